@@ -0,0 +1,83 @@
+package gtfs
+
+// AccessibilityProfile restricts the trips, stops and transfers an Itinerary may use.
+// A nil *AccessibilityProfile allows everything.
+type AccessibilityProfile struct {
+	// Only board trips with wheelchair_accessible=1
+	WheelchairTrips bool
+
+	// Only board and alight at stops with wheelchair_boarding=1 (inherited from the parent station when unknown)
+	WheelchairStops bool
+
+	// Only transfer between two stops through pathways that have no stairs nor escalators.
+	// Stops without any pathway information are considered step-free.
+	StepFree bool
+}
+
+// WheelchairProfile returns a profile for riders in a wheelchair: accessible trips, accessible stops
+// and step-free transfers only.
+func WheelchairProfile() *AccessibilityProfile {
+	return &AccessibilityProfile{WheelchairTrips: true, WheelchairStops: true, StepFree: true}
+}
+
+func (p *AccessibilityProfile) AllowsTrip(t *Trip) bool {
+	if p == nil || !p.WheelchairTrips {
+		return true
+	}
+	return t.WheelchairAccessible == WheelchairAccessible
+}
+
+func (p *AccessibilityProfile) AllowsStop(s *Stop) bool {
+	if p == nil || !p.WheelchairStops {
+		return true
+	}
+	return s.EffectiveWheelchairBoarding() == WheelchairAccessible
+}
+
+// AllowsBoarding returns true if the rider can get on st.Trip at st.Stop
+func (p *AccessibilityProfile) AllowsBoarding(st *StopTime) bool {
+	return st.Stop != nil && p.AllowsTrip(st.Trip) && p.AllowsStop(st.Stop)
+}
+
+// AllowsTransfer returns true if the rider can go from one stop to the other, looking for a
+// step-free path in the pathways graph when the profile requires it.
+func (p *AccessibilityProfile) AllowsTransfer(from, to *Stop) bool {
+	if p == nil || !p.StepFree || from == to {
+		return true
+	}
+	if len(from.Pathways) == 0 || len(to.Pathways) == 0 {
+		return true
+	}
+
+	// Breadth first search in the station's pathways, by stop ids
+	visited := map[string]bool{from.Id: true}
+	queue := []*Stop{from}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, pathway := range current.Pathways {
+			if pathway.HasSteps() {
+				continue
+			}
+			var nextId string
+			if pathway.FromStopId == current.Id {
+				nextId = pathway.ToStopId
+			} else if pathway.IsBidirectional && pathway.ToStopId == current.Id {
+				nextId = pathway.FromStopId
+			} else {
+				continue
+			}
+			if nextId == to.Id {
+				return true
+			}
+			if visited[nextId] {
+				continue
+			}
+			visited[nextId] = true
+			if next := from.feed.StopCollection.Stop(nextId); next != nil {
+				queue = append(queue, next)
+			}
+		}
+	}
+	return false
+}
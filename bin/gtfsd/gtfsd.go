@@ -9,10 +9,13 @@ import (
 	"fmt"
 	"github.com/nicolaspaton/gogtfs"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -176,6 +179,12 @@ func main() {
 		http.HandleFunc("/", Index)
 		http.HandleFunc("/shapes.json", Shapes)
 		http.HandleFunc("/trips.json", Trips)
+		http.HandleFunc("/stops.geojson", GeoJSON((*gtfs.Feed).StopsGeoJSON))
+		http.HandleFunc("/shapes.geojson", GeoJSON((*gtfs.Feed).ShapesGeoJSON))
+		http.HandleFunc("/routes.geojson", GeoJSON((*gtfs.Feed).RoutesGeoJSON))
+		http.HandleFunc("/patterns.geojson", GeoJSON((*gtfs.Feed).PatternsGeoJSON))
+		http.HandleFunc("/tiles/", Tiles)
+		http.HandleFunc("/tiles.json", TileJSON)
 		http.Handle("/gtfs", websocket.Handler(GTFSSocket))
 		http.HandleFunc("/load", LoadFeed)
 
@@ -194,6 +203,91 @@ func main() {
 
 var currentFeed string
 
+// Vector tiles of each feed, created on first request
+var (
+	tiles     = make(map[*gtfs.Feed]*gtfs.VectorTiles)
+	tilesLock sync.Mutex
+)
+
+// Simplified shapes and shape duplicates of each feed, created on first request and dropped when
+// the feed is reloaded or its shapes change (its shape index is rebuilt)
+type simplificationKey struct {
+	method    int
+	tolerance float64
+}
+
+type simplifications struct {
+	index      *gtfs.ShapeIndex
+	shapes     map[simplificationKey]map[string]*gtfs.Shape
+	duplicates map[string]string // See Feed.ShapeDuplicates
+}
+
+// Tolerances whose simplified shapes are cached, the others are simplified on each request so that
+// clients can't grow the cache without limit
+var cachedTolerances = map[float64]bool{0: true, 1: true, 2: true, 5: true, 10: true, 20: true, 50: true, 100: true}
+
+var (
+	simplified     = make(map[*gtfs.Feed]*simplifications)
+	simplifiedLock sync.Mutex
+)
+
+// simplificationsOf returns the cache of feed, a new one if its shapes changed. simplifiedLock must be held.
+func simplificationsOf(feed *gtfs.Feed) *simplifications {
+	index := feed.ShapeIndex()
+	if simplified[feed] == nil || simplified[feed].index != index {
+		simplified[feed] = &simplifications{index: index, shapes: make(map[simplificationKey]map[string]*gtfs.Shape)}
+	}
+	return simplified[feed]
+}
+
+// simplifiedShapes returns feed.SimplifiedShapes(method, tolerance), cached and shared between requests
+// for the cachedTolerances
+func simplifiedShapes(feed *gtfs.Feed, method int, tolerance float64) map[string]*gtfs.Shape {
+	if !cachedTolerances[tolerance] {
+		return feed.SimplifiedShapes(method, tolerance)
+	}
+	key := simplificationKey{method, tolerance}
+	simplifiedLock.Lock()
+	cache := simplificationsOf(feed)
+	shapes := cache.shapes[key]
+	simplifiedLock.Unlock()
+	if shapes != nil {
+		return shapes
+	}
+
+	// Computed outside the lock, other requests aren't blocked meanwhile
+	shapes = feed.SimplifiedShapes(method, tolerance)
+	simplifiedLock.Lock()
+	if existing := cache.shapes[key]; existing != nil {
+		shapes = existing
+	} else {
+		cache.shapes[key] = shapes
+	}
+	simplifiedLock.Unlock()
+	return shapes
+}
+
+// shapeDuplicates returns feed.ShapeDuplicates(), computed once per feed load
+func shapeDuplicates(feed *gtfs.Feed) map[string]string {
+	simplifiedLock.Lock()
+	cache := simplificationsOf(feed)
+	duplicates := cache.duplicates
+	simplifiedLock.Unlock()
+	if duplicates != nil {
+		return duplicates
+	}
+
+	duplicates = feed.ShapeDuplicates()
+	simplifiedLock.Lock()
+	if cache.duplicates != nil {
+		duplicates = cache.duplicates
+	} else {
+		cache.duplicates = duplicates
+	}
+	simplifiedLock.Unlock()
+	return duplicates
+}
+
 func Index(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "web/index.html")
 }
@@ -205,7 +299,54 @@ func Shapes(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "{}")
 		return
 	}
-	shapes, err := json.Marshal(feeds[currentFeed].Shapes)
+	// Query parameters:
+	// 	tolerance - simplification tolerance in meters (default 5, 0 sends every point), 0, 1, 2, 5, 10, 20,
+	// 	            50 and 100 are cached
+	// 	method - "douglas-peucker" (default) or "visvalingam"
+	// 	dedupe - "1" to send identical shapes once
+	// 	encoded - "1" to send encoded polylines instead of points
+	feed := feeds[currentFeed]
+	tolerance := 5.0
+	if v := r.FormValue("tolerance"); v != "" {
+		var err error
+		if tolerance, err = strconv.ParseFloat(v, 64); err != nil || math.IsNaN(tolerance) || tolerance < 0 {
+			http.Error(w, "tolerance must be a number of meters, 0 or more", http.StatusBadRequest)
+			return
+		}
+	}
+	method := gtfs.DouglasPeucker
+	if r.FormValue("method") == "visvalingam" {
+		method = gtfs.Visvalingam
+	}
+	simplified := simplifiedShapes(feed, method, tolerance)
+	if r.FormValue("dedupe") == "1" {
+		// The cached map is shared, filter a copy
+		duplicates := shapeDuplicates(feed)
+		unique := make(map[string]*gtfs.Shape, len(simplified))
+		for id, shape := range simplified {
+			if _, ok := duplicates[id]; !ok {
+				unique[id] = shape
+			}
+		}
+		simplified = unique
+	}
+
+	var shapes []byte
+	var err error
+	if r.FormValue("encoded") == "1" {
+		type encodedShape struct {
+			Id       string
+			Color    string
+			Polyline string
+		}
+		encoded := make(map[string]*encodedShape, len(simplified))
+		for id, shape := range simplified {
+			encoded[id] = &encodedShape{shape.Id, shape.Color, shape.EncodedPolyline()}
+		}
+		shapes, err = json.Marshal(encoded)
+	} else {
+		shapes, err = json.Marshal(simplified)
+	}
 
 	if err != nil {
 		panic(err)
@@ -235,6 +376,85 @@ func Trips(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// GeoJSON serves the FeatureCollection built by export for the current feed, limited to the
+// "bbox" query parameter (minLon,minLat,maxLon,maxLat) when given
+func GeoJSON(export func(*gtfs.Feed, *gtfs.BoundingBox) *gtfs.GeoJSONFeatureCollection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/geo+json")
+		if currentFeed == "" {
+			fmt.Fprint(w, "{\"type\":\"FeatureCollection\",\"features\":[]}")
+			return
+		}
+		var bbox *gtfs.BoundingBox
+		if v := r.FormValue("bbox"); v != "" {
+			var err error
+			if bbox, err = gtfs.ParseBoundingBox(v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		collection, err := json.Marshal(export(feeds[currentFeed], bbox))
+		if err != nil {
+			panic(err)
+		}
+		w.Write(collection)
+	}
+}
+
+// TileJSON serves /tiles.json, the TileJSON (https://github.com/mapbox/tilejson-spec) describing the
+// vector tiles of the current feed, used by the map of web/index.html
+func TileJSON(w http.ResponseWriter, r *http.Request) {
+	if currentFeed == "" {
+		http.NotFound(w, r)
+		return
+	}
+	layers := make([]map[string]interface{}, 0, 3)
+	for _, layer := range []string{"stops", "shapes", "routes"} {
+		layers = append(layers, map[string]interface{}{"id": layer, "fields": map[string]string{}})
+	}
+	tileJSON := map[string]interface{}{
+		"tilejson":      "2.2.0",
+		"tiles":         []string{"http://" + r.Host + "/tiles/{z}/{x}/{y}.mvt"},
+		"minzoom":       0,
+		"maxzoom":       18,
+		"vector_layers": layers,
+	}
+	if bounds := feeds[currentFeed].StopCollection.Bounds(); bounds != nil {
+		tileJSON["bounds"] = []float64{bounds.MinLon, bounds.MinLat, bounds.MaxLon, bounds.MaxLat}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tileJSON)
+}
+
+// Tiles serves /tiles/{z}/{x}/{y}.mvt vector tiles of the current feed
+func Tiles(w http.ResponseWriter, r *http.Request) {
+	var z, x, y int
+	if n, _ := fmt.Sscanf(r.URL.Path, "/tiles/%d/%d/%d.mvt", &z, &x, &y); n != 3 || !strings.HasSuffix(r.URL.Path, ".mvt") {
+		http.NotFound(w, r)
+		return
+	}
+	if currentFeed == "" {
+		http.NotFound(w, r)
+		return
+	}
+	feed := feeds[currentFeed]
+
+	tilesLock.Lock()
+	if tiles[feed] == nil {
+		tiles[feed] = gtfs.NewVectorTiles(feed)
+	}
+	vectorTiles := tiles[feed]
+	tilesLock.Unlock()
+
+	tile, err := vectorTiles.Tile(z, x, y)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.Write(tile)
+}
+
 func LoadFeed(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/nicolaspaton/gogtfs"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit statuses
+const (
+	exitOk      = 0
+	exitFailure = 1 // The feed couldn't be read, or bad usage
+	exitWarning = 2 // The command found issues in the feed
+)
+
+type command struct {
+	name        string
+	description string
+	run         func(args []string) int
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"calendar", "Service range, days without or with little service, inactive services and expiry", calendarCommand},
+		{"integrity", "References to missing agencies, routes, services, shapes, trips and stops", integrityCommand},
+		{"stats", "Service hours, kilometres, trips, span, headways and peak vehicles per agency and route", statsCommand},
+		{"headways", "Headways by time band per stop and route-direction, and the frequent network", headwaysCommand},
+		{"diff", "Agencies, stops, routes, trips, calendars and shapes changed between two versions of a feed", diffCommand},
+		{"merge", "Combine feeds into one, prefixing colliding ids and merging shared stops", mergeCommand},
+		{"subset", "Cut a feed down to agencies, routes, route types, a bounding box and a date window", subsetCommand},
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: gtfstool <command> [options] <feed paths (zip files or directories)>")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.description)
+	}
+	fmt.Fprintln(os.Stderr, "Run gtfstool <command> -h for the options of a command.")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitFailure)
+	}
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			os.Exit(c.run(os.Args[2:]))
+		}
+	}
+	usage()
+	os.Exit(exitFailure)
+}
+
+// newFlagSet returns the flags of a command, with the common ones
+func newFlagSet(name, arguments string) (flags *flag.FlagSet, verbose *bool) {
+	flags = flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gtfstool %s [options] %s\n", name, arguments)
+		flags.PrintDefaults()
+	}
+	verbose = flags.Bool("v", false, "Log the loading of the feed to Stderr")
+	return
+}
+
+// loadFeed loads the feed at path, logging only if verbose
+func loadFeed(path string, verbose bool) (*gtfs.Feed, error) {
+	if !verbose {
+		devNull, _ := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		log.SetOutput(devNull)
+	}
+	log.SetPrefix("gtfs - ")
+	feed, err := gtfs.NewFeed(path)
+	if err != nil {
+		return nil, err
+	}
+	return feed, feed.Load()
+}
+
+func formatDate(date time.Time) string {
+	return date.Format("Mon 2006-01-02")
+}
+
+func calendarCommand(args []string) int {
+	flags, verbose := newFlagSet("calendar", "<feed path>")
+	days := flags.Int("days", 30, "Warn when the feed expires within this number of days")
+	low := flags.Float64("low", 0.5, "Report days with less than this share of the usual trips of their weekday")
+	asJSON := flags.Bool("json", false, "Output the analysis as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitFailure
+	}
+
+	feed, err := loadFeed(flags.Arg(0), *verbose)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	analyzer := gtfs.NewCalendarAnalyzer(feed)
+	analyzer.ExpiryWarningDays = *days
+	analyzer.LowServiceRatio = *low
+	coverage, err := analyzer.Run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(coverage)
+	} else {
+		fmt.Printf("Service range: %s to %s (%d days)\n", formatDate(coverage.Start), formatDate(coverage.End), len(coverage.Days))
+		for _, day := range coverage.NoServiceDays {
+			fmt.Printf("No service:  %s (%.0f trips usually)\n", formatDate(day.Date), day.Expected)
+		}
+		for _, day := range coverage.LowServiceDays {
+			fmt.Printf("Low service: %s, %d trips (%.0f usually)\n", formatDate(day.Date), day.Trips, day.Expected)
+		}
+		for _, id := range coverage.InactiveServices {
+			fmt.Printf("Never active service: %s\n", id)
+		}
+		switch {
+		case coverage.ExpiresIn < 0:
+			fmt.Printf("WARNING: the feed expired %d days ago\n", -coverage.ExpiresIn)
+		case coverage.Expiring:
+			fmt.Printf("WARNING: the feed expires in %d days\n", coverage.ExpiresIn)
+		default:
+			fmt.Printf("The feed expires in %d days\n", coverage.ExpiresIn)
+		}
+	}
+
+	if coverage.Expiring {
+		return exitWarning
+	}
+	return exitOk
+}
+
+func integrityCommand(args []string) int {
+	flags, verbose := newFlagSet("integrity", "[-repair -o <output path>] <feed path>")
+	asJSON := flags.Bool("json", false, "Output the dangling references as JSON")
+	repair := flags.Bool("repair", false, "Fix the dangling references and write the repaired feed to -o")
+	strategy := flags.String("strategy", "drop", "With -repair, drop the records referencing missing entities or create placeholder entities: drop or placeholder")
+	output := flags.String("o", "", "Path of the repaired feed, a zip file if it ends with .zip or else a directory")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *repair && *output == "" {
+		flags.Usage()
+		return exitFailure
+	}
+	strategies := map[string]int{"drop": gtfs.RepairDrop, "placeholder": gtfs.RepairPlaceholder}
+	if _, ok := strategies[*strategy]; !ok {
+		fmt.Fprintln(os.Stderr, "Invalid -strategy, expected drop or placeholder")
+		return exitFailure
+	}
+
+	feed, err := loadFeed(flags.Arg(0), *verbose)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	integrity := gtfs.NewIntegrityRepair(feed)
+	integrity.Strategy = strategies[*strategy]
+	var references []*gtfs.DanglingReference
+	if *repair {
+		references = integrity.Repair()
+		if err := feed.Write(*output); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+	} else {
+		references = integrity.Check()
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(references)
+	} else {
+		for _, reference := range references {
+			if reference.Repair != "" {
+				fmt.Printf("%s (%s)\n", reference, reference.Repair)
+			} else {
+				fmt.Println(reference)
+			}
+		}
+		fmt.Printf("%d dangling references\n", len(references))
+		if *repair {
+			fmt.Println("Repaired feed written to", *output)
+		}
+	}
+
+	if len(references) > 0 {
+		return exitWarning
+	}
+	return exitOk
+}
+
+func statsCommand(args []string) int {
+	flags, verbose := newFlagSet("stats", "<feed path>")
+	now := time.Now()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	from := flags.String("from", month.Format("20060102"), "First day of the period, YYYYMMDD")
+	to := flags.String("to", month.AddDate(0, 1, -1).Format("20060102"), "Last day of the period, YYYYMMDD")
+	asJSON := flags.Bool("json", false, "Output the statistics as JSON instead of CSV")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitFailure
+	}
+	start, err := gtfs.StringDateToTime(*from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid -from date:", err)
+		return exitFailure
+	}
+	end, err := gtfs.StringDateToTime(*to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid -to date:", err)
+		return exitFailure
+	}
+
+	feed, err := loadFeed(flags.Arg(0), *verbose)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	calculator := gtfs.NewStatsCalculator(feed)
+	calculator.Start, calculator.End = start, end
+	stats, err := calculator.Run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	if *asJSON {
+		err = stats.WriteJSON(os.Stdout)
+	} else {
+		err = stats.WriteCSV(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	return exitOk
+}
+
+func headwaysCommand(args []string) int {
+	flags, verbose := newFlagSet("headways", "<feed path>")
+	date := flags.String("date", time.Now().Format("20060102"), "Day of service, YYYYMMDD")
+	minutes := flags.Uint("frequent", 10, "Headway in minutes of the frequent network")
+	asGeoJSON := flags.Bool("geojson", false, "Output the segments and stops as GeoJSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitFailure
+	}
+	day, err := gtfs.StringDateToTime(*date)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid -date:", err)
+		return exitFailure
+	}
+
+	feed, err := loadFeed(flags.Arg(0), *verbose)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	analyzer := gtfs.NewHeadwayAnalyzer(feed)
+	analyzer.Date = day
+	analyzer.FrequentHeadway = *minutes * 60
+	report := analyzer.Run()
+
+	if *asGeoJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.Encode(report.GeoJSON())
+		return exitOk
+	}
+	fmt.Printf("Service on %s, frequent network every %d minutes or better during %s\n", formatDate(report.Date), *minutes, strings.Join(analyzer.FrequentBands, ", "))
+	for _, rd := range report.RouteDirections {
+		frequent := 0
+		for _, segment := range rd.Segments {
+			if segment.Frequent {
+				frequent++
+			}
+		}
+		fmt.Printf("Route %s direction %d:", rd.Route.Id, rd.Direction)
+		for _, band := range rd.Bands {
+			if band.Departures > 1 {
+				fmt.Printf(" %s %.0f min,", band.Band, band.Median/60)
+			}
+		}
+		fmt.Printf(" %d/%d frequent segments\n", frequent, len(rd.Segments))
+	}
+	frequent := 0
+	for _, stop := range report.Stops {
+		if stop.Frequent {
+			frequent++
+		}
+	}
+	fmt.Printf("%d/%d frequent stops\n", frequent, len(report.Stops))
+	return exitOk
+}
+
+func diffCommand(args []string) int {
+	flags, verbose := newFlagSet("diff", "<old feed path> <new feed path>")
+	threshold := flags.Float64("moved", 1, "Distance in meters under which stops and shapes are considered not moved")
+	asJSON := flags.Bool("json", false, "Output the changes as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return exitFailure
+	}
+
+	feeds := make([]*gtfs.Feed, 2)
+	for i := range feeds {
+		feed, err := loadFeed(flags.Arg(i), *verbose)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, flags.Arg(i)+":", err)
+			return exitFailure
+		}
+		feeds[i] = feed
+	}
+	differ := gtfs.NewFeedDiffer(feeds[0], feeds[1])
+	differ.MoveThreshold = *threshold
+	diff := differ.Run()
+
+	var err error
+	if *asJSON {
+		err = diff.WriteJSON(os.Stdout)
+	} else {
+		err = diff.WriteSummary(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	if len(diff.Changes) > 0 {
+		return exitWarning
+	}
+	return exitOk
+}
+
+func mergeCommand(args []string) int {
+	flags, verbose := newFlagSet("merge", "-o <output path> <feed paths>")
+	output := flags.String("o", "", "Path of the merged feed, a zip file if it ends with .zip or else a directory")
+	prefixAll := flags.Bool("prefix-all", false, "Prefix the ids of every feed (1_, 2_, ...), not only the colliding ones")
+	distance := flags.Float64("distance", 20, "Distance in meters under which stops with similar names are merged, 0 to keep all the stops")
+	flags.Parse(args)
+	if flags.NArg() < 2 || *output == "" {
+		flags.Usage()
+		return exitFailure
+	}
+
+	feeds := make([]*gtfs.Feed, flags.NArg())
+	for i := range feeds {
+		feed, err := loadFeed(flags.Arg(i), *verbose)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, flags.Arg(i)+":", err)
+			return exitFailure
+		}
+		feeds[i] = feed
+	}
+	merger := gtfs.NewFeedMerger(feeds...)
+	if *prefixAll {
+		merger.Collisions = gtfs.CollisionPrefixAll
+	}
+	merger.MergeStops = *distance > 0
+	merger.StopDistance = *distance
+	merged, err := merger.Run()
+	if err == nil {
+		err = merged.Write(*output)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	fmt.Printf("%d feeds merged into %s, %d stops merged, %d ids renamed\n", len(feeds), *output, merger.MergedStops, merger.RenamedIds)
+	return exitOk
+}
+
+// splitList returns the comma separated values of a flag, nil when it is empty
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func subsetCommand(args []string) int {
+	flags, verbose := newFlagSet("subset", "-o <output path> <feed path>")
+	output := flags.String("o", "", "Path of the subset, a zip file if it ends with .zip or else a directory")
+	agencyIds := flags.String("agencies", "", "Agency ids to keep, comma separated")
+	routeIds := flags.String("routes", "", "Route ids to keep, comma separated")
+	routeTypes := flags.String("route-types", "", "Route types to keep, comma separated")
+	bbox := flags.String("bbox", "", "Bounding box of the stops to keep: min lon,min lat,max lon,max lat")
+	from := flags.String("from", "", "First day of the date window, YYYYMMDD")
+	to := flags.String("to", "", "Last day of the date window, YYYYMMDD")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *output == "" {
+		flags.Usage()
+		return exitFailure
+	}
+
+	feed, err := loadFeed(flags.Arg(0), *verbose)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	subset := gtfs.NewFeedSubset(feed)
+	if ids := splitList(*agencyIds); ids != nil {
+		subset.Agencies = gtfs.AgencyIdFilter(ids...)
+	}
+	if ids := splitList(*routeIds); ids != nil {
+		subset.Routes = gtfs.RouteIdFilter(ids...)
+	}
+	if values := splitList(*routeTypes); values != nil {
+		types := make([]byte, len(values))
+		for i, value := range values {
+			routeType, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Invalid -route-types:", err)
+				return exitFailure
+			}
+			types[i] = byte(routeType)
+		}
+		typeFilter, idFilter := gtfs.RoutesOfTypeFilter(types...), subset.Routes
+		subset.Routes = typeFilter
+		if idFilter != nil {
+			subset.Routes = func(route *gtfs.Route) bool { return idFilter(route) && typeFilter(route) }
+		}
+	}
+	if *bbox != "" {
+		box, err := gtfs.ParseBoundingBox(*bbox)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -bbox:", err)
+			return exitFailure
+		}
+		subset.Stops = gtfs.BoundingBoxFilter(box.MinLat, box.MinLon, box.MaxLat, box.MaxLon)
+	}
+	if *from != "" {
+		if subset.Start, err = gtfs.StringDateToTime(*from); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -from date:", err)
+			return exitFailure
+		}
+	}
+	if *to != "" {
+		if subset.End, err = gtfs.StringDateToTime(*to); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -to date:", err)
+			return exitFailure
+		}
+	}
+
+	cut, err := subset.Run()
+	if err == nil {
+		err = cut.Write(*output)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	fmt.Printf("%d of %d trips and %d of %d stops kept in %s\n", len(cut.Trips), len(feed.Trips), cut.StopCollection.Length(), feed.StopCollection.Length(), *output)
+	return exitOk
+}
@@ -2,6 +2,7 @@ package gtfs
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"time"
 	// "log"
@@ -97,6 +98,38 @@ func (c *Calendar) ValidOn(intday int, t *time.Time) bool {
 	return false
 }
 
+// ServiceDates returns the days (YYYYMMDD) a service runs on according to calendar.txt and
+// calendar_dates.txt, in order
+func (f *Feed) ServiceDates(serviceId string) []int {
+	days := make(map[int]bool)
+	if calendar, ok := f.Calendars[serviceId]; ok {
+		start, errStart := StringDateToTime(strconv.Itoa(calendar.StartDate))
+		end, errEnd := StringDateToTime(strconv.Itoa(calendar.EndDate))
+		if errStart == nil && errEnd == nil {
+			for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+				intday := day.Year()*10000 + int(day.Month())*100 + day.Day()
+				if calendar.ValidOn(intday, &day) {
+					days[intday] = true
+				}
+			}
+		}
+	}
+	for _, cd := range f.CalendarDates[serviceId] {
+		if cd.ExceptionType == CalendarExceptionAddedService {
+			days[cd.Date] = true
+		} else {
+			delete(days, cd.Date)
+		}
+	}
+
+	dates := make([]int, 0, len(days))
+	for day := range days {
+		dates = append(dates, day)
+	}
+	sort.Ints(dates)
+	return dates
+}
+
 func (c *Calendar) setField(fieldName, val string) {
 	// log.Println("setField", fieldName, value)
 	switch fieldName {
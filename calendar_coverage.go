@@ -0,0 +1,161 @@
+package gtfs
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ServiceDay is the service scheduled on a date
+type ServiceDay struct {
+	Date     time.Time
+	Trips    int     // Trips running that day, frequency based trips counting once per run
+	Expected float64 // Median number of trips of the same weekday over the service range
+}
+
+// CalendarCoverage is the result of a CalendarAnalyzer
+type CalendarCoverage struct {
+	// Effective service range, first and last days with trips
+	Start time.Time
+	End   time.Time
+
+	// Every day of the service range
+	Days []*ServiceDay
+
+	NoServiceDays  []*ServiceDay // Days without trips when the same weekday usually has some
+	LowServiceDays []*ServiceDay // Days with less than CalendarAnalyzer.LowServiceRatio of the usual trips
+
+	// Services used by trips or defined in calendars that never run, sorted
+	InactiveServices []string
+
+	ExpiresIn int  // Days from today to the end of the service range, negative once expired
+	Expiring  bool // ExpiresIn is less than CalendarAnalyzer.ExpiryWarningDays
+}
+
+// CalendarAnalyzer computes the days a feed provides service on from its calendars, and finds the
+// gaps and the approaching expiry
+type CalendarAnalyzer struct {
+	Today             time.Time // Default: time.Now()
+	ExpiryWarningDays int       // Default: 30
+	LowServiceRatio   float64   // Default: 0.5
+
+	feed *Feed
+}
+
+func NewCalendarAnalyzer(f *Feed) (a *CalendarAnalyzer) {
+	a = &CalendarAnalyzer{}
+	a.Today = time.Now()
+	a.ExpiryWarningDays = 30
+	a.LowServiceRatio = 0.5
+	a.feed = f
+	return
+}
+
+// intDateToTime converts a YYYYMMDD date to midnight UTC
+func intDateToTime(date int) time.Time {
+	return time.Date(date/10000, time.Month(date/100%100), date%100, 0, 0, 0, 0, time.UTC)
+}
+
+// runsCount returns the number of runs of a trip in a day, more than one for frequency based trips
+func runsCount(trip *Trip) int {
+	if len(trip.Frequencies) == 0 {
+		return 1
+	}
+	runs := 0
+	for _, freq := range trip.Frequencies {
+		if freq.HeadwaySecs > 0 && freq.EndTime > freq.StartTime {
+			runs += int((freq.EndTime - freq.StartTime + freq.HeadwaySecs - 1) / freq.HeadwaySecs)
+		}
+	}
+	return runs
+}
+
+func median(values []int) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+	if len(sorted)%2 == 1 {
+		return float64(sorted[len(sorted)/2])
+	}
+	return float64(sorted[len(sorted)/2-1]+sorted[len(sorted)/2]) / 2
+}
+
+// Run analyzes the calendars. It fails when no trip ever runs.
+func (a *CalendarAnalyzer) Run() (*CalendarCoverage, error) {
+	// Runs per service, and all the services
+	runs := make(map[string]int)
+	for _, trip := range a.feed.Trips {
+		runs[trip.serviceId] += runsCount(trip)
+	}
+	services := make(map[string]bool)
+	for id := range runs {
+		services[id] = true
+	}
+	for id := range a.feed.Calendars {
+		services[id] = true
+	}
+	for id := range a.feed.CalendarDates {
+		services[id] = true
+	}
+
+	coverage := &CalendarCoverage{
+		Days:             make([]*ServiceDay, 0),
+		NoServiceDays:    make([]*ServiceDay, 0),
+		LowServiceDays:   make([]*ServiceDay, 0),
+		InactiveServices: make([]string, 0),
+	}
+	trips := make(map[int]int)
+	for id := range services {
+		dates := a.feed.ServiceDates(id)
+		if len(dates) == 0 {
+			coverage.InactiveServices = append(coverage.InactiveServices, id)
+			continue
+		}
+		for _, date := range dates {
+			trips[date] += runs[id]
+		}
+	}
+	sort.Strings(coverage.InactiveServices)
+
+	first, last := 0, 0
+	for date, count := range trips {
+		if count == 0 {
+			continue
+		}
+		if first == 0 || date < first {
+			first = date
+		}
+		if date > last {
+			last = date
+		}
+	}
+	if first == 0 {
+		return nil, errors.New("No trip runs on any day")
+	}
+	coverage.Start, coverage.End = intDateToTime(first), intDateToTime(last)
+
+	byWeekday := make(map[time.Weekday][]int)
+	for day := coverage.Start; !day.After(coverage.End); day = day.AddDate(0, 0, 1) {
+		count := trips[day.Year()*10000+int(day.Month())*100+day.Day()]
+		coverage.Days = append(coverage.Days, &ServiceDay{Date: day, Trips: count})
+		byWeekday[day.Weekday()] = append(byWeekday[day.Weekday()], count)
+	}
+	for _, day := range coverage.Days {
+		day.Expected = median(byWeekday[day.Date.Weekday()])
+		if day.Expected == 0 {
+			continue
+		}
+		if day.Trips == 0 {
+			coverage.NoServiceDays = append(coverage.NoServiceDays, day)
+		} else if float64(day.Trips) < a.LowServiceRatio*day.Expected {
+			coverage.LowServiceDays = append(coverage.LowServiceDays, day)
+		}
+	}
+
+	today := time.Date(a.Today.Year(), a.Today.Month(), a.Today.Day(), 0, 0, 0, 0, time.UTC)
+	coverage.ExpiresIn = int(coverage.End.Sub(today).Hours() / 24)
+	coverage.Expiring = coverage.ExpiresIn < a.ExpiryWarningDays
+	return coverage, nil
+}
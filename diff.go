@@ -0,0 +1,464 @@
+package gtfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nicolaspaton/gogtfs/geo"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ChangeKind tells how an entity differs between two feeds
+type ChangeKind int
+
+const (
+	ChangeAdded    ChangeKind = iota // 0 - Only in the new feed
+	ChangeRemoved                    // 1 - Only in the old feed
+	ChangeModified                   // 2 - In both feeds, with different content
+)
+
+var changeKindNames = []string{"added", "removed", "modified"}
+
+func (k ChangeKind) String() string {
+	if k < 0 || int(k) >= len(changeKindNames) {
+		return "unknown"
+	}
+	return changeKindNames[k]
+}
+
+func (k ChangeKind) MarshalJSON() ([]byte, error) {
+	return json.Marshal(k.String())
+}
+
+// Entities of a Change
+const (
+	DiffAgency   = "agency"
+	DiffStop     = "stop"
+	DiffRoute    = "route"
+	DiffTrip     = "trip"
+	DiffCalendar = "calendar"
+	DiffShape    = "shape"
+)
+
+var diffEntities = []string{DiffAgency, DiffStop, DiffRoute, DiffTrip, DiffCalendar, DiffShape}
+
+// FieldChange is a field of an entity with a different value in the new feed. Fields are named after
+// the GTFS columns, plus stops, stop_times and frequencies for trips, dates for calendars and
+// location for stops and shapes.
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// Change is an entity added, removed or modified between two feeds
+type Change struct {
+	Kind   ChangeKind
+	Entity string // See Diff constants
+	Id     string // In the new feed, in the old one for removed entities
+	OldId  string `json:",omitempty"` // For trips matched under another id
+
+	Fields []*FieldChange `json:",omitempty"`
+	Moved  float64        `json:",omitempty"` // In meters, the distance a stop moved or the most a shape point moved
+}
+
+// FeedDiff is the result of a FeedDiffer, changes are sorted by entity then id
+type FeedDiff struct {
+	Changes []*Change
+
+	// Trips whose id changed, old id → new id
+	RenamedTrips map[string]string
+}
+
+// Count returns the number of changes of a kind for an entity
+func (d *FeedDiff) Count(entity string, kind ChangeKind) (count int) {
+	for _, change := range d.Changes {
+		if change.Entity == entity && change.Kind == kind {
+			count++
+		}
+	}
+	return
+}
+
+// FeedDiffer compares two versions of a feed by id and content. Trips whose id changed (some exports
+// regenerate them each time) are matched by route, service, direction and first departure, their
+// stops and times then being compared.
+type FeedDiffer struct {
+	MoveThreshold float64 // In meters, stops and shape points moving less are unchanged. Default: 1
+	MatchTrips    bool    // Match the trips whose id changed. Default: true
+
+	before *Feed
+	after  *Feed
+}
+
+func NewFeedDiffer(before, after *Feed) (d *FeedDiffer) {
+	d = &FeedDiffer{}
+	d.MoveThreshold = 1
+	d.MatchTrips = true
+	d.before = before
+	d.after = after
+	return
+}
+
+// diffRecords are the compared fields of the entities of a feed, by id
+type diffRecords map[string][]string
+
+// idPairs matches the ids of two sets of records, returning the ids found in both, and the ones
+// removed and added, sorted
+func idPairs(before, after diffRecords) (pairs [][2]string, removed, added []string) {
+	for id := range before {
+		if _, ok := after[id]; ok {
+			pairs = append(pairs, [2]string{id, id})
+		} else {
+			removed = append(removed, id)
+		}
+	}
+	for id := range after {
+		if _, ok := before[id]; !ok {
+			added = append(added, id)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][1] < pairs[j][1] })
+	sort.Strings(removed)
+	sort.Strings(added)
+	return
+}
+
+// compare adds the changes of an entity to the diff. extra returns the changes of a pair of records
+// not held in their fields.
+func (d *FeedDiff) compare(entity string, fields []string, before, after diffRecords, pairs [][2]string, removed, added []string, extra func(oldId, newId string) (*FieldChange, float64)) {
+	for _, id := range added {
+		d.Changes = append(d.Changes, &Change{Kind: ChangeAdded, Entity: entity, Id: id})
+	}
+	for _, id := range removed {
+		d.Changes = append(d.Changes, &Change{Kind: ChangeRemoved, Entity: entity, Id: id})
+	}
+	for _, pair := range pairs {
+		change := &Change{Kind: ChangeModified, Entity: entity, Id: pair[1], Fields: make([]*FieldChange, 0)}
+		if pair[0] != pair[1] {
+			change.OldId = pair[0]
+		}
+		for i, field := range fields {
+			if oldValue, newValue := before[pair[0]][i], after[pair[1]][i]; oldValue != newValue {
+				change.Fields = append(change.Fields, &FieldChange{field, oldValue, newValue})
+			}
+		}
+		if extra != nil {
+			if field, moved := extra(pair[0], pair[1]); field != nil {
+				change.Fields = append(change.Fields, field)
+				change.Moved = moved
+			}
+		}
+		if len(change.Fields) > 0 {
+			d.Changes = append(d.Changes, change)
+		}
+	}
+}
+
+func boolDigit(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func formatCoordinate(lat, lon float64) string {
+	return strconv.FormatFloat(lat, 'f', -1, 64) + "," + strconv.FormatFloat(lon, 'f', -1, 64)
+}
+
+var agencyDiffFields = []string{"agency_name", "agency_url", "agency_timezone", "agency_lang", "agency_phone"}
+
+func agencyRecords(f *Feed) diffRecords {
+	records := make(diffRecords)
+	for id, a := range f.Agencies {
+		records[id] = []string{a.Name, a.Url, a.Timezone, a.Lang, a.Phone}
+	}
+	return records
+}
+
+var stopDiffFields = []string{"stop_code", "stop_name", "stop_desc", "zone_id", "stop_url", "location_type", "parent_station", "wheelchair_boarding"}
+
+func stopRecords(f *Feed) diffRecords {
+	records := make(diffRecords)
+	for id, s := range f.StopCollection.Stops {
+		records[id] = []string{s.Code, s.Name, s.Desc, s.ZoneId, s.Url, strconv.Itoa(int(s.LocationType)), s.ParentStationId, strconv.Itoa(int(s.WheelchairBoarding))}
+	}
+	return records
+}
+
+var routeDiffFields = []string{"agency_id", "route_short_name", "route_long_name", "route_desc", "route_type", "route_url", "route_color", "route_text_color"}
+
+func routeRecords(f *Feed) diffRecords {
+	records := make(diffRecords)
+	for id, r := range f.Routes {
+		agencyId := r.agencyId
+		if r.Agency != nil {
+			agencyId = r.Agency.Id
+		}
+		records[id] = []string{agencyId, r.ShortName, r.LongName, r.Desc, strconv.Itoa(int(r.Type)), r.Url, r.Color, r.TextColor}
+	}
+	return records
+}
+
+var tripDiffFields = []string{"route_id", "service_id", "trip_headsign", "trip_short_name", "direction_id", "block_id", "shape_id", "wheelchair_accessible", "stops", "stop_times", "frequencies"}
+
+// Indexes of the stops and stop_times fields in tripDiffFields
+const tripStopsField, tripStopTimesField = 8, 9
+
+func tripRecords(f *Feed) diffRecords {
+	records := make(diffRecords)
+	for id, t := range f.Trips {
+		routeId := t.routeId
+		if t.Route != nil {
+			routeId = t.Route.Id
+		}
+		stops := make([]string, 0, len(t.StopTimes))
+		times := make([]string, 0, len(t.StopTimes))
+		for _, st := range stopTimesOf(t) {
+			stopId := st.stopId
+			if st.Stop != nil {
+				stopId = st.Stop.Id
+			}
+			stops = append(stops, stopId)
+			time := formatTimeOfDay(st.ArrivalTime)
+			if st.DepartureTime != st.ArrivalTime {
+				time += "-" + formatTimeOfDay(st.DepartureTime)
+			}
+			times = append(times, time)
+		}
+		frequencies := make([]string, 0, len(t.Frequencies))
+		for _, freq := range t.Frequencies {
+			frequencies = append(frequencies, fmt.Sprintf("%s-%s/%d", formatTimeOfDay(freq.StartTime), formatTimeOfDay(freq.EndTime), freq.HeadwaySecs))
+		}
+		sort.Strings(frequencies)
+		records[id] = []string{routeId, t.serviceId, t.Headsign, t.ShortName, strconv.Itoa(int(t.Direction)), t.BlockId, t.ShapeId,
+			strconv.Itoa(int(t.WheelchairAccessible)), strings.Join(stops, " "), strings.Join(times, " "), strings.Join(frequencies, " ")}
+	}
+	return records
+}
+
+var calendarDiffFields = []string{"days", "start_date", "end_date", "dates"}
+
+// calendarRecords has the calendar.txt fields of the services, days being the seven weekday flags
+// from monday, and dates their calendar_dates.txt exceptions
+func calendarRecords(f *Feed) diffRecords {
+	records := make(diffRecords)
+	for id, c := range f.Calendars {
+		days := boolDigit(c.Monday) + boolDigit(c.Tuesday) + boolDigit(c.Wednesday) + boolDigit(c.Thursday) + boolDigit(c.Friday) + boolDigit(c.Saturday) + boolDigit(c.Sunday)
+		records[id] = []string{days, strconv.Itoa(c.StartDate), strconv.Itoa(c.EndDate), ""}
+	}
+	for id, calendarDates := range f.CalendarDates {
+		if records[id] == nil {
+			records[id] = []string{"", "", "", ""}
+		}
+		dates := make([]string, 0, len(calendarDates))
+		for _, cd := range calendarDates {
+			sign := "+"
+			if cd.ExceptionType != CalendarExceptionAddedService {
+				sign = "-"
+			}
+			dates = append(dates, sign+strconv.Itoa(cd.Date))
+		}
+		sort.Strings(dates)
+		records[id][3] = strings.Join(dates, " ")
+	}
+	return records
+}
+
+var shapeDiffFields = []string{"points"}
+
+func shapeRecords(f *Feed) diffRecords {
+	records := make(diffRecords)
+	for id, s := range f.Shapes {
+		records[id] = []string{strconv.Itoa(len(s.Points))}
+	}
+	return records
+}
+
+// matchTrips pairs the removed trips with the added ones running the same route, service and
+// direction from the same first stop at the same time, preferring the ones with the same stops
+// and times. It returns the new pairs and the trips left unmatched.
+func matchTrips(before, after *Feed, oldRecords, newRecords diffRecords, removed, added []string) (pairs [][2]string, stillRemoved, stillAdded []string) {
+	key := func(f *Feed, id string) string {
+		trip := f.Trips[id]
+		stopTimes := stopTimesOf(trip)
+		if len(stopTimes) == 0 || stopTimes[0].Stop == nil {
+			return ""
+		}
+		routeId := trip.routeId
+		if trip.Route != nil {
+			routeId = trip.Route.Id
+		}
+		return strings.Join([]string{routeId, trip.serviceId, strconv.Itoa(int(trip.Direction)), stopTimes[0].Stop.Id, strconv.Itoa(int(stopTimes[0].DepartureTime))}, "\x00")
+	}
+	candidates := make(map[string][]string)
+	for _, id := range added {
+		if k := key(after, id); k != "" {
+			candidates[k] = append(candidates[k], id)
+		}
+	}
+
+	matched := make(map[string]bool)
+	for _, id := range removed {
+		k := key(before, id)
+		best := -1
+		for i, candidate := range candidates[k] {
+			if matched[candidate] {
+				continue
+			}
+			if best == -1 {
+				best = i
+			}
+			// Same stops and times
+			if oldRecords[id][tripStopsField] == newRecords[candidate][tripStopsField] && oldRecords[id][tripStopTimesField] == newRecords[candidate][tripStopTimesField] {
+				best = i
+				break
+			}
+		}
+		if best == -1 {
+			stillRemoved = append(stillRemoved, id)
+			continue
+		}
+		matched[candidates[k][best]] = true
+		pairs = append(pairs, [2]string{id, candidates[k][best]})
+	}
+	for _, id := range added {
+		if !matched[id] {
+			stillAdded = append(stillAdded, id)
+		}
+	}
+	return
+}
+
+// Run compares the feeds
+func (d *FeedDiffer) Run() *FeedDiff {
+	diff := &FeedDiff{Changes: make([]*Change, 0), RenamedTrips: make(map[string]string)}
+
+	before, after := agencyRecords(d.before), agencyRecords(d.after)
+	pairs, removed, added := idPairs(before, after)
+	diff.compare(DiffAgency, agencyDiffFields, before, after, pairs, removed, added, nil)
+
+	before, after = stopRecords(d.before), stopRecords(d.after)
+	pairs, removed, added = idPairs(before, after)
+	diff.compare(DiffStop, stopDiffFields, before, after, pairs, removed, added, func(oldId, newId string) (*FieldChange, float64) {
+		a, b := d.before.StopCollection.Stop(oldId), d.after.StopCollection.Stop(newId)
+		if moved := geo.Haversine(a.Lat, a.Lon, b.Lat, b.Lon); moved >= d.MoveThreshold {
+			return &FieldChange{"location", formatCoordinate(a.Lat, a.Lon), formatCoordinate(b.Lat, b.Lon)}, moved
+		}
+		return nil, 0
+	})
+
+	before, after = routeRecords(d.before), routeRecords(d.after)
+	pairs, removed, added = idPairs(before, after)
+	diff.compare(DiffRoute, routeDiffFields, before, after, pairs, removed, added, nil)
+
+	before, after = tripRecords(d.before), tripRecords(d.after)
+	pairs, removed, added = idPairs(before, after)
+	if d.MatchTrips {
+		var matched [][2]string
+		matched, removed, added = matchTrips(d.before, d.after, before, after, removed, added)
+		for _, pair := range matched {
+			diff.RenamedTrips[pair[0]] = pair[1]
+		}
+		pairs = append(pairs, matched...)
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i][1] < pairs[j][1] })
+	}
+	diff.compare(DiffTrip, tripDiffFields, before, after, pairs, removed, added, nil)
+
+	before, after = calendarRecords(d.before), calendarRecords(d.after)
+	pairs, removed, added = idPairs(before, after)
+	diff.compare(DiffCalendar, calendarDiffFields, before, after, pairs, removed, added, nil)
+
+	before, after = shapeRecords(d.before), shapeRecords(d.after)
+	pairs, removed, added = idPairs(before, after)
+	diff.compare(DiffShape, shapeDiffFields, before, after, pairs, removed, added, func(oldId, newId string) (*FieldChange, float64) {
+		a, b := d.before.Shapes[oldId], d.after.Shapes[newId]
+		if len(a.Points) != len(b.Points) {
+			return nil, 0
+		}
+		moved := 0.0
+		for i := range a.Points {
+			moved = maxFloat(moved, geo.Haversine(a.Points[i].Lat, a.Points[i].Lon, b.Points[i].Lat, b.Points[i].Lon))
+		}
+		if moved >= d.MoveThreshold {
+			return &FieldChange{Field: "location"}, moved
+		}
+		return nil, 0
+	})
+
+	// Entities in diffEntities order, then added, removed and modified ones, then by id
+	rank := make(map[string]int)
+	for i, entity := range diffEntities {
+		rank[entity] = i
+	}
+	sort.SliceStable(diff.Changes, func(i, j int) bool {
+		a, b := diff.Changes[i], diff.Changes[j]
+		if a.Entity != b.Entity {
+			return rank[a.Entity] < rank[b.Entity]
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Id < b.Id
+	})
+	return diff
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// WriteJSON writes the changes as an indented JSON document
+func (d *FeedDiff) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(d)
+}
+
+// WriteSummary writes the number of changes of each entity, then one line per change: + for added
+// entities, - for removed ones and ~ for modified ones with their changed fields
+func (d *FeedDiff) WriteSummary(w io.Writer) error {
+	for _, entity := range diffEntities {
+		plural := entity + "s:"
+		if entity == DiffAgency {
+			plural = "agencies:"
+		}
+		if _, err := fmt.Fprintf(w, "%-10s %d added, %d removed, %d modified\n", plural, d.Count(entity, ChangeAdded), d.Count(entity, ChangeRemoved), d.Count(entity, ChangeModified)); err != nil {
+			return err
+		}
+	}
+	if len(d.RenamedTrips) > 0 {
+		if _, err := fmt.Fprintf(w, "%d trips matched under a new id\n", len(d.RenamedTrips)); err != nil {
+			return err
+		}
+	}
+	signs := map[ChangeKind]string{ChangeAdded: "+", ChangeRemoved: "-", ChangeModified: "~"}
+	for _, change := range d.Changes {
+		line := fmt.Sprintf("%s %s %s", signs[change.Kind], change.Entity, change.Id)
+		if change.OldId != "" {
+			line += " (was " + change.OldId + ")"
+		}
+		fields := make([]string, 0, len(change.Fields))
+		for _, field := range change.Fields {
+			if field.Field == "location" && change.Entity == DiffStop {
+				fields = append(fields, fmt.Sprintf("moved %.0f m", change.Moved))
+			} else if field.Field == "location" {
+				fields = append(fields, fmt.Sprintf("points moved up to %.0f m", change.Moved))
+			} else {
+				fields = append(fields, fmt.Sprintf("%s %q → %q", field.Field, field.Old, field.New))
+			}
+		}
+		if len(fields) > 0 {
+			line += ": " + strings.Join(fields, ", ")
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
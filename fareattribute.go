@@ -1,5 +1,9 @@
 package gtfs
 
+import (
+	"strconv"
+)
+
 // FareAttribute.PaymentMethod possible values:
 const (
 	PayementOnBoard        = iota // 0 - Fare is paid on board.
@@ -13,6 +17,7 @@ const (
 	TransfersUnlimited        // (empty) - If this field is empty, unlimited transfers are permitted.
 )
 
+// fare_attributes.txt
 type FareAttribute struct {
 	// fare_id - Required. The fare_id field contains an ID that uniquely identifies a fare class. The fare_id is dataset unique.
 	Id string
@@ -22,7 +27,7 @@ type FareAttribute struct {
 
 	// currency_type - Required. The currency_type field defines the currency used to pay the fare. Please use the ISO 4217 alphabetical 
 	// currency codes which can be found at the following URL: http://www.iso.org/iso/en/prods-services/popstds/currencycodeslist.html.
-	CurrencyType float64
+	CurrencyType string
 
 	// payment_method - Required. The payment_method field indicates when the fare must be paid. Valid values for this field are:
 	// 	 0 - Fare is paid on board.
@@ -46,3 +51,38 @@ type FareAttribute struct {
 
 	feed *Feed
 }
+
+func (fa *FareAttribute) setField(fieldName, val string) {
+	// log.Println("setField", fieldName, value)
+	switch fieldName {
+	case "fare_id":
+		fa.Id = val
+		break
+	case "price":
+		v, _ := strconv.ParseFloat(val, 64) // Should panic on error !
+		fa.Price = v
+		break
+	case "currency_type":
+		fa.CurrencyType = val
+		break
+	case "payment_method":
+		if val == "1" {
+			fa.PaymentMethod = PayementBeforeBoarding
+		} else {
+			fa.PaymentMethod = PayementOnBoard
+		}
+		break
+	case "transfers":
+		v, err := strconv.Atoi(val)
+		if err != nil || v < TransfersNone || v > TransfersTwice {
+			fa.Transfers = TransfersUnlimited
+		} else {
+			fa.Transfers = byte(v)
+		}
+		break
+	case "transfer_duration":
+		v, _ := strconv.Atoi(val) // Should panic on error !
+		fa.TransferDuration = v
+		break
+	}
+}
@@ -49,3 +49,111 @@ type FareRule struct {
 
 	feed *Feed
 }
+
+// Matches returns true if the rule applies to a ride on route from the origin zone to the destination zone,
+// passing through zones. Empty rule fields match anything.
+func (fr *FareRule) Matches(route *Route, originZone, destinationZone string, zones []string) bool {
+	if fr.RouteId != "" && (route == nil || route.Id != fr.RouteId) {
+		return false
+	}
+	if fr.OriginId != "" && fr.OriginId != originZone {
+		return false
+	}
+	if fr.DestinationId != "" && fr.DestinationId != destinationZone {
+		return false
+	}
+	if fr.ContainsId != "" {
+		for _, zone := range zones {
+			if zone == fr.ContainsId {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// FareForRide returns the cheapest fare that applies to a ride on route from the origin zone to the
+// destination zone, passing through zones (origin and destination included), or nil if none does.
+// A fare with contains_id rules applies when the ride passes through exactly the zones of its rules
+// matching the route, origin and destination. A feed with a single fare and no rules applies it to
+// every ride.
+func (feed *Feed) FareForRide(route *Route, originZone, destinationZone string, zones []string) (fare *FareAttribute) {
+	if len(feed.FareRules) == 0 && len(feed.FareAttributes) == 1 {
+		for _, fare = range feed.FareAttributes {
+			return
+		}
+	}
+	cheaper := func(candidate *FareAttribute) bool {
+		return candidate != nil && (fare == nil || candidate.Price < fare.Price || (candidate.Price == fare.Price && candidate.Id < fare.Id))
+	}
+
+	contains := make(map[string]map[string]bool) // By fare id
+	for _, rule := range feed.FareRules {
+		if rule.ContainsId != "" {
+			if rule.Matches(route, originZone, destinationZone, []string{rule.ContainsId}) {
+				if contains[rule.Id] == nil {
+					contains[rule.Id] = make(map[string]bool)
+				}
+				contains[rule.Id][rule.ContainsId] = true
+			}
+		} else if candidate := feed.FareAttributes[rule.Id]; cheaper(candidate) && rule.Matches(route, originZone, destinationZone, zones) {
+			fare = candidate
+		}
+	}
+
+	passed := make(map[string]bool)
+	for _, zone := range zones {
+		if zone != "" {
+			passed[zone] = true
+		}
+	}
+	for id, fareZones := range contains {
+		if candidate := feed.FareAttributes[id]; cheaper(candidate) && sameZones(fareZones, passed) {
+			fare = candidate
+		}
+	}
+	return
+}
+
+func sameZones(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for zone := range a {
+		if !b[zone] {
+			return false
+		}
+	}
+	return true
+}
+
+// transferAllowed returns whether a ride departing at departure is covered by a ticket of fare bought
+// at start and already used for transfers rides after the first one
+func (fare *FareAttribute) transferAllowed(start, departure uint, transfers int) bool {
+	if fare.Transfers != TransfersUnlimited && transfers >= int(fare.Transfers) {
+		return false
+	}
+	return fare.TransferDuration <= 0 || departure <= start+uint(fare.TransferDuration)
+}
+
+func (fr *FareRule) setField(fieldName, val string) {
+	// log.Println("setField", fieldName, value)
+	switch fieldName {
+	case "fare_id":
+		fr.Id = val
+		break
+	case "route_id":
+		fr.RouteId = val
+		break
+	case "origin_id":
+		fr.OriginId = val
+		break
+	case "destination_id":
+		fr.DestinationId = val
+		break
+	case "contains_id":
+		fr.ContainsId = val
+		break
+	}
+}
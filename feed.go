@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	// "runtime"
 	// "bufio"
 	"time"
@@ -27,15 +28,25 @@ type Feed struct {
 	Shapes           map[string]*Shape
 	Calendars        map[string]*Calendar
 	CalendarDates    map[string][]*CalendarDate
+	FareAttributes   map[string]*FareAttribute
+	FareRules        []*FareRule
 	Loaded           bool
-	StopTimesCount   int
+	StopTimesCount   int // Stop times of the trips, rows of stop_times.txt with an unknown trip_id aren't counted
 	TranfersCount    int
 	FrequenciesCount int
+
+	shapeIndex     *ShapeIndex
+	shapeIndexLock sync.Mutex
+
+	// Records referencing a trip or a stop that doesn't exist, see IntegrityRepair
+	orphanStopTimes   []*StopTime
+	orphanFrequencies []*Frequency
+	orphanTransfers   []*Transfer
 }
 
 var RequiredFiles = []string{"agency.txt", "stops.txt", "routes.txt", "trips.txt", "stop_times.txt"}
 var RequiredEitherCalendarFiles = []string{"calendar.txt", "calendar_dates.txt"}
-var AllFiles = []string{"agency.txt", "stops.txt", "routes.txt", "trips.txt", "stop_times.txt", "calendar.txt", "calendar_dates.txt", "fare_attributes.txt", "fare_rules.txt", "shapes.txt", "frequencies.txt", "transfers.txt"}
+var AllFiles = []string{"agency.txt", "stops.txt", "routes.txt", "trips.txt", "stop_times.txt", "calendar.txt", "calendar_dates.txt", "fare_attributes.txt", "fare_rules.txt", "shapes.txt", "frequencies.txt", "transfers.txt", "pathways.txt"}
 
 func NewFeed(path string) (*Feed, error) {
 
@@ -49,6 +60,8 @@ func NewFeed(path string) (*Feed, error) {
 		Shapes:         make(map[string]*Shape),
 		Calendars:      make(map[string]*Calendar),
 		CalendarDates:  make(map[string][]*CalendarDate),
+		FareAttributes: make(map[string]*FareAttribute),
+		FareRules:      make([]*FareRule, 0),
 		Loaded:         false,
 	}
 
@@ -63,7 +76,11 @@ func (f *Feed) Reload() error {
 	f.Shapes = make(map[string]*Shape)
 	f.Calendars = make(map[string]*Calendar)
 	f.CalendarDates = make(map[string][]*CalendarDate)
+	f.FareAttributes = make(map[string]*FareAttribute)
+	f.FareRules = make([]*FareRule, 0)
 	f.Loaded = false
+	f.orphanStopTimes, f.orphanFrequencies, f.orphanTransfers = nil, nil, nil
+	f.invalidateShapeIndex()
 	return f.Load()
 }
 
@@ -118,11 +135,16 @@ func (f *Feed) Load() error {
 		}
 	}
 
+	for _, shape := range f.Shapes {
+		shape.sortPoints()
+	}
+
 	// Color field copy from Routes to Shapes for json export
 	// And calculate the DayRange for each trip
 	bench("Trips calculations", func() interface{} {
 		for _, trip := range f.Trips {
 			trip.copyColorToShape()
+			trip.interpolateStopTimes()
 			trip.calculateDayTimeRange()
 			for _, freq := range trip.Frequencies {
 				freq.calculateDayTimeRange()
@@ -144,7 +166,7 @@ func (f *Feed) Load() error {
 	log.Println("Calendars count", len(f.Calendars))
 	log.Println("CalendarDates count", len(f.CalendarDates))
 	log.Println("Tranfers count", f.TranfersCount)
-	log.Println("FrequenciesCount count", f.TranfersCount)
+	log.Println("Frequencies count", f.FrequenciesCount)
 
 	// log.Printf("gtfsd weight - bytes = %d - footprint = %d", runtime.MemStats.HeapAlloc, runtime.MemStats.Sys)
 	// now := time.Now().Local()
@@ -219,6 +241,46 @@ func (f *Feed) Load() error {
 	return nil
 }
 
+// ShapeIndex returns the spatial index of the feed's shapes, built on first use
+func (f *Feed) ShapeIndex() *ShapeIndex {
+	f.shapeIndexLock.Lock()
+	defer f.shapeIndexLock.Unlock()
+	if f.shapeIndex == nil {
+		f.shapeIndex = NewShapeIndex(f.Shapes, f.Trips)
+	}
+	return f.shapeIndex
+}
+
+// invalidateShapeIndex has the shape index rebuilt after shapes or trips changes
+func (f *Feed) invalidateShapeIndex() {
+	f.shapeIndexLock.Lock()
+	f.shapeIndex = nil
+	f.shapeIndexLock.Unlock()
+}
+
+// removeTrip removes trip and its stop times from the feed
+func (f *Feed) removeTrip(trip *Trip) {
+	delete(f.Trips, trip.Id)
+	for _, st := range trip.StopTimes {
+		if st == nil {
+			continue
+		}
+		f.StopTimesCount = f.StopTimesCount - 1
+		if st.Stop == nil {
+			continue
+		}
+		kept := st.Stop.StopTimes[:0]
+		for _, other := range st.Stop.StopTimes {
+			if other != st {
+				kept = append(kept, other)
+			}
+		}
+		st.Stop.StopTimes = kept
+	}
+	f.FrequenciesCount = f.FrequenciesCount - len(trip.Frequencies)
+	f.invalidateShapeIndex()
+}
+
 func bench(name string, toBench func() interface{}) {
 	start := time.Now()
 	result := toBench()
@@ -294,6 +356,52 @@ func (feed *Feed) openAndParseTxtFile(basePath, fileName string) (err error) {
 	return feed.parseTxtFile(file, fileName)
 }
 
+// readFiles calls handler with every file of the feed, zip or folder, GTFS or not
+func (f *Feed) readFiles(handler func(fileName string, reader io.Reader) error) error {
+	if filepath.Ext(f.path) == ".zip" {
+		zipReader, err := zip.OpenReader(f.path)
+		if err != nil {
+			return err
+		}
+		defer zipReader.Close()
+		for _, zf := range zipReader.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			reader, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			err = handler(zf.Name, reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	entries, err := os.ReadDir(f.path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		file, err := os.Open(filepath.Join(f.path, entry.Name()))
+		if err != nil {
+			return err
+		}
+		err = handler(entry.Name(), file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (feed *Feed) parseTxtFile(reader io.Reader, fileName string) (err error) {
 
 	parser := new(Parser)
@@ -362,6 +470,8 @@ func (feed *Feed) parseTxtFile(reader io.Reader, fileName string) (err error) {
 			if stopTime.Trip != nil {
 				feed.StopTimesCount = feed.StopTimesCount + 1
 				stopTime.Trip.AddStopTime(stopTime)
+			} else {
+				feed.orphanStopTimes = append(feed.orphanStopTimes, stopTime)
 			}
 
 			if stopTime.Stop != nil { // For security, should proceed otherwise
@@ -404,8 +514,33 @@ func (feed *Feed) parseTxtFile(reader io.Reader, fileName string) (err error) {
 			return
 		}
 		break
-	// case "fare_attributes.txt":
-	// case "fare_rules.txt":
+	case "fare_attributes.txt":
+		log.Println("fare_attributes.txt")
+		err = parser.parse(reader, func(k, v []string) {
+			fare := new(FareAttribute)
+			fare.feed = feed
+			fare.Transfers = TransfersUnlimited // The field is required but empty means unlimited
+			fieldsSetter(fare, k, v)
+			// log.Println("  - fare:", fare)
+			feed.FareAttributes[fare.Id] = fare
+		})
+		if err != nil {
+			return
+		}
+		break
+	case "fare_rules.txt":
+		log.Println("fare_rules.txt")
+		err = parser.parse(reader, func(k, v []string) {
+			rule := new(FareRule)
+			rule.feed = feed
+			fieldsSetter(rule, k, v)
+			// log.Println("  - rule:", rule)
+			feed.FareRules = append(feed.FareRules, rule)
+		})
+		if err != nil {
+			return
+		}
+		break
 	case "shapes.txt":
 		// break
 		log.Println("shapes.txt")
@@ -436,6 +571,8 @@ func (feed *Feed) parseTxtFile(reader io.Reader, fileName string) (err error) {
 			if frequency.Trip != nil {
 				feed.Trips[frequency.Trip.Id].Frequencies = append(feed.Trips[frequency.Trip.Id].Frequencies, *frequency)
 				feed.FrequenciesCount = feed.FrequenciesCount + 1
+			} else {
+				feed.orphanFrequencies = append(feed.orphanFrequencies, frequency)
 			}
 		})
 		if err != nil {
@@ -449,8 +586,30 @@ func (feed *Feed) parseTxtFile(reader io.Reader, fileName string) (err error) {
 			transfer.feed = feed
 			fieldsSetter(transfer, k, v)
 			// log.Println("  - transfer:", transfer)
-			feed.StopCollection.Stop(transfer.FromStopId).Transfers[transfer.ToStopId] = transfer
-			feed.TranfersCount = feed.TranfersCount + 1
+			if from := feed.StopCollection.Stop(transfer.FromStopId); from != nil {
+				from.Transfers[transfer.ToStopId] = transfer
+				feed.TranfersCount = feed.TranfersCount + 1
+			} else {
+				feed.orphanTransfers = append(feed.orphanTransfers, transfer)
+			}
+		})
+		if err != nil {
+			return
+		}
+		break
+	case "pathways.txt":
+		log.Println("pathways.txt")
+		err = parser.parse(reader, func(k, v []string) {
+			pathway := new(Pathway)
+			pathway.feed = feed
+			fieldsSetter(pathway, k, v)
+			// log.Println("  - pathway:", pathway)
+			if from := feed.StopCollection.Stop(pathway.FromStopId); from != nil {
+				from.Pathways = append(from.Pathways, pathway)
+			}
+			if to := feed.StopCollection.Stop(pathway.ToStopId); to != nil && pathway.ToStopId != pathway.FromStopId {
+				to.Pathways = append(to.Pathways, pathway)
+			}
 		})
 		if err != nil {
 			return
@@ -39,7 +39,8 @@ type Frequency struct {
 	HeadwaySecs uint
 
 	DayRange
-	feed *Feed
+	tripId string // trip_id as found in frequencies.txt, Trip is nil when it is unknown
+	feed   *Feed
 }
 
 func (f *Frequency) calculateDayTimeRange() {
@@ -51,6 +52,7 @@ func (f *Frequency) setField(fieldName, val string) {
 	switch fieldName {
 	case "trip_id":
 		f.Trip = f.feed.Trips[val]
+		f.tripId = val
 		break
 	case "start_time":
 		v, err := timeOfDayStringToSeconds(val)
@@ -0,0 +1,140 @@
+// Package geo provides the geodesic computations shared by the gtfs package: distances, bearings,
+// destination points, bounding boxes and projections on segments. Coordinates are WGS 84 latitudes
+// and longitudes in degrees, distances are in meters.
+package geo
+
+import (
+	"math"
+)
+
+// EarthRadius is the mean radius of the Earth in meters, used by the spherical formulas
+const EarthRadius = 6371000.0
+
+// WGS 84 ellipsoid, used by Vincenty
+const (
+	wgs84A = 6378137.0
+	wgs84F = 1 / 298.257223563
+	wgs84B = wgs84A * (1 - wgs84F)
+)
+
+// minCosLat keeps longitude spans finite near the poles
+const minCosLat = 0.01
+
+func toRad(degrees float64) float64 {
+	return degrees * math.Pi / 180.0
+}
+
+func toDeg(radians float64) float64 {
+	return radians * 180.0 / math.Pi
+}
+
+// Haversine returns the great-circle distance between two coordinates on a spherical Earth.
+// It is accurate to about 0.5% and well conditioned for small distances (0 for identical points).
+func Haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a)) * EarthRadius
+}
+
+// Vincenty returns the distance between two coordinates on the WGS 84 ellipsoid (inverse Vincenty
+// formula, accurate to the millimeter). For nearly antipodal points where the iteration doesn't
+// converge, it falls back to Haversine.
+func Vincenty(lat1, lon1, lat2, lon2 float64) float64 {
+	if lat1 == lat2 && lon1 == lon2 {
+		return 0
+	}
+	L := toRad(lon2 - lon1)
+	U1 := math.Atan((1 - wgs84F) * math.Tan(toRad(lat1)))
+	U2 := math.Atan((1 - wgs84F) * math.Tan(toRad(lat2)))
+	sinU1, cosU1 := math.Sincos(U1)
+	sinU2, cosU2 := math.Sincos(U2)
+
+	lambda := L
+	for i := 0; i < 200; i++ {
+		sinLambda, cosLambda := math.Sincos(lambda)
+		sinSigma := math.Sqrt((cosU2*sinLambda)*(cosU2*sinLambda) + (cosU1*sinU2-sinU1*cosU2*cosLambda)*(cosU1*sinU2-sinU1*cosU2*cosLambda))
+		if sinSigma == 0 {
+			return 0
+		}
+		cosSigma := sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma := math.Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cosSqAlpha := 1 - sinAlpha*sinAlpha
+		cos2SigmaM := 0.0
+		if cosSqAlpha != 0 { // Equatorial line otherwise
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha
+		}
+		C := wgs84F / 16 * cosSqAlpha * (4 + wgs84F*(4-3*cosSqAlpha))
+		previous := lambda
+		lambda = L + (1-C)*wgs84F*sinAlpha*(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+		if math.Abs(lambda-previous) < 1e-12 {
+			uSq := cosSqAlpha * (wgs84A*wgs84A - wgs84B*wgs84B) / (wgs84B * wgs84B)
+			A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+			B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+			deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+				B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+			return wgs84B * A * (sigma - deltaSigma)
+		}
+	}
+	return Haversine(lat1, lon1, lat2, lon2)
+}
+
+// Bearing returns the initial bearing from the first coordinate to the second, in degrees
+// clockwise from north, between 0 and 360
+func Bearing(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1, phi2 := toRad(lat1), toRad(lat2)
+	dLon := toRad(lon2 - lon1)
+	y := math.Sin(dLon) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dLon)
+	return math.Mod(toDeg(math.Atan2(y, x))+360, 360)
+}
+
+// Destination returns the coordinate reached traveling distance meters from lat, lon along the
+// great circle of initial bearing (in degrees clockwise from north)
+func Destination(lat, lon, bearing, distance float64) (lat2, lon2 float64) {
+	angular := distance / EarthRadius
+	phi1, lambda1, theta := toRad(lat), toRad(lon), toRad(bearing)
+	phi2 := math.Asin(math.Sin(phi1)*math.Cos(angular) + math.Cos(phi1)*math.Sin(angular)*math.Cos(theta))
+	lambda2 := lambda1 + math.Atan2(math.Sin(theta)*math.Sin(angular)*math.Cos(phi1), math.Cos(angular)-math.Sin(phi1)*math.Sin(phi2))
+	return toDeg(phi2), math.Mod(toDeg(lambda2)+540, 360) - 180
+}
+
+// BBoxFromRadius returns the box containing the circle of radius meters around lat, lon
+func BBoxFromRadius(lat, lon, radius float64) (minLat, minLon, maxLat, maxLon float64) {
+	dLat := toDeg(radius / EarthRadius)
+	dLon := dLat / math.Max(math.Cos(toRad(math.Min(math.Abs(lat)+dLat, 90))), minCosLat)
+	return lat - dLat, lon - dLon, lat + dLat, lon + dLon
+}
+
+// ExpandBBox enlarges a box by margin meters on every side
+func ExpandBBox(minLat, minLon, maxLat, maxLon, margin float64) (float64, float64, float64, float64) {
+	dLat := toDeg(margin / EarthRadius)
+	dLon := dLat / math.Max(math.Cos(toRad(math.Min(math.Max(math.Abs(minLat), math.Abs(maxLat))+dLat, 90))), minCosLat)
+	return minLat - dLat, minLon - dLon, maxLat + dLat, maxLon + dLon
+}
+
+// Equirectangular returns the position of lat, lon in meters east (x) and north (y) of the origin,
+// in a local equirectangular projection (fine within a few kilometers)
+func Equirectangular(originLat, originLon, lat, lon float64) (x, y float64) {
+	cosLat := math.Cos(toRad(originLat))
+	return toRad(lon-originLon) * cosLat * EarthRadius, toRad(lat-originLat) * EarthRadius
+}
+
+// ProjectOnSegment returns the point of the segment [a, b] closest to lat, lon, and its position t
+// on the segment from 0 (a) to 1 (b), computed in a local equirectangular plane
+func ProjectOnSegment(lat, lon, aLat, aLon, bLat, bLon float64) (t, pLat, pLon float64) {
+	cosLat := math.Cos(toRad(lat))
+	ax, ay := (aLon-lon)*cosLat, aLat-lat
+	dx, dy := (bLon-aLon)*cosLat, bLat-aLat
+	if length := dx*dx + dy*dy; length > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/length))
+	}
+	return t, aLat + t*(bLat-aLat), aLon + t*(bLon-aLon)
+}
+
+// PointToSegmentDistance returns the distance from lat, lon to the segment [a, b]
+func PointToSegmentDistance(lat, lon, aLat, aLon, bLat, bLon float64) float64 {
+	_, pLat, pLon := ProjectOnSegment(lat, lon, aLat, aLon, bLat, bLon)
+	return Haversine(lat, lon, pLat, pLon)
+}
@@ -0,0 +1,56 @@
+package gtfs
+
+import (
+	"github.com/nicolaspaton/gogtfs/geo"
+)
+
+// GeoJSON (RFC 7946) structures used by the exports of this package.
+// Coordinates are always [longitude, latitude].
+
+type GeoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Id         string                 `json:"id,omitempty"`
+	Geometry   *GeoJSONGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoJSONFeatureCollection struct {
+	Type     string            `json:"type"`
+	Features []*GeoJSONFeature `json:"features"`
+}
+
+func NewGeoJSONFeatureCollection() *GeoJSONFeatureCollection {
+	return &GeoJSONFeatureCollection{Type: "FeatureCollection", Features: make([]*GeoJSONFeature, 0)}
+}
+
+func NewGeoJSONFeature(geometry *GeoJSONGeometry, properties map[string]interface{}) *GeoJSONFeature {
+	if properties == nil {
+		properties = make(map[string]interface{})
+	}
+	return &GeoJSONFeature{Type: "Feature", Geometry: geometry, Properties: properties}
+}
+
+func (fc *GeoJSONFeatureCollection) Add(feature *GeoJSONFeature) {
+	fc.Features = append(fc.Features, feature)
+}
+
+func NewGeoJSONMultiPolygon(polygons [][][][2]float64) *GeoJSONGeometry {
+	return &GeoJSONGeometry{Type: "MultiPolygon", Coordinates: polygons}
+}
+
+// circlePolygon approximates the circle of radius meters around lat, lon with a closed ring of
+// segments points, as GeoJSON polygon coordinates.
+func circlePolygon(lat, lon, radius float64, segments int) [][][2]float64 {
+	ring := make([][2]float64, 0, segments+1)
+	for i := 0; i < segments; i++ {
+		lat2, lon2 := geo.Destination(lat, lon, 360*float64(i)/float64(segments), radius)
+		ring = append(ring, [2]float64{lon2, lat2})
+	}
+	ring = append(ring, ring[0])
+	return [][][2]float64{ring}
+}
@@ -0,0 +1,269 @@
+package gtfs
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BoundingBox limits an export to an area. A nil *BoundingBox exports everything.
+type BoundingBox struct {
+	MinLat float64
+	MinLon float64
+	MaxLat float64
+	MaxLon float64
+}
+
+// ParseBoundingBox reads a "minLon,minLat,maxLon,maxLat" string (GeoJSON bbox order)
+func ParseBoundingBox(s string) (*BoundingBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, errors.New("bbox must be minLon,minLat,maxLon,maxLat")
+	}
+	values := make([]float64, 4)
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	if values[0] > values[2] || values[1] > values[3] {
+		return nil, errors.New("bbox minimums must not exceed maximums")
+	}
+	return &BoundingBox{MinLat: values[1], MinLon: values[0], MaxLat: values[3], MaxLon: values[2]}, nil
+}
+
+func (b *BoundingBox) aabb() *AABB {
+	return NewAABB((b.MinLon+b.MaxLon)/2, (b.MinLat+b.MaxLat)/2, (b.MaxLon-b.MinLon)/2, (b.MaxLat-b.MinLat)/2)
+}
+
+// intersectsLine returns true if the box is nil or crosses the [lon, lat] line
+func (b *BoundingBox) intersectsLine(line [][2]float64) bool {
+	if b == nil {
+		return true
+	}
+	box := b.aabb()
+	if len(line) == 1 {
+		return segmentIntersectsAABB(line[0][1], line[0][0], line[0][1], line[0][0], box)
+	}
+	for i := 1; i < len(line); i++ {
+		if segmentIntersectsAABB(line[i-1][1], line[i-1][0], line[i][1], line[i][0], box) {
+			return true
+		}
+	}
+	return false
+}
+
+func NewGeoJSONPoint(lat, lon float64) *GeoJSONGeometry {
+	return &GeoJSONGeometry{Type: "Point", Coordinates: [2]float64{lon, lat}}
+}
+
+func NewGeoJSONLineString(line [][2]float64) *GeoJSONGeometry {
+	return &GeoJSONGeometry{Type: "LineString", Coordinates: line}
+}
+
+func NewGeoJSONMultiLineString(lines [][][2]float64) *GeoJSONGeometry {
+	return &GeoJSONGeometry{Type: "MultiLineString", Coordinates: lines}
+}
+
+// shapeLine returns the coordinates of a shape
+func shapeLine(shape *Shape) [][2]float64 {
+	line := make([][2]float64, len(shape.Points))
+	for i, point := range shape.Points {
+		line[i] = [2]float64{point.Lon, point.Lat}
+	}
+	return line
+}
+
+// stopsLine returns the straight lines joining stops
+func stopsLine(stops []*Stop) [][2]float64 {
+	line := make([][2]float64, len(stops))
+	for i, stop := range stops {
+		line[i] = [2]float64{stop.Lon, stop.Lat}
+	}
+	return line
+}
+
+// colorProperties returns the route colors, plus the simplestyle "stroke" property understood by most GeoJSON viewers
+func colorProperties(properties map[string]interface{}, color, textColor string) map[string]interface{} {
+	if color == "" {
+		color = "FFFFFF"
+	}
+	if textColor == "" {
+		textColor = "000000"
+	}
+	properties["route_color"] = color
+	properties["route_text_color"] = textColor
+	properties["stroke"] = "#" + color
+	return properties
+}
+
+// StopGeoJSON returns stop as a Point feature with its stops.txt fields and the ids of the routes serving it
+func StopGeoJSON(stop *Stop) *GeoJSONFeature {
+	routes := make([]string, 0)
+	for _, route := range stop.Routes() {
+		routes = append(routes, route.Id)
+	}
+	sort.Strings(routes)
+	feature := NewGeoJSONFeature(NewGeoJSONPoint(stop.Lat, stop.Lon), map[string]interface{}{
+		"stop_id":             stop.Id,
+		"stop_code":           stop.Code,
+		"stop_name":           stop.Name,
+		"stop_desc":           stop.Desc,
+		"zone_id":             stop.ZoneId,
+		"stop_url":            stop.Url,
+		"location_type":       stop.LocationType,
+		"parent_station":      stop.ParentStationId,
+		"wheelchair_boarding": stop.WheelchairBoarding,
+		"routes":              routes,
+	})
+	feature.Id = stop.Id
+	return feature
+}
+
+// StopsGeoJSON returns the stops of the feed within bbox, sorted by id
+func (f *Feed) StopsGeoJSON(bbox *BoundingBox) *GeoJSONFeatureCollection {
+	var stops []*Stop
+	if bbox == nil {
+		stops = make([]*Stop, 0, len(f.Stops))
+		for _, stop := range f.Stops {
+			stops = append(stops, stop)
+		}
+	} else {
+		stops = f.StopCollection.quadtree().SearchArea(bbox.aabb())
+	}
+	sort.Slice(stops, func(i, j int) bool { return stops[i].Id < stops[j].Id })
+
+	collection := NewGeoJSONFeatureCollection()
+	for _, stop := range stops {
+		collection.Add(StopGeoJSON(stop))
+	}
+	return collection
+}
+
+// ShapesGeoJSON returns the shapes of the feed crossing bbox as LineString features, sorted by id
+func (f *Feed) ShapesGeoJSON(bbox *BoundingBox) *GeoJSONFeatureCollection {
+	var shapes []*Shape
+	if bbox == nil {
+		shapes = make([]*Shape, 0, len(f.Shapes))
+		for _, shape := range f.Shapes {
+			shapes = append(shapes, shape)
+		}
+	} else {
+		shapes = f.ShapeIndex().ShapesInBox(bbox.MinLat, bbox.MinLon, bbox.MaxLat, bbox.MaxLon)
+	}
+	sort.Slice(shapes, func(i, j int) bool { return shapes[i].Id < shapes[j].Id })
+
+	collection := NewGeoJSONFeatureCollection()
+	for _, shape := range shapes {
+		if len(shape.Points) == 0 {
+			continue
+		}
+		properties := map[string]interface{}{"shape_id": shape.Id}
+		if shape.Color != "" {
+			properties["stroke"] = "#" + shape.Color
+		}
+		feature := NewGeoJSONFeature(NewGeoJSONLineString(shapeLine(shape)), properties)
+		feature.Id = shape.Id
+		collection.Add(feature)
+	}
+	return collection
+}
+
+// patternLine returns the shape of the pattern, or the straight lines between its stops if it has none
+func (f *Feed) patternLine(pattern *Pattern) [][2]float64 {
+	if shapeId := pattern.ShapeId(); shapeId != "" {
+		return shapeLine(f.Shapes[shapeId])
+	}
+	return stopsLine(pattern.Stops)
+}
+
+// RoutesGeoJSON returns one MultiLineString feature per route crossing bbox, made of the distinct
+// shapes of its patterns (straight lines between stops for patterns without shape) and coloured
+// by Route.Color. Features are sorted by route id.
+func (f *Feed) RoutesGeoJSON(bbox *BoundingBox) *GeoJSONFeatureCollection {
+	lines := make(map[*Route][][][2]float64)
+	seen := make(map[*Route]map[string]bool)
+	for _, pattern := range f.Patterns() {
+		if pattern.Route == nil || len(pattern.Stops) < 2 {
+			continue
+		}
+		key := pattern.ShapeId()
+		if key == "" {
+			key = "pattern:" + pattern.Id
+		}
+		if seen[pattern.Route] == nil {
+			seen[pattern.Route] = make(map[string]bool)
+		}
+		if seen[pattern.Route][key] {
+			continue
+		}
+		seen[pattern.Route][key] = true
+		lines[pattern.Route] = append(lines[pattern.Route], f.patternLine(pattern))
+	}
+
+	routes := make([]*Route, 0, len(lines))
+	for route, routeLines := range lines {
+		for _, line := range routeLines {
+			if bbox.intersectsLine(line) {
+				routes = append(routes, route)
+				break
+			}
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Id < routes[j].Id })
+
+	collection := NewGeoJSONFeatureCollection()
+	for _, route := range routes {
+		agencyId := ""
+		if route.Agency != nil {
+			agencyId = route.Agency.Id
+		}
+		properties := colorProperties(map[string]interface{}{
+			"route_id":         route.Id,
+			"agency_id":        agencyId,
+			"route_short_name": route.ShortName,
+			"route_long_name":  route.LongName,
+			"route_type":       route.Type,
+		}, route.Color, route.TextColor)
+		feature := NewGeoJSONFeature(NewGeoJSONMultiLineString(lines[route]), properties)
+		feature.Id = route.Id
+		collection.Add(feature)
+	}
+	return collection
+}
+
+// PatternsGeoJSON returns one LineString feature per trip pattern crossing bbox, with its stops and trip count
+func (f *Feed) PatternsGeoJSON(bbox *BoundingBox) *GeoJSONFeatureCollection {
+	collection := NewGeoJSONFeatureCollection()
+	for _, pattern := range f.Patterns() {
+		if len(pattern.Stops) == 0 {
+			continue
+		}
+		line := f.patternLine(pattern)
+		if !bbox.intersectsLine(line) {
+			continue
+		}
+		stopIds := make([]string, len(pattern.Stops))
+		for i, stop := range pattern.Stops {
+			stopIds[i] = stop.Id
+		}
+		properties := map[string]interface{}{
+			"pattern_id":   pattern.Id,
+			"direction_id": pattern.Direction,
+			"shape_id":     pattern.ShapeId(),
+			"stop_ids":     stopIds,
+			"trips_count":  len(pattern.Trips),
+		}
+		if pattern.Route != nil {
+			properties["route_id"] = pattern.Route.Id
+			colorProperties(properties, pattern.Route.Color, pattern.Route.TextColor)
+		}
+		feature := NewGeoJSONFeature(NewGeoJSONLineString(line), properties)
+		feature.Id = pattern.Id
+		collection.Add(feature)
+	}
+	return collection
+}
@@ -0,0 +1,281 @@
+package gtfs
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// HeadwayStats is the distribution of the time between consecutive departures in a time band.
+// Headways are in seconds, 0 when there are less than two departures.
+type HeadwayStats struct {
+	Band       string
+	Departures int
+	Min        float64
+	Median     float64
+	Mean       float64
+	Max        float64
+
+	// There is a departure at least every HeadwayAnalyzer.FrequentHeadway seconds over the whole band
+	Frequent bool
+}
+
+// StopHeadways are the headways of the departures from a stop, all routes together
+type StopHeadways struct {
+	Stop     *Stop
+	Bands    []*HeadwayStats // In HeadwayAnalyzer.TimeBands order
+	Frequent bool            // Frequent in all the HeadwayAnalyzer.FrequentBands
+}
+
+// SegmentHeadways are the headways of the runs of a route-direction from a stop to the next one
+type SegmentHeadways struct {
+	From     *Stop
+	To       *Stop
+	Bands    []*HeadwayStats
+	Frequent bool
+
+	line [][2]float64
+}
+
+// RouteDirectionHeadways are the headways of the departures of a route in a direction from the first
+// stop of its runs, and of each of the segments it serves
+type RouteDirectionHeadways struct {
+	Route     *Route
+	Direction byte
+	Bands     []*HeadwayStats
+	Frequent  bool
+	Segments  []*SegmentHeadways // By from and to stop ids
+}
+
+// HeadwayReport is the result of a HeadwayAnalyzer
+type HeadwayReport struct {
+	Date            time.Time
+	Stops           []*StopHeadways           // Stops with departures, by stop id
+	RouteDirections []*RouteDirectionHeadways // By route id then direction
+}
+
+// HeadwayAnalyzer computes the headways of the service of a day by time band, for each stop and
+// each route-direction, and finds the frequent network: the stops and route segments served at
+// least every FrequentHeadway seconds during the FrequentBands. Trips with frequencies are expanded.
+type HeadwayAnalyzer struct {
+	Date            time.Time  // Default: today
+	TimeBands       []TimeBand // Default: DefaultTimeBands
+	FrequentHeadway uint       // In seconds. Default: 10*60 (10 min)
+	FrequentBands   []string   // TimeBands names. Default: am_peak, midday and pm_peak
+
+	feed *Feed
+}
+
+func NewHeadwayAnalyzer(f *Feed) (a *HeadwayAnalyzer) {
+	a = &HeadwayAnalyzer{}
+	a.Date = time.Now()
+	a.TimeBands = DefaultTimeBands
+	a.FrequentHeadway = 10 * 60
+	a.FrequentBands = []string{"am_peak", "midday", "pm_peak"}
+	a.feed = f
+	return
+}
+
+// headwayStats returns the distribution of the headways between sorted departure times in a band
+func (a *HeadwayAnalyzer) headwayStats(band TimeBand, times []uint) *HeadwayStats {
+	inBand := make([]uint, 0)
+	for _, t := range times {
+		if t >= band.Start && t < band.End {
+			inBand = append(inBand, t)
+		}
+	}
+	stats := &HeadwayStats{Band: band.Name, Departures: len(inBand)}
+	if len(inBand) < 2 {
+		return stats
+	}
+	headways := make([]int, len(inBand)-1)
+	sum := 0
+	for i := 1; i < len(inBand); i++ {
+		headways[i-1] = int(inBand[i] - inBand[i-1])
+		sum += headways[i-1]
+	}
+	sort.Ints(headways)
+	stats.Min = float64(headways[0])
+	stats.Median = median(headways)
+	stats.Mean = float64(sum) / float64(len(headways))
+	stats.Max = float64(headways[len(headways)-1])
+	stats.Frequent = stats.Max <= float64(a.FrequentHeadway) &&
+		inBand[0]-band.Start <= a.FrequentHeadway && band.End-inBand[len(inBand)-1] <= a.FrequentHeadway
+	return stats
+}
+
+// bands returns the headway stats of each time band, and whether the frequent bands are all frequent
+func (a *HeadwayAnalyzer) bands(times []uint) ([]*HeadwayStats, bool) {
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	bands := make([]*HeadwayStats, len(a.TimeBands))
+	frequent := make(map[string]bool)
+	for i, band := range a.TimeBands {
+		bands[i] = a.headwayStats(band, times)
+		frequent[band.Name] = bands[i].Frequent
+	}
+	for _, name := range a.FrequentBands {
+		if !frequent[name] {
+			return bands, false
+		}
+	}
+	return bands, len(a.FrequentBands) > 0
+}
+
+// Run computes the headways of the trips running on Date
+func (a *HeadwayAnalyzer) Run() *HeadwayReport {
+	date := time.Date(a.Date.Year(), a.Date.Month(), a.Date.Day(), 0, 0, 0, 0, time.UTC)
+	report := &HeadwayReport{Date: date, Stops: make([]*StopHeadways, 0), RouteDirections: make([]*RouteDirectionHeadways, 0)}
+
+	type routeDirection struct {
+		route     *Route
+		direction byte
+	}
+	type segment struct {
+		routeDirection
+		from, to *Stop
+	}
+	stopTimes := make(map[*Stop][]uint)
+	runStarts := make(map[routeDirection][]uint)
+	segmentTimes := make(map[segment][]uint)
+	segmentTrips := make(map[segment]*Trip)
+	projections := make(map[*Trip][]*ShapeProjection)
+
+	trips := a.feed.TripsForDay(&date)
+	sort.Slice(trips, func(i, j int) bool { return trips[i].Id < trips[j].Id })
+	for _, trip := range trips {
+		sts := stopTimesOf(trip)
+		if trip.Route == nil || len(sts) == 0 {
+			continue
+		}
+		key := routeDirection{trip.Route, trip.Direction}
+		for _, start := range tripRunStarts(trip, sts) {
+			offset := int(start) - int(sts[0].DepartureTime)
+			runStarts[key] = append(runStarts[key], start)
+			// The last stop has no departure
+			for i, st := range sts[:len(sts)-1] {
+				if st.Stop == nil {
+					continue
+				}
+				departure := uint(int(st.DepartureTime) + offset)
+				stopTimes[st.Stop] = append(stopTimes[st.Stop], departure)
+				if next := sts[i+1].Stop; next != nil && next != st.Stop {
+					s := segment{key, st.Stop, next}
+					segmentTimes[s] = append(segmentTimes[s], departure)
+					if segmentTrips[s] == nil {
+						segmentTrips[s] = trip
+					}
+				}
+			}
+		}
+	}
+
+	for stop, times := range stopTimes {
+		bands, frequent := a.bands(times)
+		report.Stops = append(report.Stops, &StopHeadways{stop, bands, frequent})
+	}
+	sort.Slice(report.Stops, func(i, j int) bool { return report.Stops[i].Stop.Id < report.Stops[j].Stop.Id })
+
+	byKey := make(map[routeDirection]*RouteDirectionHeadways)
+	for key, starts := range runStarts {
+		bands, frequent := a.bands(starts)
+		byKey[key] = &RouteDirectionHeadways{key.route, key.direction, bands, frequent, make([]*SegmentHeadways, 0)}
+		report.RouteDirections = append(report.RouteDirections, byKey[key])
+	}
+	for s, times := range segmentTimes {
+		bands, frequent := a.bands(times)
+		rd := byKey[s.routeDirection]
+		trip := segmentTrips[s]
+		if _, ok := projections[trip]; !ok {
+			projections[trip], _ = trip.ProjectStopTimes()
+		}
+		rd.Segments = append(rd.Segments, &SegmentHeadways{s.from, s.to, bands, frequent, a.feed.segmentLine(trip, projections[trip], s.from, s.to)})
+	}
+	for _, rd := range report.RouteDirections {
+		sort.Slice(rd.Segments, func(i, j int) bool {
+			if rd.Segments[i].From.Id != rd.Segments[j].From.Id {
+				return rd.Segments[i].From.Id < rd.Segments[j].From.Id
+			}
+			return rd.Segments[i].To.Id < rd.Segments[j].To.Id
+		})
+	}
+	sort.Slice(report.RouteDirections, func(i, j int) bool {
+		x, y := report.RouteDirections[i], report.RouteDirections[j]
+		if x.Route.Id != y.Route.Id {
+			return x.Route.Id < y.Route.Id
+		}
+		return x.Direction < y.Direction
+	})
+	return report
+}
+
+// segmentLine returns the section of the trip's shape between two consecutive stops from the
+// projections of its stop times, a straight line when the trip has no shape
+func (f *Feed) segmentLine(trip *Trip, projections []*ShapeProjection, from, to *Stop) [][2]float64 {
+	straight := stopsLine([]*Stop{from, to})
+	shape := f.Shapes[trip.ShapeId]
+	if shape == nil || len(shape.Points) < 2 {
+		return straight
+	}
+	for i := 1; i < len(projections); i++ {
+		if projections[i-1].StopTime.Stop != from || projections[i].StopTime.Stop != to {
+			continue
+		}
+		start, end := projections[i-1].Meters, projections[i].Meters
+		if end <= start {
+			return straight
+		}
+		line := [][2]float64{{projections[i-1].Lon, projections[i-1].Lat}}
+		for j, d := range shape.Distances() {
+			if d > start && d < end {
+				line = append(line, [2]float64{shape.Points[j].Lon, shape.Points[j].Lat})
+			}
+		}
+		return append(line, [2]float64{projections[i].Lon, projections[i].Lat})
+	}
+	return straight
+}
+
+// headwayProperties adds the median headway of each band, in minutes, as headway_<band> properties
+func headwayProperties(properties map[string]interface{}, bands []*HeadwayStats, frequent bool) map[string]interface{} {
+	for _, band := range bands {
+		if band.Departures > 1 {
+			properties["headway_"+band.Band] = band.Median / 60
+		}
+		properties["departures_"+band.Band] = band.Departures
+	}
+	properties["frequent"] = frequent
+	return properties
+}
+
+// GeoJSON returns the route-direction segments as LineString features and the stops as Point
+// features, with their median headways per band and whether they are part of the frequent network.
+// Frequent segments are drawn thicker.
+func (r *HeadwayReport) GeoJSON() *GeoJSONFeatureCollection {
+	collection := NewGeoJSONFeatureCollection()
+	for _, rd := range r.RouteDirections {
+		for _, segment := range rd.Segments {
+			properties := colorProperties(map[string]interface{}{
+				"route_id":         rd.Route.Id,
+				"route_short_name": rd.Route.ShortName,
+				"direction_id":     rd.Direction,
+				"from_stop_id":     segment.From.Id,
+				"to_stop_id":       segment.To.Id,
+			}, rd.Route.Color, rd.Route.TextColor)
+			properties["stroke-width"] = 2
+			if segment.Frequent {
+				properties["stroke-width"] = 5
+			}
+			feature := NewGeoJSONFeature(NewGeoJSONLineString(segment.line), headwayProperties(properties, segment.Bands, segment.Frequent))
+			feature.Id = fmt.Sprintf("%s:%d:%s:%s", rd.Route.Id, rd.Direction, segment.From.Id, segment.To.Id)
+			collection.Add(feature)
+		}
+	}
+	for _, stopHeadways := range r.Stops {
+		stop := stopHeadways.Stop
+		properties := map[string]interface{}{"stop_id": stop.Id, "stop_name": stop.Name}
+		feature := NewGeoJSONFeature(NewGeoJSONPoint(stop.Lat, stop.Lon), headwayProperties(properties, stopHeadways.Bands, stopHeadways.Frequent))
+		feature.Id = stop.Id
+		collection.Add(feature)
+	}
+	return collection
+}
@@ -0,0 +1,396 @@
+package gtfs
+
+import (
+	"fmt"
+	"sort"
+)
+
+// IntegrityRepair.Strategy possible values, what to do with a record referencing a missing entity:
+const (
+	RepairNone        = iota // 0 - Only report the reference
+	RepairDrop               // 1 - Drop the record, or clear the reference when it is optional (shape, parent station)
+	RepairPlaceholder        // 2 - Create the missing entity, dropping the record when it can't be made up (trip, stop)
+)
+
+// DanglingReference is a field of a record referencing an entity that doesn't exist
+type DanglingReference struct {
+	File     string // File of the record, e.g. trips.txt
+	Field    string // Referencing field, e.g. route_id
+	EntityId string // Id of the record, trip_id:stop_sequence for stop times
+	Value    string // Missing id
+	Repair   string // What Repair did, empty when nothing was done
+}
+
+func (r *DanglingReference) String() string {
+	return fmt.Sprintf("%s %s: %s %q doesn't exist", r.File, r.EntityId, r.Field, r.Value)
+}
+
+// IntegrityRepair finds the records of a feed referencing missing entities (route→agency,
+// trip→route/service/shape, stop_time→trip/stop, frequency→trip, stop→parent_station and
+// transfer→stops) and optionally fixes them.
+type IntegrityRepair struct {
+	// Routes without a known agency get the only agency of the feed, when there is one. Default: true
+	DefaultAgency bool
+
+	// See Repair constants. Default: RepairDrop
+	Strategy int
+
+	feed *Feed
+}
+
+func NewIntegrityRepair(f *Feed) (r *IntegrityRepair) {
+	r = &IntegrityRepair{}
+	r.DefaultAgency = true
+	r.Strategy = RepairDrop
+	r.feed = f
+	return
+}
+
+// Check returns the dangling references without changing the feed
+func (r *IntegrityRepair) Check() []*DanglingReference {
+	return r.run(false)
+}
+
+// Repair fixes the dangling references following DefaultAgency and Strategy, and returns them
+func (r *IntegrityRepair) Repair() []*DanglingReference {
+	return r.run(true)
+}
+
+// integrityRun holds the state of a Check or Repair pass
+type integrityRun struct {
+	*IntegrityRepair
+	repair     bool
+	references []*DanglingReference
+	created    map[interface{}]bool // Placeholders, still dangling references for the next records
+}
+
+// report records a dangling reference
+func (run *integrityRun) report(file, field, entityId, value string) *DanglingReference {
+	reference := &DanglingReference{File: file, Field: field, EntityId: entityId, Value: value}
+	run.references = append(run.references, reference)
+	return reference
+}
+
+// strategy returns the strategy to apply, RepairNone when only checking
+func (run *integrityRun) strategy() int {
+	if !run.repair {
+		return RepairNone
+	}
+	return run.Strategy
+}
+
+func (r *IntegrityRepair) run(repair bool) []*DanglingReference {
+	run := &integrityRun{r, repair, make([]*DanglingReference, 0), make(map[interface{}]bool)}
+	run.routes()
+	run.trips()
+	run.stopTimes()
+	run.frequencies()
+	run.stops()
+	run.transfers()
+	return run.references
+}
+
+func sortedRouteIds(routes map[string]*Route) []string {
+	ids := make([]string, 0, len(routes))
+	for id := range routes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sortedTripIds(trips map[string]*Trip) []string {
+	ids := make([]string, 0, len(trips))
+	for id := range trips {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// singleAgency returns the agency of a feed with only one, nil otherwise
+func (f *Feed) singleAgency() *Agency {
+	if len(f.Agencies) != 1 {
+		return nil
+	}
+	for _, agency := range f.Agencies {
+		return agency
+	}
+	return nil
+}
+
+// removeRoute removes a route and its trips from the feed
+func (f *Feed) removeRoute(route *Route) {
+	for _, trip := range f.Trips {
+		if trip.Route == route {
+			f.removeTrip(trip)
+		}
+	}
+	delete(f.Routes, route.Id)
+}
+
+// route → agency. A route without agency_id is fine in a feed with a single agency.
+func (run *integrityRun) routes() {
+	feed := run.feed
+	for _, id := range sortedRouteIds(feed.Routes) {
+		route := feed.Routes[id]
+		if route.Agency != nil {
+			continue
+		}
+		single := feed.singleAgency()
+		if route.agencyId == "" && single != nil {
+			if run.repair && run.DefaultAgency {
+				route.Agency = single
+			}
+			continue
+		}
+		reference := run.report("routes.txt", "agency_id", route.Id, route.agencyId)
+		switch {
+		case !run.repair:
+		case run.DefaultAgency && single != nil:
+			route.Agency = single
+			reference.Repair = "defaulted to agency " + single.Id
+		case run.Strategy == RepairPlaceholder:
+			route.Agency = run.placeholderAgency(route.agencyId)
+			reference.Repair = "placeholder agency created"
+		case run.Strategy == RepairDrop:
+			feed.removeRoute(route)
+			reference.Repair = "route and its trips dropped"
+		}
+	}
+}
+
+func (run *integrityRun) placeholderAgency(id string) *Agency {
+	if agency := run.feed.Agencies[id]; agency != nil {
+		return agency
+	}
+	agency := &Agency{Id: id, Name: id, feed: run.feed}
+	for _, other := range run.feed.Agencies {
+		agency.Timezone = other.Timezone
+		break
+	}
+	run.feed.Agencies[id] = agency
+	return agency
+}
+
+// trip → route, service and shape
+func (run *integrityRun) trips() {
+	feed := run.feed
+	for _, id := range sortedTripIds(feed.Trips) {
+		trip := feed.Trips[id]
+		if trip.Route == nil {
+			reference := run.report("trips.txt", "route_id", trip.Id, trip.routeId)
+			switch run.strategy() {
+			case RepairDrop:
+				feed.removeTrip(trip)
+				reference.Repair = "trip dropped"
+				continue
+			case RepairPlaceholder:
+				trip.Route = run.placeholderRoute(trip.routeId)
+				reference.Repair = "placeholder route created"
+			}
+		}
+
+		if calendar := feed.Calendars[trip.serviceId]; (calendar == nil && feed.CalendarDates[trip.serviceId] == nil) || run.created[calendar] {
+			reference := run.report("trips.txt", "service_id", trip.Id, trip.serviceId)
+			switch run.strategy() {
+			case RepairDrop:
+				feed.removeTrip(trip)
+				reference.Repair = "trip dropped"
+				continue
+			case RepairPlaceholder:
+				// A service without any date, the trip stays in the feed but never runs
+				if feed.Calendars[trip.serviceId] == nil {
+					calendar := &Calendar{serviceId: trip.serviceId, feed: feed}
+					feed.Calendars[trip.serviceId] = calendar
+					run.created[calendar] = true
+				}
+				reference.Repair = "placeholder service created, never running"
+			}
+		}
+
+		if shape := feed.Shapes[trip.ShapeId]; trip.ShapeId != "" && (shape == nil || run.created[shape]) {
+			reference := run.report("trips.txt", "shape_id", trip.Id, trip.ShapeId)
+			switch run.strategy() {
+			case RepairDrop:
+				trip.ShapeId = ""
+				reference.Repair = "shape cleared"
+			case RepairPlaceholder:
+				if feed.Shapes[trip.ShapeId] != nil || run.placeholderShape(trip) {
+					reference.Repair = "placeholder shape created"
+				} else {
+					trip.ShapeId = ""
+					reference.Repair = "shape cleared"
+				}
+			}
+		}
+	}
+}
+
+func (run *integrityRun) placeholderRoute(id string) *Route {
+	if route := run.feed.Routes[id]; route != nil {
+		return route
+	}
+	route := &Route{Id: id, ShortName: id, Type: Bus, feed: run.feed}
+	route.Agency = run.feed.singleAgency()
+	run.feed.Routes[id] = route
+	return route
+}
+
+// placeholderShape creates the shape of a trip as a straight line through its stops, it needs two
+func (run *integrityRun) placeholderShape(trip *Trip) bool {
+	shape := &Shape{Id: trip.ShapeId, Points: make([]*ShapePoint, 0)}
+	for _, st := range stopTimesOf(trip) {
+		if st.Stop != nil {
+			shape.Points = append(shape.Points, &ShapePoint{Id: shape.Id, Lat: st.Stop.Lat, Lon: st.Stop.Lon, PointSequence: len(shape.Points), feed: run.feed})
+		}
+	}
+	if len(shape.Points) < 2 {
+		return false
+	}
+	run.feed.Shapes[shape.Id] = shape
+	run.created[shape] = true
+	trip.copyColorToShape()
+	run.feed.invalidateShapeIndex()
+	return true
+}
+
+// stop_time → trip and stop. Neither can be made up, the stop times are dropped.
+func (run *integrityRun) stopTimes() {
+	feed := run.feed
+	// Stop times of unknown trips were never counted in StopTimesCount, the stop-less ones below were
+	kept := feed.orphanStopTimes[:0]
+	for _, st := range feed.orphanStopTimes {
+		reference := run.report("stop_times.txt", "trip_id", fmt.Sprintf("%s:%d", st.tripId, st.StopSequence), st.tripId)
+		if run.strategy() == RepairNone {
+			kept = append(kept, st)
+			continue
+		}
+		if st.Stop != nil {
+			st.Stop.removeStopTime(st)
+		}
+		reference.Repair = "stop time dropped"
+	}
+	feed.orphanStopTimes = kept
+
+	for _, id := range sortedTripIds(feed.Trips) {
+		trip := feed.Trips[id]
+		stopTimes := trip.StopTimes[:0]
+		for _, st := range trip.StopTimes {
+			if st == nil || st.Stop != nil {
+				stopTimes = append(stopTimes, st)
+				continue
+			}
+			reference := run.report("stop_times.txt", "stop_id", fmt.Sprintf("%s:%d", trip.Id, st.StopSequence), st.stopId)
+			if run.strategy() == RepairNone {
+				stopTimes = append(stopTimes, st)
+				continue
+			}
+			feed.StopTimesCount = feed.StopTimesCount - 1
+			reference.Repair = "stop time dropped"
+		}
+		if len(stopTimes) != len(trip.StopTimes) {
+			trip.StopTimes = stopTimes
+			trip.calculateDayTimeRange()
+			feed.invalidateShapeIndex()
+		}
+	}
+}
+
+func (s *Stop) removeStopTime(stopTime *StopTime) {
+	kept := s.StopTimes[:0]
+	for _, st := range s.StopTimes {
+		if st != stopTime {
+			kept = append(kept, st)
+		}
+	}
+	s.StopTimes = kept
+}
+
+// frequency → trip, dropped
+func (run *integrityRun) frequencies() {
+	for _, frequency := range run.feed.orphanFrequencies {
+		reference := run.report("frequencies.txt", "trip_id", frequency.tripId, frequency.tripId)
+		if run.strategy() != RepairNone {
+			reference.Repair = "frequency dropped"
+		}
+	}
+	if run.strategy() != RepairNone {
+		run.feed.orphanFrequencies = nil
+	}
+}
+
+// stop → parent station
+func (run *integrityRun) stops() {
+	feed := run.feed
+	ids := make([]string, 0, feed.StopCollection.Length())
+	for id := range feed.StopCollection.Stops {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		stop := feed.StopCollection.Stop(id)
+		if parent := feed.StopCollection.Stop(stop.ParentStationId); stop.ParentStationId == "" || (parent != nil && !run.created[parent]) {
+			continue
+		}
+		reference := run.report("stops.txt", "parent_station", stop.Id, stop.ParentStationId)
+		switch run.strategy() {
+		case RepairDrop:
+			stop.ParentStationId = ""
+			reference.Repair = "parent station cleared"
+		case RepairPlaceholder:
+			if feed.StopCollection.Stop(stop.ParentStationId) == nil {
+				// At the location of its first child
+				station := NewStop()
+				station.Id, station.Name, station.LocationType = stop.ParentStationId, stop.Name, LocationTypeStation
+				station.Lat, station.Lon = stop.Lat, stop.Lon
+				station.feed = feed
+				feed.StopCollection.SetStop(station.Id, station)
+				run.created[station] = true
+			}
+			reference.Repair = "placeholder station created"
+		}
+	}
+}
+
+// transfer → from and to stops, dropped
+func (run *integrityRun) transfers() {
+	feed := run.feed
+	transferId := func(t *Transfer) string {
+		return t.FromStopId + ">" + t.ToStopId
+	}
+	for _, transfer := range feed.orphanTransfers {
+		reference := run.report("transfers.txt", "from_stop_id", transferId(transfer), transfer.FromStopId)
+		if run.strategy() != RepairNone {
+			reference.Repair = "transfer dropped"
+		}
+	}
+	if run.strategy() != RepairNone {
+		feed.orphanTransfers = nil
+	}
+
+	ids := make([]string, 0, feed.StopCollection.Length())
+	for id := range feed.StopCollection.Stops {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		stop := feed.StopCollection.Stop(id)
+		toIds := make([]string, 0, len(stop.Transfers))
+		for toId := range stop.Transfers {
+			toIds = append(toIds, toId)
+		}
+		sort.Strings(toIds)
+		for _, toId := range toIds {
+			if feed.StopCollection.Stop(toId) != nil {
+				continue
+			}
+			reference := run.report("transfers.txt", "to_stop_id", transferId(stop.Transfers[toId]), toId)
+			if run.strategy() != RepairNone {
+				delete(stop.Transfers, toId)
+				feed.TranfersCount = feed.TranfersCount - 1
+				reference.Repair = "transfer dropped"
+			}
+		}
+	}
+}
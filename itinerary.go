@@ -1,11 +1,52 @@
 package gtfs
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
 )
 
+// ItineraryError.Kind possible values:
+const (
+	ItineraryNoRouteFound = iota // 0 - The search completed (or reached its limits) without reaching the destination.
+	ItineraryTimeout             // 1 - The context deadline was exceeded before the search completed.
+	ItineraryCanceled            // 2 - The context was canceled before the search completed.
+	ItineraryInvalidQuery        // 3 - The itinerary is missing its origin, destination or departure time.
+)
+
+// ItineraryError is returned by Itinerary.Run and Itinerary.RunContext instead of panicking.
+type ItineraryError struct {
+	Kind    byte
+	Message string
+	Err     error // The context error for ItineraryTimeout and ItineraryCanceled
+}
+
+func (ie *ItineraryError) Error() string {
+	switch ie.Kind {
+	case ItineraryNoRouteFound:
+		return "No route found: " + ie.Message
+	case ItineraryTimeout:
+		return "Itinerary timeout: " + ie.Message
+	case ItineraryCanceled:
+		return "Itinerary canceled: " + ie.Message
+	}
+	return "Invalid itinerary query: " + ie.Message
+}
+
+func (ie *ItineraryError) Unwrap() error {
+	return ie.Err
+}
+
+// contextError wraps the error of a done context
+func contextError(ctx context.Context, message string) *ItineraryError {
+	err := &ItineraryError{Kind: ItineraryCanceled, Message: message, Err: ctx.Err()}
+	if ctx.Err() == context.DeadlineExceeded {
+		err.Kind = ItineraryTimeout
+	}
+	return err
+}
+
 type Itinerary struct {
 	From *Stop
 	To   *Stop
@@ -15,6 +56,12 @@ type Itinerary struct {
 	MaxWaitDuration         uint // In seconds. Default: 60*15 (15 min)
 	DefaultTransferDuration uint // In seconds. Default: 60*5 (5 min)
 
+	Accessibility *AccessibilityProfile // Default: nil (no restriction)
+
+	MaxRounds  uint // Maximum number of explored steps (0 for unlimited). Default: 0
+	MaxLabels  uint // Maximum number of steps kept for exploration (0 for unlimited). Default: 0
+	MaxResults uint // Number of itineraries to find before stopping. Default: 10
+
 	Departure *time.Time
 	Arrival   *time.Time
 
@@ -40,6 +87,7 @@ func NewItinerary(f *Feed) (i *Itinerary) {
 	i.MaxTransfers = 3
 	i.MaxWaitDuration = 60 * 60 * 15
 	i.DefaultTransferDuration = 60 * 5
+	i.MaxResults = 10
 	// i.Step = Step{Steps:make([]Step,0)}
 	i.feed = f
 	return
@@ -72,97 +120,138 @@ func (step *Step) retrace(previousTrace *TmpTrace) (result *TmpTrace) {
 	return result
 }
 
-func (i *Itinerary) Run() {
-	// i.trips = i.feed.TripsForDayAndDayRange(i.DepartureTime, &DayRange{uint(i.DepartureTime.Hour), 60*30*3})
-	if i.Departure != nil {
-		i.departureTime = uint(i.Departure.Hour()*60*60 + i.Departure.Minute()*60 + i.Departure.Second())
+// Run searches for itineraries with a one minute time limit. See RunContext.
+func (i *Itinerary) Run() ([]*Step, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	return i.RunContext(ctx)
+}
+
+// RunContext searches for itineraries from i.From to i.To, leaving after i.Departure, until MaxResults
+// itineraries are found, the exploration limits are reached or ctx is done. The returned steps are
+// the last step of each itinerary found (use Step.Previous to retrace them).
+// When ctx is done, the itineraries found so far are returned along with an *ItineraryError.
+func (i *Itinerary) RunContext(ctx context.Context) ([]*Step, error) {
+	if i.From == nil || i.To == nil {
+		return nil, &ItineraryError{Kind: ItineraryInvalidQuery, Message: "From and To stops are required"}
+	}
+	if i.From == i.To {
+		return nil, &ItineraryError{Kind: ItineraryInvalidQuery, Message: "From and To are the same stop"}
+	}
+	if i.Departure == nil {
+		return nil, &ItineraryError{Kind: ItineraryInvalidQuery, Message: "Departure is required"}
 	}
+
+	// i.trips = i.feed.TripsForDayAndDayRange(i.DepartureTime, &DayRange{uint(i.DepartureTime.Hour), 60*30*3})
+	i.departureTime = uint(i.Departure.Hour()*60*60 + i.Departure.Minute()*60 + i.Departure.Second())
 	if i.Arrival != nil {
 		i.arrivalTime = uint(i.Arrival.Hour()*60*60 + i.Arrival.Minute()*60 + i.Arrival.Second())
 	}
 
+	// Walkers stop sending as soon as we return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	// start off the fun HERE
 	walked := make(chan bool, 1)
 	stepped := make(chan *Step, 10)
 	found := make(chan *Step, 1)
-	timeout := time.NewTicker(60 * 1 * 1E9).C
 
+	// Steps waiting to be walked, sorted by cost (linked through Step.parent)
 	var cheapestStep *Step
-	var otherStep *Step
-	var firstStep *Step
+	var labels, rounds uint
+	limitReached := false
+	insert := func(step *Step) {
+		labels += 1
+		if i.MaxLabels > 0 && labels > i.MaxLabels {
+			limitReached = true
+			return
+		}
+		if cheapestStep == nil || cheapestStep.Cost > step.Cost {
+			step.parent = cheapestStep
+			cheapestStep = step
+			return
+		}
+		currentStep := cheapestStep
+		for currentStep.parent != nil && currentStep.parent.Cost <= step.Cost {
+			currentStep = currentStep.parent
+		}
+		step.parent = currentStep.parent
+		currentStep.parent = step
+	}
+
+	results := make([]*Step, 0, i.MaxResults)
+	addResult := func(step *Step) bool {
+		trace := step.retrace(nil)
+		log.Println("===== Found")
+		log.Println(trace.trace())
+		results = append(results, step)
+		return i.MaxResults > 0 && uint(len(results)) >= i.MaxResults
+	}
+
 	for _, stoptime := range i.From.StopTimes {
+		if !i.Accessibility.AllowsBoarding(stoptime) {
+			continue
+		}
 		if stoptime.DepartureTime >= i.departureTime && stoptime.DepartureTime-i.departureTime < i.MaxWaitDuration {
-			if firstStep == nil {
-				firstStep = &Step{stoptime, nil, 0, 0, nil}
-			} else {
-				otherStep = &Step{stoptime, nil, 0, 0, otherStep}
-				if cheapestStep == nil {
-					cheapestStep = otherStep
-				}
-			}
+			insert(&Step{To: stoptime, Cost: int(stoptime.DepartureTime - i.departureTime)})
 		}
 	}
 
+	if cheapestStep == nil {
+		return nil, &ItineraryError{Kind: ItineraryNoRouteFound, Message: "no departure from " + i.From.Name + " within MaxWaitDuration"}
+	}
+
 	// log.Println("itinerary:",i.Departure, i.From.Name, i.To.Name, cheapestStep)
 
-	i.Walk(cheapestStep, stepped, walked, found)
-	// countWalked := 0
-	// countStep := 0
-	foundCount := 0
+	walkNext := func() {
+		nextStep := cheapestStep
+		cheapestStep = cheapestStep.parent
+		rounds += 1
+		i.Walk(ctx, nextStep, stepped, walked, found)
+	}
+	walkNext()
+
 	for {
 		select {
 		case step := <-stepped:
-			// log.Println("running step", step.ToString())
-			if cheapestStep != nil && cheapestStep.Cost > step.Cost {
-				step.parent = cheapestStep
-				cheapestStep = step
-			} else {
-				currentStep := cheapestStep
-				for {
-					if currentStep.parent == nil || currentStep.parent.Cost < step.Cost {
-						break
+			insert(step)
+		case <-walked:
+			// Everything the walker sent before finishing has to be handled before picking the next step
+			drained := false
+			for !drained {
+				select {
+				case step := <-stepped:
+					insert(step)
+				case step := <-found:
+					if addResult(step) {
+						return results, nil
 					}
-					currentStep = currentStep.parent
+				default:
+					drained = true
 				}
-				step.parent = currentStep.parent
-				currentStep.parent = step
 			}
 
-			// countStep+=1
-			// if countStep % 1000 == 0 {
-			// 	log.Println("countStep", countStep)
-			// }
-
-			break
-		case <-walked:
-			// log.Println("running walked")
-			nextStep := cheapestStep
-			if nextStep != nil {
-				cheapestStep = cheapestStep.parent
-				i.Walk(nextStep, stepped, walked, found)
-			} else {
-				panic("no routes found!!")
+			roundsExhausted := i.MaxRounds > 0 && rounds >= i.MaxRounds
+			if roundsExhausted {
+				limitReached = true
 			}
-
-			// countWalked+=1
-			// if countWalked % 1000 == 0 {
-			// 	log.Println("countWalked", countWalked)
-			// }
-
-			break
+			if cheapestStep == nil || roundsExhausted {
+				if len(results) > 0 {
+					return results, nil
+				}
+				if limitReached {
+					return nil, &ItineraryError{Kind: ItineraryNoRouteFound, Message: fmt.Sprintf("exploration limits reached after %d rounds and %d labels", rounds, labels)}
+				}
+				return nil, &ItineraryError{Kind: ItineraryNoRouteFound, Message: "no more steps to explore"}
+			}
+			walkNext()
 		case step := <-found:
-			foundCount += 1
-			// log.Println("running found", foundCount, ":", step.ToString())
-			trace := step.retrace(nil)
-			log.Println("===== Found")
-			log.Println(trace.trace())
-			if foundCount == 10 {
-				return
+			if addResult(step) {
+				return results, nil
 			}
-			break
-			// panic("Found!!"+step.ToString())
-		case <-timeout: // Timout after 10s
-			panic("Itinerary more than 1 min to complete")
+		case <-ctx.Done():
+			return results, contextError(ctx, fmt.Sprintf("stopped after %d rounds", rounds))
 		}
 	}
 }
@@ -181,29 +270,43 @@ func (s *Step) ToString() string {
 	return fmt.Sprintf("%v - cost: %v - changes:%v", s.To.Stop.Name, s.Cost, s.Changes)
 }
 
-func (i *Itinerary) Walk(step *Step, stepped chan *Step, walked chan bool, found chan *Step) {
+// Walk explores step in a new goroutine, sending the following steps on stepped, the final ones
+// on found and true on walked when done. It gives up sending as soon as ctx is done.
+func (i *Itinerary) Walk(ctx context.Context, step *Step, stepped chan *Step, walked chan bool, found chan *Step) {
 	go func() {
-		if finalStopTime, cost, yes := step.To.Trip.RunsFromTo(step.To.Stop, i.To); yes {
+		if finalStopTime, cost, yes := step.To.Trip.RunsFromTo(step.To.Stop, i.To); yes && i.Accessibility.AllowsStop(finalStopTime.Stop) {
 			// if step.To.ArrivalTime+uint(step.Cost)+i.DefaultTransferDuration <= finalStopTime.DepartureTime && uint(step.Changes+1) <= i.MaxTransfers && uint(cost)+uint(step.Cost)+i.DefaultTransferDuration < i.MaxDuration {
-			found <- &Step{
+			select {
+			case found <- &Step{
 				To:       finalStopTime,
 				Previous: step,
 				Cost:     step.Cost + cost + int(i.DefaultTransferDuration),
 				Changes:  step.Changes,
+			}:
+			case <-ctx.Done():
+				return
 			}
 			// }
 		} else {
 			nextStopTimeWithTransfer, cost, ok := step.To.Trip.NextStopTimeWithTransfer(step.To.Stop, nil)
 			for ok {
-				for _, st := range nextStopTimeWithTransfer.Stop.StopTimes {
-					if st.Trip.Route != nextStopTimeWithTransfer.Trip.Route { // If we change route
-						waitCost := st.DepartureTime - step.To.ArrivalTime
-						if waitCost < i.MaxWaitDuration && nextStopTimeWithTransfer.ArrivalTime+i.DefaultTransferDuration <= st.DepartureTime && uint(step.Changes+1) <= i.MaxTransfers && waitCost+uint(cost)+uint(step.Cost)+i.DefaultTransferDuration < i.MaxDuration {
-							stepped <- &Step{
-								To:       st,
-								Previous: step,
-								Cost:     int(st.DepartureTime-step.To.ArrivalTime) + step.Cost + cost + int(i.DefaultTransferDuration),
-								Changes:  step.Changes + 1,
+				if i.Accessibility.AllowsStop(nextStopTimeWithTransfer.Stop) {
+					for _, transfer := range i.transfersFrom(nextStopTimeWithTransfer.Stop) {
+						for _, st := range transfer.to.StopTimes {
+							if st.Trip.Route != nextStopTimeWithTransfer.Trip.Route && i.Accessibility.AllowsBoarding(st) { // If we change route
+								waitCost := st.DepartureTime - step.To.ArrivalTime
+								if waitCost < i.MaxWaitDuration && nextStopTimeWithTransfer.ArrivalTime+transfer.duration <= st.DepartureTime && uint(step.Changes+1) <= i.MaxTransfers && waitCost+uint(cost)+uint(step.Cost)+transfer.duration < i.MaxDuration {
+									select {
+									case stepped <- &Step{
+										To:       st,
+										Previous: step,
+										Cost:     int(st.DepartureTime-step.To.ArrivalTime) + step.Cost + cost + int(transfer.duration),
+										Changes:  step.Changes + 1,
+									}:
+									case <-ctx.Done():
+										return
+									}
+								}
 							}
 						}
 					}
@@ -212,10 +315,39 @@ func (i *Itinerary) Walk(step *Step, stepped chan *Step, walked chan bool, found
 			}
 		}
 
-		walked <- true
+		select {
+		case walked <- true:
+		case <-ctx.Done():
+		}
 	}()
 }
 
+type stopTransfer struct {
+	to       *Stop
+	duration uint // In seconds
+}
+
+// transfersFrom lists the stops a rider can change trips at after alighting at stop: the stop
+// itself and the ones declared in transfers.txt, filtered by the accessibility profile.
+func (i *Itinerary) transfersFrom(stop *Stop) []stopTransfer {
+	transfers := []stopTransfer{{stop, i.DefaultTransferDuration}}
+	for _, transfer := range stop.Transfers {
+		if transfer.TransferType == TransferImpossible || transfer.ToStopId == stop.Id {
+			continue
+		}
+		to := i.feed.StopCollection.Stop(transfer.ToStopId)
+		if to == nil || !i.Accessibility.AllowsTransfer(stop, to) {
+			continue
+		}
+		duration := i.DefaultTransferDuration
+		if transfer.MinTransferTime > 0 && uint(transfer.MinTransferTime) > duration {
+			duration = uint(transfer.MinTransferTime)
+		}
+		transfers = append(transfers, stopTransfer{to, duration})
+	}
+	return transfers
+}
+
 func tripsIntersectingStop(trips []*Trip, stop *Stop) []*Trip {
 	foundTrips := make([]*Trip, 0, len(trips))
 	for _, trip := range trips {
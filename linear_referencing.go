@@ -0,0 +1,283 @@
+package gtfs
+
+import (
+	"errors"
+	"github.com/nicolaspaton/gogtfs/geo"
+	"math"
+	"sort"
+)
+
+// maxProjectionCandidates is the number of positions along a shape considered for each stop
+const maxProjectionCandidates = 20
+
+// Distances returns the distance in meters traveled along the shape at each of its points
+func (s *Shape) Distances() []float64 {
+	distances := make([]float64, len(s.Points))
+	for i := 1; i < len(s.Points); i++ {
+		a, b := s.Points[i-1], s.Points[i]
+		distances[i] = distances[i-1] + geo.Haversine(a.Lat, a.Lon, b.Lat, b.Lon)
+	}
+	return distances
+}
+
+// Length returns the length of the shape in meters
+func (s *Shape) Length() float64 {
+	if len(s.Points) == 0 {
+		return 0
+	}
+	distances := s.Distances()
+	return distances[len(distances)-1]
+}
+
+// HasDistanceTraveled returns true if every point of the shape has a shape_dist_traveled value
+func (s *Shape) HasDistanceTraveled() bool {
+	for _, point := range s.Points {
+		if !point.hasDistanceTraveled {
+			return false
+		}
+	}
+	return len(s.Points) > 0
+}
+
+// fillDistanceTraveled sets the points' shape_dist_traveled to the distance in meters along the shape
+func (s *Shape) fillDistanceTraveled() {
+	for i, d := range s.Distances() {
+		s.Points[i].DistanceTraveled = d
+		s.Points[i].hasDistanceTraveled = true
+	}
+}
+
+// PointAt returns the position at meters along the shape
+func (s *Shape) PointAt(meters float64) (lat, lon float64) {
+	if len(s.Points) == 0 {
+		return 0, 0
+	}
+	distances := s.Distances()
+	i := sort.SearchFloat64s(distances, meters)
+	if i == 0 {
+		return s.Points[0].Lat, s.Points[0].Lon
+	}
+	if i >= len(distances) {
+		last := s.Points[len(s.Points)-1]
+		return last.Lat, last.Lon
+	}
+	a, b := s.Points[i-1], s.Points[i]
+	t := 0.0
+	if length := distances[i] - distances[i-1]; length > 0 {
+		t = (meters - distances[i-1]) / length
+	}
+	return a.Lat + t*(b.Lat-a.Lat), a.Lon + t*(b.Lon-a.Lon)
+}
+
+// shapePosition is the projection of a coordinate on a shape segment
+type shapePosition struct {
+	segment int
+	t       float64 // Position on the segment, from 0 to 1
+	lat     float64
+	lon     float64
+	meters  float64 // Distance along the shape
+	offset  float64 // Distance from the coordinate to the shape, in meters
+}
+
+// positions returns the best projections of lat, lon on the shape: the segments where the distance
+// to the coordinate is a local minimum, closest first. A loop shape passing twice by the same place
+// yields one position per passage.
+func (s *Shape) positions(lat, lon float64, distances []float64, max int) []shapePosition {
+	if len(s.Points) == 1 {
+		p := s.Points[0]
+		return []shapePosition{{0, 0, p.Lat, p.Lon, 0, geo.Haversine(lat, lon, p.Lat, p.Lon)}}
+	}
+	all := make([]shapePosition, len(s.Points)-1)
+	for i := range all {
+		a, b := s.Points[i], s.Points[i+1]
+		t, pLat, pLon := geo.ProjectOnSegment(lat, lon, a.Lat, a.Lon, b.Lat, b.Lon)
+		all[i] = shapePosition{i, t, pLat, pLon, distances[i] + t*(distances[i+1]-distances[i]), geo.Haversine(lat, lon, pLat, pLon)}
+	}
+	minima := make([]shapePosition, 0)
+	for i, position := range all {
+		if (i == 0 || position.offset <= all[i-1].offset) && (i == len(all)-1 || position.offset < all[i+1].offset) {
+			minima = append(minima, position)
+		}
+	}
+	sort.Slice(minima, func(i, j int) bool { return minima[i].offset < minima[j].offset })
+	if len(minima) > max {
+		minima = minima[:max]
+	}
+	return minima
+}
+
+// Project returns the position on the shape closest to lat, lon: the distance along the shape and
+// the distance from the coordinate to the shape, in meters.
+func (s *Shape) Project(lat, lon float64) (meters, offset float64) {
+	if len(s.Points) == 0 {
+		return 0, math.Inf(1)
+	}
+	best := s.positions(lat, lon, s.Distances(), 1)[0]
+	return best.meters, best.offset
+}
+
+// distanceTraveledAt converts a position to the shape's shape_dist_traveled unit, or meters when
+// the shape has no shape_dist_traveled values
+func (s *Shape) distanceTraveledAt(position shapePosition) float64 {
+	if !s.HasDistanceTraveled() || len(s.Points) < 2 {
+		return position.meters
+	}
+	a, b := s.Points[position.segment], s.Points[position.segment+1]
+	return a.DistanceTraveled + position.t*(b.DistanceTraveled-a.DistanceTraveled)
+}
+
+// ShapeProjection is the position of a stop time's stop on its trip's shape
+type ShapeProjection struct {
+	StopTime *StopTime
+
+	// Projected coordinate
+	Lat float64
+	Lon float64
+
+	Meters            float64 // Distance along the shape, in meters
+	ShapeDistTraveled float64 // Distance along the shape, in the shape's shape_dist_traveled unit (meters if it has none)
+	Offset            float64 // Distance from the stop to the shape, in meters
+}
+
+// projectSequence projects coordinates in order on the shape: the distance along the shape never
+// decreases by more than slack meters from a coordinate to the next, so places passed twice by loop
+// shapes are projected on the right passage. ok is false when there is no such projection, positions
+// are then the closest ones.
+func (s *Shape) projectSequence(coordinates []Coordinate, slack float64) (positions []shapePosition, ok bool) {
+	if len(coordinates) == 0 {
+		return nil, true
+	}
+	distances := s.Distances()
+
+	// Dynamic programming over the candidate positions of each coordinate, minimizing the sum of
+	// the offsets.
+	candidates := make([][]shapePosition, len(coordinates))
+	costs := make([][]float64, len(coordinates))
+	previous := make([][]int, len(coordinates))
+	for i, coordinate := range coordinates {
+		candidates[i] = s.positions(coordinate.Lat, coordinate.Lon, distances, maxProjectionCandidates)
+		costs[i] = make([]float64, len(candidates[i]))
+		previous[i] = make([]int, len(candidates[i]))
+		for c, candidate := range candidates[i] {
+			costs[i][c] = math.Inf(1)
+			previous[i][c] = -1
+			if i == 0 {
+				costs[i][c] = candidate.offset
+				continue
+			}
+			for p, prior := range candidates[i-1] {
+				if prior.meters <= candidate.meters+slack && costs[i-1][p]+candidate.offset < costs[i][c] {
+					costs[i][c] = costs[i-1][p] + candidate.offset
+					previous[i][c] = p
+				}
+			}
+		}
+	}
+
+	last := len(coordinates) - 1
+	best := -1
+	for c := range candidates[last] {
+		if best == -1 || costs[last][c] < costs[last][best] {
+			best = c
+		}
+	}
+
+	positions = make([]shapePosition, len(coordinates))
+	if best == -1 || math.IsInf(costs[last][best], 1) {
+		for i := range coordinates {
+			positions[i] = candidates[i][0]
+		}
+		return positions, false
+	}
+	for i := last; i >= 0; i-- {
+		positions[i] = candidates[i][best]
+		best = previous[i][best]
+	}
+	return positions, true
+}
+
+// ProjectStopTimes positions each stop of the trip on its shape, in stop_sequence order (see
+// projectSequence). When the stops can't be projected in order, each stop gets its closest position.
+// Stop times without stop are skipped.
+func (t *Trip) ProjectStopTimes() ([]*ShapeProjection, error) {
+	shape := t.feed.Shapes[t.ShapeId]
+	if shape == nil || len(shape.Points) == 0 {
+		return nil, errors.New("Trip " + t.Id + " has no shape")
+	}
+
+	stopTimes := make([]*StopTime, 0, len(t.StopTimes))
+	coordinates := make([]Coordinate, 0, len(t.StopTimes))
+	for _, st := range t.StopTimes {
+		if st != nil && st.Stop != nil {
+			stopTimes = append(stopTimes, st)
+			coordinates = append(coordinates, Coordinate{st.Stop.Lat, st.Stop.Lon})
+		}
+	}
+	if len(stopTimes) == 0 {
+		return nil, nil
+	}
+
+	positions, _ := shape.projectSequence(coordinates, 0)
+	projections := make([]*ShapeProjection, len(stopTimes))
+	for i, st := range stopTimes {
+		projections[i] = shape.projection(st, positions[i])
+	}
+	return projections, nil
+}
+
+func (s *Shape) projection(st *StopTime, position shapePosition) *ShapeProjection {
+	return &ShapeProjection{
+		StopTime:          st,
+		Lat:               position.lat,
+		Lon:               position.lon,
+		Meters:            position.meters,
+		ShapeDistTraveled: s.distanceTraveledAt(position),
+		Offset:            position.offset,
+	}
+}
+
+// ComputeShapeDistTraveled fills the missing shape_dist_traveled values of the feed: in meters for
+// shapes without any (unless their trips' stop times already use another unit), and for every stop
+// time by projecting its stop on the trip's shape. It returns the projections of the stops further
+// than maxOffset meters from their shape.
+func (f *Feed) ComputeShapeDistTraveled(maxOffset float64) (outliers []*ShapeProjection) {
+	shapeTrips := make(map[*Shape][]*Trip)
+	for _, trip := range f.Trips {
+		if shape := f.Shapes[trip.ShapeId]; shape != nil {
+			shapeTrips[shape] = append(shapeTrips[shape], trip)
+		}
+	}
+
+	for shape, trips := range shapeTrips {
+		if !shape.HasDistanceTraveled() && !anyStopTimeHasShapeDistTraveled(trips) {
+			shape.fillDistanceTraveled()
+		}
+		for _, trip := range trips {
+			projections, err := trip.ProjectStopTimes()
+			if err != nil {
+				continue
+			}
+			for _, projection := range projections {
+				if !projection.StopTime.hasShapeDistTraveled && shape.HasDistanceTraveled() {
+					projection.StopTime.ShapeDistTraveled = projection.ShapeDistTraveled
+					projection.StopTime.hasShapeDistTraveled = true
+				}
+				if projection.Offset > maxOffset {
+					outliers = append(outliers, projection)
+				}
+			}
+		}
+	}
+	return
+}
+
+func anyStopTimeHasShapeDistTraveled(trips []*Trip) bool {
+	for _, trip := range trips {
+		for _, st := range trip.StopTimes {
+			if st != nil && st.hasShapeDistTraveled {
+				return true
+			}
+		}
+	}
+	return false
+}
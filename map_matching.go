@@ -0,0 +1,295 @@
+package gtfs
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GPSPing is a vehicle position at a given time
+type GPSPing struct {
+	Time time.Time
+	Lat  float64
+	Lon  float64
+}
+
+// MatchedPing is a ping projected on the shape of a trip
+type MatchedPing struct {
+	Ping *GPSPing
+
+	// Projected coordinate
+	Lat float64
+	Lon float64
+
+	Offset   float64 // Distance from the ping to the shape, in meters
+	Distance float64 // Distance along the trip's shape, in meters
+
+	ScheduledTime uint // Time of day in seconds when the trip is scheduled at Distance, interpolated between stop times
+	Deviation     int  // In seconds, positive when the vehicle is late
+}
+
+// TripMatch is a trip (and run, for frequency based trips) the pings may belong to
+type TripMatch struct {
+	Trip  *Trip
+	Pings []*MatchedPing
+
+	// Start of the run for frequency based trips, time of day in seconds (0 otherwise)
+	RunStart uint
+
+	MeanOffset    float64 // In meters
+	MeanDeviation float64 // Mean absolute deviation, in seconds
+	Score         float64 // The lower the better, see MapMatcher.DeviationWeight
+}
+
+// MapMatcher finds the trip a sequence of GPS pings most likely belongs to, among the trips running
+// on the day of the first ping, and relates each ping to the trip's shape and schedule.
+type MapMatcher struct {
+	// Default: nil (any route)
+	Route *Route
+
+	MaxOffset       float64 // In meters, pings further from a trip's shape are off route. Default: 100
+	MaxOffRoute     float64 // Share of off route pings above which a trip is discarded. Default: 0.2
+	MaxDeviation    uint    // In seconds, trips with a larger mean deviation are discarded. Default: 60*30 (30 min)
+	DeviationWeight float64 // Meters of offset a minute of schedule deviation weighs in the Score. Default: 20
+	Backtrack       float64 // In meters, GPS noise allowed backwards between two pings. Default: 30
+
+	feed       *Feed
+	lock       sync.Mutex           // Guards the cache below
+	index      *ShapeIndex          // Feed shape index the cache was built with
+	stopMeters map[string][]float64 // Distance along the shape of each stop, by shape and stops, see stopPositions
+}
+
+// searchedPings is the number of pings, spread along the trace, around which candidate shapes are searched
+const searchedPings = 10
+
+func NewMapMatcher(f *Feed) (m *MapMatcher) {
+	m = &MapMatcher{}
+	m.MaxOffset = 100
+	m.MaxOffRoute = 0.2
+	m.MaxDeviation = 60 * 30
+	m.DeviationWeight = 20
+	m.Backtrack = 30
+	m.feed = f
+	return
+}
+
+// Match returns the most likely trip for pings (sorted by time)
+func (m *MapMatcher) Match(pings []*GPSPing) (*TripMatch, error) {
+	matches, err := m.Candidates(pings)
+	if err != nil {
+		return nil, err
+	}
+	return matches[0], nil
+}
+
+// Candidates returns all the trips matching pings, best Score first
+func (m *MapMatcher) Candidates(pings []*GPSPing) ([]*TripMatch, error) {
+	if len(pings) == 0 {
+		return nil, errors.New("No GPS pings to match")
+	}
+	pings = append([]*GPSPing(nil), pings...)
+	sort.SliceStable(pings, func(i, j int) bool { return pings[i].Time.Before(pings[j].Time) })
+
+	coordinates := make([]Coordinate, len(pings))
+	for i, ping := range pings {
+		coordinates[i] = Coordinate{ping.Lat, ping.Lon}
+	}
+
+	// Shapes passing by a few pings spread along the trace (a single noisy ping doesn't rule out the
+	// right shape), with the trips using them that run that day
+	date := pings[0].Time
+	running := make(map[*Trip]bool)
+	for _, trip := range m.feed.TripsForDay(&date) {
+		if m.Route == nil || trip.Route == m.Route {
+			running[trip] = true
+		}
+	}
+	index := m.feed.ShapeIndex()
+	found := make(map[*Shape]bool)
+	shapes := make([]*Shape, 0)
+	samples := len(coordinates)
+	if samples > searchedPings {
+		samples = searchedPings
+	}
+	for i := 0; i < samples; i++ {
+		coordinate := coordinates[0]
+		if samples > 1 {
+			coordinate = coordinates[i*(len(coordinates)-1)/(samples-1)]
+		}
+		for _, near := range index.ShapesNear(coordinate.Lat, coordinate.Lon, m.MaxOffset) {
+			if !found[near.Shape] {
+				found[near.Shape] = true
+				shapes = append(shapes, near.Shape)
+			}
+		}
+	}
+	sort.Slice(shapes, func(i, j int) bool { return shapes[i].Id < shapes[j].Id })
+
+	matches := make([]*TripMatch, 0)
+	for _, shape := range shapes {
+		trips := make([]*Trip, 0)
+		for _, trip := range index.TripsOf(shape) {
+			if running[trip] {
+				trips = append(trips, trip)
+			}
+		}
+		if len(trips) == 0 {
+			continue
+		}
+
+		positions, inOrder := shape.projectSequence(coordinates, m.Backtrack)
+		if !inOrder {
+			// The vehicle goes the other way
+			continue
+		}
+		offRoute := 0
+		meanOffset := 0.0
+		for _, position := range positions {
+			if position.offset > m.MaxOffset {
+				offRoute++
+			}
+			meanOffset += position.offset / float64(len(positions))
+		}
+		if float64(offRoute) > m.MaxOffRoute*float64(len(positions)) {
+			continue
+		}
+
+		for _, trip := range trips {
+			if match := m.matchTrip(index, trip, pings, positions); match != nil {
+				match.MeanOffset = meanOffset
+				match.Score = meanOffset + m.DeviationWeight*match.MeanDeviation/60
+				matches = append(matches, match)
+			}
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, errors.New("No trip matches the GPS pings")
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score < matches[j].Score })
+	return matches, nil
+}
+
+// matchTrip compares the pings, projected on the trip's shape at positions, to the schedule of the
+// trip (of its closest run for frequency based trips). It returns nil if the trip is too far from schedule.
+func (m *MapMatcher) matchTrip(index *ShapeIndex, trip *Trip, pings []*GPSPing, positions []shapePosition) *TripMatch {
+	stopTimes, meters := m.stopPositions(index, trip)
+	if len(meters) == 0 {
+		return nil
+	}
+
+	// Scheduled times along the shape, relative to the trip's first departure
+	first := stopTimes[0].DepartureTime
+	scheduled := make([]int, len(positions))
+	for i, position := range positions {
+		scheduled[i] = int(scheduledTimeAt(stopTimes, meters, position.meters)) - int(first)
+	}
+
+	starts := []uint{first}
+	if len(trip.Frequencies) > 0 {
+		starts = starts[:0]
+		for _, freq := range trip.Frequencies {
+			if freq.HeadwaySecs == 0 {
+				continue
+			}
+			for start := freq.StartTime; start < freq.EndTime; start += freq.HeadwaySecs {
+				starts = append(starts, start)
+			}
+		}
+	}
+
+	var best *TripMatch
+	for _, start := range starts {
+		match := &TripMatch{Trip: trip, Pings: make([]*MatchedPing, len(pings))}
+		if len(trip.Frequencies) > 0 {
+			match.RunStart = start
+		}
+		for i, ping := range pings {
+			at := uint(int(start) + scheduled[i])
+			deviation := int(timeOfDayInSeconds(&ping.Time)) - int(at)
+			// Pings and trips on both sides of midnight (trips running after midnight have times beyond 24:00:00)
+			if deviation < -12*60*60 {
+				deviation += 24 * 60 * 60
+			} else if deviation > 12*60*60 {
+				deviation -= 24 * 60 * 60
+			}
+			match.Pings[i] = &MatchedPing{
+				Ping:          ping,
+				Lat:           positions[i].lat,
+				Lon:           positions[i].lon,
+				Offset:        positions[i].offset,
+				Distance:      positions[i].meters,
+				ScheduledTime: at,
+				Deviation:     deviation,
+			}
+			match.MeanDeviation += math.Abs(float64(deviation)) / float64(len(pings))
+		}
+		if best == nil || match.MeanDeviation < best.MeanDeviation {
+			best = match
+		}
+	}
+	if best == nil || best.MeanDeviation > float64(m.MaxDeviation) {
+		return nil
+	}
+	return best
+}
+
+// stopPositions returns the stop times of trip at a known stop and their distance along the trip's
+// shape (see Trip.ProjectStopTimes). The distances are cached by shape and stops, trips of a pattern
+// are only projected once.
+func (m *MapMatcher) stopPositions(index *ShapeIndex, trip *Trip) ([]*StopTime, []float64) {
+	stopTimes := servedStopTimes(trip)
+	ids := make([]string, 0, len(stopTimes)+1)
+	ids = append(ids, trip.ShapeId)
+	for _, st := range stopTimes {
+		ids = append(ids, st.Stop.Id)
+	}
+	key := strings.Join(ids, "\x00")
+
+	m.lock.Lock()
+	if m.index != index {
+		m.index, m.stopMeters = index, make(map[string][]float64)
+	}
+	meters, ok := m.stopMeters[key]
+	m.lock.Unlock()
+	if ok {
+		return stopTimes, meters
+	}
+
+	projections, err := trip.ProjectStopTimes()
+	if err == nil {
+		meters = make([]float64, len(projections))
+		for i, projection := range projections {
+			meters[i] = projection.Meters
+		}
+	}
+	m.lock.Lock()
+	if m.index == index {
+		m.stopMeters[key] = meters
+	}
+	m.lock.Unlock()
+	return stopTimes, meters
+}
+
+// scheduledTimeAt interpolates the time of day at meters along the shape between the stop times
+// at stopMeters along it, from the departure of a stop to the arrival at the next one.
+func scheduledTimeAt(stopTimes []*StopTime, stopMeters []float64, meters float64) uint {
+	if meters <= stopMeters[0] {
+		return stopTimes[0].DepartureTime
+	}
+	for i := 1; i < len(stopTimes); i++ {
+		from, to := stopTimes[i-1], stopTimes[i]
+		if meters > stopMeters[i] {
+			continue
+		}
+		departure, arrival := float64(from.DepartureTime), float64(to.ArrivalTime)
+		if stopMeters[i] <= stopMeters[i-1] || arrival < departure {
+			return to.ArrivalTime
+		}
+		return uint(departure + (arrival-departure)*(meters-stopMeters[i-1])/(stopMeters[i]-stopMeters[i-1]))
+	}
+	return stopTimes[len(stopTimes)-1].ArrivalTime
+}
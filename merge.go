@@ -0,0 +1,373 @@
+package gtfs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// FeedMerger.Collisions possible values, how the ids of the feeds are renamed:
+const (
+	CollisionPrefixColliding = iota // 0 - Prefix the ids already used by a previous feed
+	CollisionPrefixAll              // 1 - Prefix every id of every feed
+)
+
+// FeedMerger combines feeds into a new one. Agencies stay separate, ids used by several feeds are
+// prefixed, services with the same id and the same dates are shared, and stops of different feeds
+// that are the same place (close to each other, with similar names) become one.
+type FeedMerger struct {
+	Collisions int      // See Collision constants. Default: CollisionPrefixColliding
+	Prefixes   []string // Prefix of the ids of each feed. Default: "1_", "2_", ...
+
+	MergeStops        bool    // Default: true
+	StopDistance      float64 // In meters, between two stops to merge. Default: 20
+	MinNameSimilarity float64 // From 0 (any name) to 1 (same name once normalized), see StopClustering. Default: 0.9
+
+	// Filled by Run
+	MergedStops int // Stops of a feed replaced by the same stop of a previous one
+	RenamedIds  int
+
+	feeds []*Feed
+}
+
+func NewFeedMerger(feeds ...*Feed) (m *FeedMerger) {
+	m = &FeedMerger{}
+	m.Collisions = CollisionPrefixColliding
+	m.Prefixes = make([]string, len(feeds))
+	for i := range feeds {
+		m.Prefixes[i] = fmt.Sprintf("%d_", i+1)
+	}
+	m.MergeStops = true
+	m.StopDistance = 20
+	m.MinNameSimilarity = 0.9
+	m.feeds = feeds
+	return
+}
+
+// mergeIds maps the ids of the entities of a feed to their id in the merged feed, by kind of
+// entity ("stop", "route", ...)
+type mergeIds struct {
+	merger *FeedMerger
+	prefix string
+	used   map[string]map[string]bool // Ids of the merged feed
+	ids    map[string]map[string]string
+}
+
+// set maps id to an existing id of the merged feed
+func (m *mergeIds) set(kind, id, merged string) {
+	if m.ids[kind] == nil {
+		m.ids[kind] = make(map[string]string)
+	}
+	m.ids[kind][id] = merged
+}
+
+// rename returns the merged id of id, renaming it on first use
+func (m *mergeIds) rename(kind, id string) string {
+	if renamed, ok := m.ids[kind][id]; ok {
+		return renamed
+	}
+	if m.used[kind] == nil {
+		m.used[kind] = make(map[string]bool)
+	}
+	renamed := id
+	if m.merger.Collisions == CollisionPrefixAll {
+		renamed = m.prefix + id
+	}
+	for m.used[kind][renamed] {
+		renamed = m.prefix + renamed
+	}
+	if renamed != id {
+		m.merger.RenamedIds++
+	}
+	m.used[kind][renamed] = true
+	m.set(kind, id, renamed)
+	return renamed
+}
+
+// Run returns the merged feed, it needs at least a feed
+func (m *FeedMerger) Run() (*Feed, error) {
+	if len(m.feeds) == 0 {
+		return nil, errors.New("No feed to merge")
+	}
+	if len(m.Prefixes) < len(m.feeds) {
+		return nil, errors.New("A prefix is needed for each feed")
+	}
+	merged, _ := NewFeed("")
+	merged.Loaded = true
+	m.MergedStops, m.RenamedIds = 0, 0
+
+	used := make(map[string]map[string]bool)
+	for i, feed := range m.feeds {
+		ids := &mergeIds{m, m.Prefixes[i], used, make(map[string]map[string]string)}
+		agencies := m.mergeAgencies(merged, feed, ids)
+		stops := m.mergeStops(merged, feed, ids)
+		routes := m.mergeRoutes(merged, feed, ids, agencies)
+		m.mergeServices(merged, feed, ids)
+		m.mergeShapes(merged, feed, ids)
+		m.mergeTrips(merged, feed, ids, routes, stops)
+		m.mergeFares(merged, feed, ids)
+	}
+	merged.invalidateShapeIndex()
+	return merged, nil
+}
+
+// mergeAgencies copies the agencies, the empty agency_id of single agency feeds becoming the feed
+// prefix followed by "agency"
+func (m *FeedMerger) mergeAgencies(merged, feed *Feed, ids *mergeIds) map[*Agency]*Agency {
+	agencies := make(map[*Agency]*Agency)
+	for _, agency := range feed.Agencies {
+		copied := *agency
+		copied.feed = merged
+		if agency.Id == "" {
+			copied.Id = ids.rename("agency", ids.prefix+"agency")
+		} else {
+			copied.Id = ids.rename("agency", agency.Id)
+		}
+		merged.Agencies[copied.Id] = &copied
+		agencies[agency] = &copied
+	}
+	return agencies
+}
+
+// sameStop returns the stop of the merged feed that is the same place as stop, if any
+func (m *FeedMerger) sameStop(merged *Feed, stop *Stop) *Stop {
+	var same *Stop
+	for _, candidate := range merged.StopCollection.StopDistancesByProximity(stop.Lat, stop.Lon, m.StopDistance) {
+		if candidate.Stop.LocationType == stop.LocationType && nameSimilarity(candidate.Stop.Name, stop.Name) >= m.MinNameSimilarity {
+			same = candidate.Stop
+			break
+		}
+	}
+	return same
+}
+
+func (m *FeedMerger) mergeStops(merged, feed *Feed, ids *mergeIds) map[*Stop]*Stop {
+	stops := make(map[*Stop]*Stop)
+	sorted := feed.sortedStops()
+
+	// Matched against the stops of the previous feeds only
+	if m.MergeStops && merged.StopCollection.Length() > 0 {
+		for _, stop := range sorted {
+			if same := m.sameStop(merged, stop); same != nil {
+				stops[stop] = same
+				ids.set("stop", stop.Id, same.Id)
+				m.MergedStops++
+			}
+		}
+	}
+
+	added := make([]*Stop, 0)
+	for _, stop := range sorted {
+		if stops[stop] != nil {
+			continue
+		}
+		copied := *stop
+		copied.Id = ids.rename("stop", stop.Id)
+		if stop.ZoneId != "" {
+			copied.ZoneId = ids.rename("zone", stop.ZoneId)
+		}
+		copied.Transfers = make(map[string]*Transfer)
+		copied.Pathways = nil
+		copied.StopTimes = nil
+		copied.feed = merged
+		stops[stop] = &copied
+		added = append(added, &copied)
+	}
+	for _, stop := range added {
+		if stop.ParentStationId != "" {
+			stop.ParentStationId = ids.rename("stop", stop.ParentStationId)
+		}
+		merged.StopCollection.SetStop(stop.Id, stop)
+	}
+
+	// Transfers and pathways, once all the stops are known
+	for _, stop := range sorted {
+		from := stops[stop]
+		for toId, transfer := range stop.Transfers {
+			copied := *transfer
+			copied.FromStopId, copied.ToStopId = from.Id, ids.rename("stop", toId)
+			copied.feed = merged
+			if from.Transfers[copied.ToStopId] == nil {
+				from.Transfers[copied.ToStopId] = &copied
+				merged.TranfersCount++
+			}
+		}
+	}
+	pathways := make(map[*Pathway]bool)
+	for _, stop := range sorted {
+		for _, pathway := range stop.Pathways {
+			if pathways[pathway] {
+				continue
+			}
+			pathways[pathway] = true
+			copied := *pathway
+			copied.Id = ids.rename("pathway", pathway.Id)
+			copied.FromStopId = ids.rename("stop", pathway.FromStopId)
+			copied.ToStopId = ids.rename("stop", pathway.ToStopId)
+			copied.feed = merged
+			if from := merged.StopCollection.Stop(copied.FromStopId); from != nil {
+				from.Pathways = append(from.Pathways, &copied)
+			}
+			if to := merged.StopCollection.Stop(copied.ToStopId); to != nil && copied.ToStopId != copied.FromStopId {
+				to.Pathways = append(to.Pathways, &copied)
+			}
+		}
+	}
+	return stops
+}
+
+func (m *FeedMerger) mergeRoutes(merged, feed *Feed, ids *mergeIds, agencies map[*Agency]*Agency) map[*Route]*Route {
+	routes := make(map[*Route]*Route)
+	for _, id := range sortedRouteIds(feed.Routes) {
+		route := feed.Routes[id]
+		copied := *route
+		copied.Id = ids.rename("route", route.Id)
+		copied.Agency = agencies[route.Agency]
+		if copied.Agency == nil && len(feed.Agencies) == 1 {
+			copied.Agency = agencies[feed.singleAgency()]
+		}
+		copied.agencyId = ""
+		if copied.Agency != nil {
+			copied.agencyId = copied.Agency.Id
+		}
+		copied.feed = merged
+		merged.Routes[copied.Id] = &copied
+		routes[route] = &copied
+	}
+	return routes
+}
+
+// sameDates returns whether a service of two feeds runs on the same days
+func sameDates(a *Feed, aId string, b *Feed, bId string) bool {
+	aDates, bDates := a.ServiceDates(aId), b.ServiceDates(bId)
+	if len(aDates) != len(bDates) {
+		return false
+	}
+	for i := range aDates {
+		if aDates[i] != bDates[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeServices copies the calendars and calendar dates. A service with the id and the dates of a
+// service of a previous feed is shared.
+func (m *FeedMerger) mergeServices(merged, feed *Feed, ids *mergeIds) {
+	for _, id := range feed.sortedServiceIds() {
+		if m.Collisions == CollisionPrefixColliding && ids.used["service"][id] && sameDates(merged, id, feed, id) {
+			ids.set("service", id, id)
+			continue
+		}
+		renamed := ids.rename("service", id)
+		if calendar := feed.Calendars[id]; calendar != nil {
+			copied := *calendar
+			copied.serviceId = renamed
+			copied.feed = merged
+			merged.Calendars[renamed] = &copied
+		}
+		for _, cd := range feed.CalendarDates[id] {
+			copied := *cd
+			copied.serviceId = renamed
+			copied.feed = merged
+			merged.CalendarDates[renamed] = append(merged.CalendarDates[renamed], &copied)
+		}
+	}
+}
+
+func (m *FeedMerger) mergeShapes(merged, feed *Feed, ids *mergeIds) {
+	shapeIds := make([]string, 0, len(feed.Shapes))
+	for id := range feed.Shapes {
+		shapeIds = append(shapeIds, id)
+	}
+	sort.Strings(shapeIds)
+	for _, id := range shapeIds {
+		shape := feed.Shapes[id]
+		copied := &Shape{Id: ids.rename("shape", id), Color: shape.Color, Points: make([]*ShapePoint, len(shape.Points))}
+		for i, point := range shape.Points {
+			copiedPoint := *point
+			copiedPoint.Id = copied.Id
+			copiedPoint.feed = merged
+			copied.Points[i] = &copiedPoint
+		}
+		merged.Shapes[copied.Id] = copied
+	}
+}
+
+// mergeTrips copies the trips, with their stop times and frequencies. Trips whose route is missing
+// are left out.
+func (m *FeedMerger) mergeTrips(merged, feed *Feed, ids *mergeIds, routes map[*Route]*Route, stops map[*Stop]*Stop) {
+	for _, id := range sortedTripIds(feed.Trips) {
+		trip := feed.Trips[id]
+		if routes[trip.Route] == nil {
+			continue
+		}
+		copied := *trip
+		copied.Id = ids.rename("trip", trip.Id)
+		copied.Route = routes[trip.Route]
+		copied.routeId = copied.Route.Id
+		copied.serviceId = ids.rename("service", trip.serviceId)
+		if trip.ShapeId != "" {
+			copied.ShapeId = ids.rename("shape", trip.ShapeId)
+		}
+		if trip.BlockId != "" {
+			copied.BlockId = ids.rename("block", trip.BlockId)
+		}
+		copied.feed = merged
+
+		copied.StopTimes = make([]*StopTime, 0, len(trip.StopTimes))
+		for _, st := range stopTimesOf(trip) {
+			if stops[st.Stop] == nil {
+				continue
+			}
+			copiedStopTime := *st
+			copiedStopTime.Trip = &copied
+			copiedStopTime.Stop = stops[st.Stop]
+			copiedStopTime.tripId, copiedStopTime.stopId = copied.Id, copiedStopTime.Stop.Id
+			copiedStopTime.feed = merged
+			copied.StopTimes = append(copied.StopTimes, &copiedStopTime)
+			copiedStopTime.Stop.StopTimes = append(copiedStopTime.Stop.StopTimes, &copiedStopTime)
+		}
+		copied.Frequencies = make([]Frequency, len(trip.Frequencies))
+		for i, freq := range trip.Frequencies {
+			freq.Trip = &copied
+			freq.tripId = copied.Id
+			freq.feed = merged
+			copied.Frequencies[i] = freq
+		}
+		merged.StopTimesCount += len(copied.StopTimes)
+		merged.FrequenciesCount += len(copied.Frequencies)
+		merged.Trips[copied.Id] = &copied
+	}
+}
+
+// mergeFares copies the fare attributes and rules, with the zone and route ids of the merged feed
+func (m *FeedMerger) mergeFares(merged, feed *Feed, ids *mergeIds) {
+	fareIds := make([]string, 0, len(feed.FareAttributes))
+	for id := range feed.FareAttributes {
+		fareIds = append(fareIds, id)
+	}
+	sort.Strings(fareIds)
+	for _, id := range fareIds {
+		copied := *feed.FareAttributes[id]
+		copied.Id = ids.rename("fare", id)
+		copied.feed = merged
+		merged.FareAttributes[copied.Id] = &copied
+	}
+	zone := func(id string) string {
+		if id == "" {
+			return ""
+		}
+		return ids.rename("zone", id)
+	}
+	for _, rule := range feed.FareRules {
+		copied := *rule
+		copied.Id = ids.rename("fare", rule.Id)
+		if rule.RouteId != "" {
+			copied.RouteId = ids.rename("route", rule.RouteId)
+		}
+		copied.OriginId, copied.DestinationId, copied.ContainsId = zone(rule.OriginId), zone(rule.DestinationId), zone(rule.ContainsId)
+		copied.feed = merged
+		merged.FareRules = append(merged.FareRules, &copied)
+	}
+}
@@ -0,0 +1,312 @@
+package gtfs
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// CriteriaWeights ranks the journeys of a Pareto set. The score of a journey is expressed in minutes:
+// Time per minute of travel, Transfer per transfer, Walk per kilometer walked and Fare per unit of currency.
+type CriteriaWeights struct {
+	Time     float64 // Default: 1
+	Transfer float64 // Default: 5
+	Walk     float64 // Default: 10
+	Fare     float64 // Default: 5
+}
+
+// JourneyLeg is a ride on a trip, or a walk between two stops when Trip is nil.
+type JourneyLeg struct {
+	Trip      *Trip
+	From      *Stop
+	To        *Stop
+	Departure uint           // Time of day in seconds
+	Arrival   uint           // In seconds
+	Distance  float64        // Walking distance in meters, 0 for rides
+	Fare      *FareAttribute // nil for walks and rides without fare information
+	Price     float64        // Paid for the leg, 0 when it is a transfer allowed by the fare of a previous leg
+}
+
+// Journey is an itinerary with its criteria kept apart (unlike Step.Cost).
+type Journey struct {
+	Legs         []*JourneyLeg
+	Departure    uint    // Time of day in seconds
+	Arrival      uint    // In seconds
+	Transfers    int     // Number of trip changes
+	WalkDistance float64 // In meters
+	Fare         float64 // Sum of the legs' prices
+	Score        float64 // See CriteriaWeights
+}
+
+// MultiCriteriaItinerary finds the Pareto set of journeys from a stop to another, optimizing arrival time,
+// number of transfers, walking distance and fare at the same time (multi-criteria Connection Scan Algorithm).
+type MultiCriteriaItinerary struct {
+	From *Stop
+	To   *Stop
+
+	Departure *time.Time
+
+	MaxTransfers        int     // Default: 3
+	MaxDuration         uint    // In seconds. Default: 60*60*3 (3 hours)
+	MinTransferDuration uint    // In seconds, to change trips at the same stop. Default: 60*2 (2 min)
+	WalkSpeed           float64 // In meters per second. Default: 1.3
+	MaxWalkDistance     float64 // In meters, between two stops. Default: 500
+
+	Accessibility *AccessibilityProfile // Default: nil (no restriction)
+	Weights       CriteriaWeights
+
+	feed          *Feed
+	departureTime uint
+}
+
+func NewMultiCriteriaItinerary(f *Feed) (i *MultiCriteriaItinerary) {
+	i = &MultiCriteriaItinerary{}
+	i.MaxTransfers = 3
+	i.MaxDuration = 60 * 60 * 3
+	i.MinTransferDuration = 60 * 2
+	i.WalkSpeed = 1.3
+	i.MaxWalkDistance = 500
+	i.Weights = CriteriaWeights{Time: 1, Transfer: 5, Walk: 10, Fare: 5}
+	i.feed = f
+	return
+}
+
+// mcLabel is a way of reaching stop, with the leg that led there
+type mcLabel struct {
+	stop      *Stop
+	arrival   uint
+	boardings int
+	walk      float64
+	fare      float64
+
+	// Last fare paid, which may cover the next rides (see FareAttribute.Transfers and TransferDuration)
+	ticket          *FareAttribute
+	ticketStart     uint // Departure of the ride it was paid for
+	ticketTransfers int  // Rides covered after the first one
+
+	previous  *mcLabel
+	trip      *Trip
+	departure uint
+	distance  float64
+	legFare   *FareAttribute
+	price     float64
+}
+
+// dominates returns whether a is at least as good as b on every criterion, a ticket possibly
+// covering the next rides being better than none
+func (a *mcLabel) dominates(b *mcLabel) bool {
+	if a.arrival > b.arrival || a.boardings > b.boardings || a.walk > b.walk || a.fare > b.fare {
+		return false
+	}
+	return b.ticket == nil || (a.ticket == b.ticket && a.ticketStart >= b.ticketStart && a.ticketTransfers <= b.ticketTransfers)
+}
+
+// pay charges label for a ride on fare departing at departure, unless the ticket of the previous
+// label covers it
+func (label *mcLabel) pay(fare *FareAttribute, departure uint) {
+	previous := label.previous
+	label.legFare = fare
+	label.ticket, label.ticketStart, label.ticketTransfers = previous.ticket, previous.ticketStart, previous.ticketTransfers
+	if fare == nil {
+		return
+	}
+	if previous.ticket == fare && fare.transferAllowed(previous.ticketStart, departure, previous.ticketTransfers) {
+		label.ticketTransfers++
+		return
+	}
+	label.price = fare.Price
+	label.fare += fare.Price
+	label.ticket, label.ticketStart, label.ticketTransfers = fare, departure, 0
+}
+
+// mcOnboard is a label riding a trip run, boarded at board
+type mcOnboard struct {
+	previous  *mcLabel
+	board     *StopTime
+	departure uint
+	zones     []string // Of the stops passed since board, board included
+}
+
+func (ride *mcOnboard) pass(zone string) {
+	for _, z := range ride.zones {
+		if z == zone {
+			return
+		}
+	}
+	ride.zones = append(ride.zones, zone)
+}
+
+type mcBag []*mcLabel
+
+// insert adds label to the bag if no other label dominates it, removing the ones it dominates
+func (bag mcBag) insert(label *mcLabel) (mcBag, bool) {
+	for _, other := range bag {
+		if other.dominates(label) {
+			return bag, false
+		}
+	}
+	kept := bag[:0]
+	for _, other := range bag {
+		if !label.dominates(other) {
+			kept = append(kept, other)
+		}
+	}
+	return append(kept, label), true
+}
+
+// Run computes the journeys with a one minute time limit. See RunContext.
+func (i *MultiCriteriaItinerary) Run() ([]*Journey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	return i.RunContext(ctx)
+}
+
+// RunContext returns the Pareto-optimal journeys, best Score first.
+func (i *MultiCriteriaItinerary) RunContext(ctx context.Context) ([]*Journey, error) {
+	if i.From == nil || i.To == nil {
+		return nil, &ItineraryError{Kind: ItineraryInvalidQuery, Message: "From and To stops are required"}
+	}
+	if i.From == i.To {
+		return nil, &ItineraryError{Kind: ItineraryInvalidQuery, Message: "From and To are the same stop"}
+	}
+	if i.Departure == nil {
+		return nil, &ItineraryError{Kind: ItineraryInvalidQuery, Message: "Departure is required"}
+	}
+	if i.WalkSpeed <= 0 {
+		return nil, &ItineraryError{Kind: ItineraryInvalidQuery, Message: "WalkSpeed must be positive"}
+	}
+
+	i.departureTime = timeOfDayInSeconds(i.Departure)
+	limit := i.departureTime + i.MaxDuration
+	conns := i.feed.connectionsOn(i.Departure)
+
+	bags := make(map[*Stop]mcBag)
+	onboard := make(map[int][]*mcOnboard)
+	footpaths := make(map[*Stop][]footpath)
+	walkFrom := func(label *mcLabel) {
+		paths, ok := footpaths[label.stop]
+		if !ok {
+			paths = i.feed.footpathsFrom(label.stop, i.MaxWalkDistance, i.WalkSpeed, i.Accessibility)
+			footpaths[label.stop] = paths
+		}
+		for _, path := range paths {
+			if label.arrival+path.duration > limit {
+				continue
+			}
+			walk := &mcLabel{
+				stop:      path.to,
+				arrival:   label.arrival + path.duration,
+				boardings: label.boardings,
+				walk:      label.walk + path.distance,
+				fare:      label.fare,
+
+				ticket:          label.ticket,
+				ticketStart:     label.ticketStart,
+				ticketTransfers: label.ticketTransfers,
+
+				previous:  label,
+				departure: label.arrival,
+				distance:  path.distance,
+			}
+			bags[path.to], _ = bags[path.to].insert(walk)
+		}
+	}
+
+	origin := &mcLabel{stop: i.From, arrival: i.departureTime}
+	bags[i.From] = mcBag{origin}
+	walkFrom(origin)
+
+	for index := conns.firstAfter(i.departureTime); index < len(conns); index++ {
+		c := conns[index]
+		if c.departure > limit {
+			break
+		}
+		if index%1000 == 0 {
+			select {
+			case <-ctx.Done():
+				return nil, contextError(ctx, "multi-criteria itinerary interrupted")
+			default:
+			}
+		}
+
+		// Board the run with every label waiting at the stop
+		if c.from.PickupType != PickupUnavailable && i.Accessibility.AllowsBoarding(c.from) {
+			for _, label := range bags[c.from.Stop] {
+				ready := label.arrival
+				if label.trip != nil {
+					ready += i.MinTransferDuration
+				}
+				if ready > c.departure || label.boardings > i.MaxTransfers {
+					continue
+				}
+				onboard[c.run] = append(onboard[c.run], &mcOnboard{label, c.from, c.departure, []string{c.from.Stop.ZoneId}})
+			}
+		}
+		for _, ride := range onboard[c.run] {
+			ride.pass(c.to.Stop.ZoneId)
+		}
+
+		// Alight at the next stop
+		if len(onboard[c.run]) == 0 || c.arrival > limit || c.to.DropOffType == DropOffUnavailable || !i.Accessibility.AllowsStop(c.to.Stop) {
+			continue
+		}
+		for _, ride := range onboard[c.run] {
+			label := &mcLabel{
+				stop:      c.to.Stop,
+				arrival:   c.arrival,
+				boardings: ride.previous.boardings + 1,
+				walk:      ride.previous.walk,
+				fare:      ride.previous.fare,
+				previous:  ride.previous,
+				trip:      c.trip,
+				departure: ride.departure,
+			}
+			label.pay(i.feed.FareForRide(c.trip.Route, ride.board.Stop.ZoneId, c.to.Stop.ZoneId, ride.zones), ride.departure)
+			var inserted bool
+			bags[c.to.Stop], inserted = bags[c.to.Stop].insert(label)
+			if inserted {
+				walkFrom(label)
+			}
+		}
+	}
+
+	journeys := make([]*Journey, 0, len(bags[i.To]))
+	for _, label := range bags[i.To] {
+		journeys = append(journeys, i.journey(label))
+	}
+	if len(journeys) == 0 {
+		return nil, &ItineraryError{Kind: ItineraryNoRouteFound, Message: "destination not reached within MaxDuration"}
+	}
+	sort.Slice(journeys, func(a, b int) bool { return journeys[a].Score < journeys[b].Score })
+	return journeys, nil
+}
+
+// journey retraces label's legs and scores them
+func (i *MultiCriteriaItinerary) journey(label *mcLabel) *Journey {
+	j := &Journey{Arrival: label.arrival, WalkDistance: label.walk, Fare: label.fare}
+	if label.boardings > 0 {
+		j.Transfers = label.boardings - 1
+	}
+	for current := label; current.previous != nil; current = current.previous {
+		leg := &JourneyLeg{
+			Trip:      current.trip,
+			From:      current.previous.stop,
+			To:        current.stop,
+			Departure: current.departure,
+			Arrival:   current.arrival,
+			Distance:  current.distance,
+			Fare:      current.legFare,
+			Price:     current.price,
+		}
+		j.Legs = append([]*JourneyLeg{leg}, j.Legs...)
+	}
+	j.Departure = i.departureTime
+	if len(j.Legs) > 0 {
+		j.Departure = j.Legs[0].Departure
+	}
+	j.Score = i.Weights.Time*float64(j.Arrival-i.departureTime)/60 +
+		i.Weights.Transfer*float64(j.Transfers) +
+		i.Weights.Walk*j.WalkDistance/1000 +
+		i.Weights.Fare*j.Fare
+	return j
+}
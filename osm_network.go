@@ -0,0 +1,269 @@
+package gtfs
+
+import (
+	"container/heap"
+	"encoding/xml"
+	"github.com/nicolaspaton/gogtfs/geo"
+	"io"
+	"math"
+	"os"
+	"strconv"
+)
+
+// Network kinds, a way can belong to both (e.g. street running tram tracks)
+const (
+	NetworkRoad = 1 << iota // 1 - ways usable by buses (OSM highway=*, except footways, paths, steps...)
+	NetworkRail             // 2 - rail tracks (OSM railway=rail, tram, subway, light_rail...)
+)
+
+// networkCellSize is the side of the grid cells used to find the node nearest to a coordinate, in degrees
+const networkCellSize = 0.005
+
+var roadHighways = map[string]bool{
+	"motorway": true, "motorway_link": true, "trunk": true, "trunk_link": true, "primary": true, "primary_link": true,
+	"secondary": true, "secondary_link": true, "tertiary": true, "tertiary_link": true, "unclassified": true,
+	"residential": true, "living_street": true, "service": true, "busway": true, "bus_guideway": true, "road": true,
+}
+
+var railRailways = map[string]bool{
+	"rail": true, "light_rail": true, "subway": true, "tram": true, "narrow_gauge": true, "funicular": true, "monorail": true,
+}
+
+type networkEdge struct {
+	to     *networkNode
+	length float64 // In meters
+	kinds  int
+}
+
+type networkNode struct {
+	id    int64
+	lat   float64
+	lon   float64
+	edges []networkEdge
+}
+
+// Network is a road and rail graph read from an OpenStreetMap extract, used to route shapes between stops
+type Network struct {
+	nodes map[int64]*networkNode
+	cells map[[2]int][]*networkNode
+}
+
+// LoadOSMNetwork reads the road and rail ways of an OpenStreetMap XML extract (.osm)
+func LoadOSMNetwork(path string) (*Network, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadOSMNetwork(file)
+}
+
+// ReadOSMNetwork reads the road and rail ways of an OpenStreetMap XML document
+func ReadOSMNetwork(reader io.Reader) (*Network, error) {
+	type osmWay struct {
+		refs  []int64
+		kinds int
+		// 1 forward only, -1 backward only, 0 both ways
+		oneway int
+	}
+
+	coordinates := make(map[int64][2]float64)
+	ways := make([]*osmWay, 0)
+	var way *osmWay
+	var tags map[string]string
+
+	decoder := xml.NewDecoder(reader)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			attributes := make(map[string]string, len(element.Attr))
+			for _, attribute := range element.Attr {
+				attributes[attribute.Name.Local] = attribute.Value
+			}
+			switch element.Name.Local {
+			case "node":
+				id, _ := strconv.ParseInt(attributes["id"], 10, 64)
+				lat, _ := strconv.ParseFloat(attributes["lat"], 64)
+				lon, _ := strconv.ParseFloat(attributes["lon"], 64)
+				coordinates[id] = [2]float64{lat, lon}
+				break
+			case "way":
+				way = &osmWay{}
+				tags = make(map[string]string)
+				break
+			case "nd":
+				if way != nil {
+					ref, _ := strconv.ParseInt(attributes["ref"], 10, 64)
+					way.refs = append(way.refs, ref)
+				}
+				break
+			case "tag":
+				if tags != nil {
+					tags[attributes["k"]] = attributes["v"]
+				}
+				break
+			}
+		case xml.EndElement:
+			if element.Name.Local != "way" || way == nil {
+				continue
+			}
+			if roadHighways[tags["highway"]] {
+				way.kinds |= NetworkRoad
+				switch tags["oneway"] {
+				case "yes", "true", "1":
+					way.oneway = 1
+				case "-1", "reverse":
+					way.oneway = -1
+				}
+				if tags["junction"] == "roundabout" && way.oneway == 0 {
+					way.oneway = 1
+				}
+			}
+			if railRailways[tags["railway"]] {
+				way.kinds |= NetworkRail
+				if way.kinds&NetworkRoad == 0 {
+					way.oneway = 0
+				}
+			}
+			if way.kinds != 0 && len(way.refs) > 1 {
+				ways = append(ways, way)
+			}
+			way, tags = nil, nil
+		}
+	}
+
+	n := &Network{nodes: make(map[int64]*networkNode), cells: make(map[[2]int][]*networkNode)}
+	node := func(id int64) *networkNode {
+		if existing := n.nodes[id]; existing != nil {
+			return existing
+		}
+		coordinate, ok := coordinates[id]
+		if !ok {
+			return nil
+		}
+		created := &networkNode{id: id, lat: coordinate[0], lon: coordinate[1]}
+		n.nodes[id] = created
+		cell := networkCell(created.lat, created.lon)
+		n.cells[cell] = append(n.cells[cell], created)
+		return created
+	}
+	for _, way := range ways {
+		for i := 1; i < len(way.refs); i++ {
+			from, to := node(way.refs[i-1]), node(way.refs[i])
+			if from == nil || to == nil {
+				continue
+			}
+			length := geo.Haversine(from.lat, from.lon, to.lat, to.lon)
+			if way.oneway >= 0 {
+				from.edges = append(from.edges, networkEdge{to, length, way.kinds})
+			}
+			if way.oneway <= 0 {
+				to.edges = append(to.edges, networkEdge{from, length, way.kinds})
+			}
+		}
+	}
+	return n, nil
+}
+
+func networkCell(lat, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat / networkCellSize)), int(math.Floor(lon / networkCellSize))}
+}
+
+// NodesCount returns the number of nodes of the graph
+func (n *Network) NodesCount() int {
+	return len(n.nodes)
+}
+
+// nearest returns the node with an edge of kinds closest to lat, lon within maxDistance meters, or nil
+func (n *Network) nearest(lat, lon, maxDistance float64, kinds int) *networkNode {
+	var best *networkNode
+	bestDistance := maxDistance
+	minLat, minLon, maxLat, maxLon := geo.BBoxFromRadius(lat, lon, maxDistance)
+	min, max := networkCell(minLat, minLon), networkCell(maxLat, maxLon)
+	for i := min[0]; i <= max[0]; i++ {
+		for j := min[1]; j <= max[1]; j++ {
+			for _, node := range n.cells[[2]int{i, j}] {
+				if !node.hasEdge(kinds) {
+					continue
+				}
+				if d := geo.Haversine(lat, lon, node.lat, node.lon); d <= bestDistance {
+					best, bestDistance = node, d
+				}
+			}
+		}
+	}
+	return best
+}
+
+func (node *networkNode) hasEdge(kinds int) bool {
+	for _, edge := range node.edges {
+		if edge.kinds&kinds != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type networkQueueItem struct {
+	node     *networkNode
+	priority float64
+}
+
+type networkQueue []networkQueueItem
+
+func (q networkQueue) Len() int            { return len(q) }
+func (q networkQueue) Less(i, j int) bool  { return q[i].priority < q[j].priority }
+func (q networkQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *networkQueue) Push(x interface{}) { *q = append(*q, x.(networkQueueItem)) }
+func (q *networkQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// route returns the shortest path (A*) from one node to another over edges of kinds, without
+// exploring paths longer than maxLength meters. It returns nil if there is none.
+func (n *Network) route(from, to *networkNode, kinds int, maxLength float64) []*networkNode {
+	lengths := map[*networkNode]float64{from: 0}
+	previous := make(map[*networkNode]*networkNode)
+	queue := &networkQueue{{from, geo.Haversine(from.lat, from.lon, to.lat, to.lon)}}
+	for queue.Len() > 0 {
+		item := heap.Pop(queue).(networkQueueItem)
+		if item.node == to {
+			path := []*networkNode{to}
+			for node := to; node != from; {
+				node = previous[node]
+				path = append(path, node)
+			}
+			for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+				path[i], path[j] = path[j], path[i]
+			}
+			return path
+		}
+		if item.priority > maxLength {
+			return nil
+		}
+		current := lengths[item.node]
+		for _, edge := range item.node.edges {
+			if edge.kinds&kinds == 0 {
+				continue
+			}
+			length := current + edge.length
+			if known, ok := lengths[edge.to]; ok && known <= length {
+				continue
+			}
+			lengths[edge.to] = length
+			previous[edge.to] = item.node
+			heap.Push(queue, networkQueueItem{edge.to, length + geo.Haversine(edge.to.lat, edge.to.lon, to.lat, to.lon)})
+		}
+	}
+	return nil
+}
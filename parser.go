@@ -33,6 +33,14 @@ func fieldsSetter(model settableThroughField, fieldKeys, fieldValues []string) {
 }
 
 func (p *Parser) parse(r io.Reader, recordHandler func(k, v []string)) error {
+	return p.parseLines(r, func(k, v []string, lineNumber int) {
+		recordHandler(k, v)
+	}, nil)
+}
+
+// parseLines is parse with the line number of each record (the header being line 1). Lines that
+// can't be parsed are passed to errorHandler, or logged if it is nil.
+func (p *Parser) parseLines(r io.Reader, recordHandler func(k, v []string, lineNumber int), errorHandler func(perr *ParseError)) error {
 
 	lineNumber := 1
 
@@ -69,7 +77,11 @@ func (p *Parser) parse(r io.Reader, recordHandler func(k, v []string)) error {
 		if perr != nil {
 			perr.FileName = string(*p)
 			perr.LineNumber = lineNumber
-			log.Println(perr)
+			if errorHandler != nil {
+				errorHandler(perr)
+			} else {
+				log.Println(perr)
+			}
 			// return perr
 		} else {
 			lengthdiff := len(fieldKeys) - len(fieldValues)
@@ -79,7 +91,7 @@ func (p *Parser) parse(r io.Reader, recordHandler func(k, v []string)) error {
 					lengthdiff = lengthdiff - 1
 				}
 			}
-			recordHandler(fieldKeys, fieldValues)
+			recordHandler(fieldKeys, fieldValues, lineNumber)
 		}
 
 		line, isPrefix, err = reader.ReadLine()
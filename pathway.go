@@ -0,0 +1,106 @@
+package gtfs
+
+import (
+	"strconv"
+)
+
+// Pathway.PathwayMode possible values:
+const (
+	_                     = iota // Ignore 0
+	PathwayWalkway               // 1 - Walkway.
+	PathwayStairs                // 2 - Stairs.
+	PathwayMovingSidewalk        // 3 - Moving sidewalk/travelator.
+	PathwayEscalator             // 4 - Escalator.
+	PathwayElevator              // 5 - Elevator.
+	PathwayFareGate              // 6 - Fare gate (or payment gate). A pathway that crosses into an area of the station where a proof of payment is required.
+	PathwayExitGate              // 7 - Exit gate. A pathway exiting a paid area into an unpaid area where a proof of payment is not required.
+)
+
+// pathways.txt
+// This file is optional. The pathways file links together locations within stations (platforms, entrances, generic nodes
+// and boarding areas, see Stop.LocationType). Pathways are directed edges of the graph describing the inside of a station.
+type Pathway struct {
+
+	// pathway_id - Required. The pathway_id field contains an ID that uniquely identifies a pathway. The pathway_id is dataset unique.
+	Id string
+
+	// from_stop_id - Required. The from_stop_id field contains the stop ID of the location at which the pathway begins.
+	// Stop IDs are referenced from the stops.txt file.
+	FromStopId string
+
+	// to_stop_id - Required. The to_stop_id field contains the stop ID of the location at which the pathway ends.
+	// Stop IDs are referenced from the stops.txt file.
+	ToStopId string
+
+	// pathway_mode - Required. The pathway_mode field describes the type of pathway between the specified (from_stop_id, to_stop_id) pair.
+	// Valid values for this field are:
+	// 		1 - Walkway.
+	// 		2 - Stairs.
+	// 		3 - Moving sidewalk/travelator.
+	// 		4 - Escalator.
+	// 		5 - Elevator.
+	// 		6 - Fare gate.
+	// 		7 - Exit gate.
+	// See Pathway constants
+	PathwayMode byte
+
+	// is_bidirectional - Required. The is_bidirectional field indicates the direction that the pathway can be taken:
+	// 		0 - Unidirectional pathway, it can only be used from from_stop_id to to_stop_id.
+	// 		1 - Bidirectional pathway, it can be used in the two directions.
+	IsBidirectional bool
+
+	// length - Optional. The length field contains the horizontal length in meters of the pathway from the origin
+	// location (defined in from_stop_id) to the destination location (defined in to_stop_id).
+	Length float64
+
+	// traversal_time - Optional. The traversal_time field contains the average time in seconds needed to walk through
+	// the pathway from the origin location to the destination location.
+	TraversalTime int
+
+	// stair_count - Optional. The stair_count field contains the number of stairs of the pathway. A positive value
+	// implies that the rider walks up from from_stop_id to to_stop_id, a negative value that the rider walks down.
+	StairCount int
+
+	feed *Feed
+}
+
+// HasSteps returns true if the pathway can't be used by a rider in a wheelchair (stairs or escalator)
+func (p *Pathway) HasSteps() bool {
+	return p.PathwayMode == PathwayStairs || p.PathwayMode == PathwayEscalator || p.StairCount != 0
+}
+
+func (p *Pathway) setField(fieldName, val string) {
+	// log.Println("setField", fieldName, value)
+	switch fieldName {
+	case "pathway_id":
+		p.Id = val
+		break
+	case "from_stop_id":
+		p.FromStopId = val
+		break
+	case "to_stop_id":
+		p.ToStopId = val
+		break
+	case "pathway_mode":
+		v, _ := strconv.Atoi(val) // Should panic on error !
+		if v >= PathwayWalkway && v <= PathwayExitGate {
+			p.PathwayMode = byte(v)
+		}
+		break
+	case "is_bidirectional":
+		p.IsBidirectional = val == "1"
+		break
+	case "length":
+		v, _ := strconv.ParseFloat(val, 64) // Should panic on error !
+		p.Length = v
+		break
+	case "traversal_time":
+		v, _ := strconv.Atoi(val) // Should panic on error !
+		p.TraversalTime = v
+		break
+	case "stair_count":
+		v, _ := strconv.Atoi(val) // Should panic on error !
+		p.StairCount = v
+		break
+	}
+}
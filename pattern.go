@@ -0,0 +1,105 @@
+package gtfs
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Pattern groups the trips of a route serving the same sequence of stops in the same direction
+type Pattern struct {
+	// Route id followed by the pattern's rank in the route, e.g. "R1:0"
+	Id string
+
+	Route     *Route
+	Direction byte
+	Stops     []*Stop
+
+	// Sorted by id
+	Trips []*Trip
+}
+
+// ShapeId returns the shape of the first of the pattern's trips having one, or "" if none has
+func (p *Pattern) ShapeId() string {
+	for _, trip := range p.Trips {
+		if trip.ShapeId != "" && trip.feed.Shapes[trip.ShapeId] != nil {
+			return trip.ShapeId
+		}
+	}
+	return ""
+}
+
+// servedStopTimes returns the stop times of trip at a known stop, the ones its patternKey is made of
+func servedStopTimes(trip *Trip) []*StopTime {
+	stopTimes := make([]*StopTime, 0, len(trip.StopTimes))
+	for _, st := range trip.StopTimes {
+		if st != nil && st.Stop != nil {
+			stopTimes = append(stopTimes, st)
+		}
+	}
+	return stopTimes
+}
+
+// patternKey identifies the stop sequence of a trip
+func patternKey(trip *Trip) string {
+	ids := make([]string, 0, len(trip.StopTimes)+2)
+	if trip.Route != nil {
+		ids = append(ids, trip.Route.Id)
+	} else {
+		ids = append(ids, "")
+	}
+	ids = append(ids, strconv.Itoa(int(trip.Direction)))
+	for _, st := range servedStopTimes(trip) {
+		ids = append(ids, st.Stop.Id)
+	}
+	return strings.Join(ids, "\x00")
+}
+
+// Patterns returns the trip patterns of the feed, ordered by route id then by number of trips
+func (f *Feed) Patterns() []*Pattern {
+	trips := make([]*Trip, 0, len(f.Trips))
+	for _, trip := range f.Trips {
+		trips = append(trips, trip)
+	}
+	sort.Slice(trips, func(i, j int) bool { return trips[i].Id < trips[j].Id })
+
+	byKey := make(map[string]*Pattern)
+	patterns := make([]*Pattern, 0)
+	for _, trip := range trips {
+		key := patternKey(trip)
+		pattern := byKey[key]
+		if pattern == nil {
+			pattern = &Pattern{Route: trip.Route, Direction: trip.Direction, Stops: make([]*Stop, 0, len(trip.StopTimes))}
+			for _, st := range trip.StopTimes {
+				if st != nil && st.Stop != nil {
+					pattern.Stops = append(pattern.Stops, st.Stop)
+				}
+			}
+			byKey[key] = pattern
+			patterns = append(patterns, pattern)
+		}
+		pattern.Trips = append(pattern.Trips, trip)
+	}
+
+	routeId := func(p *Pattern) string {
+		if p.Route == nil {
+			return ""
+		}
+		return p.Route.Id
+	}
+	sort.SliceStable(patterns, func(i, j int) bool {
+		if routeId(patterns[i]) != routeId(patterns[j]) {
+			return routeId(patterns[i]) < routeId(patterns[j])
+		}
+		return len(patterns[i].Trips) > len(patterns[j].Trips)
+	})
+	rank := 0
+	for i, pattern := range patterns {
+		if i > 0 && routeId(patterns[i-1]) != routeId(pattern) {
+			rank = 0
+		}
+		pattern.Id = routeId(pattern) + ":" + strconv.Itoa(rank)
+		rank += 1
+	}
+	return patterns
+}
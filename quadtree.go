@@ -9,12 +9,35 @@
 package gtfs
 
 import (
+	"container/heap"
+	"github.com/nicolaspaton/gogtfs/geo"
 	"math"
 )
 
 // node_capacity is the maximum number of points allowed in a quadtree node
 var node_capacity int = 4
 
+// minHalfDim is the size (in degrees) under which a quadtree node is not subdivided anymore
+const minHalfDim = 1e-7
+
+// Coordinate is a WGS 84 position
+type Coordinate struct {
+	Lat float64
+	Lon float64
+}
+
+// StopFilter selects stops in QuadTree and StopCollection queries
+type StopFilter func(*Stop) bool
+
+func acceptsStop(stop *Stop, filters []StopFilter) bool {
+	for _, filter := range filters {
+		if filter != nil && !filter(stop) {
+			return false
+		}
+	}
+	return true
+}
+
 // AABB represents an Axis-Aligned bounding box structure with center and half
 // dimension
 type AABB struct {
@@ -78,10 +101,11 @@ type QuadTree struct {
 // New creates a new quadtree node that is bounded by boundary and contains
 // node_capacity points.
 func CreateQuadtree(minLat, maxLat, minLon, maxLon float64) *QuadTree {
-	halfdimX := (maxLon - minLon) / 2
-	halfdimY := (maxLat - minLat) / 2
-	centerX := halfdimX + minLon
-	centerY := halfdimY + minLat
+	// A small margin keeps the extreme points inside the boundary despite rounding errors
+	halfdimX := (maxLon-minLon)/2 + minHalfDim
+	halfdimY := (maxLat-minLat)/2 + minHalfDim
+	centerX := (maxLon + minLon) / 2
+	centerY := (maxLat + minLat) / 2
 	boundary := *NewAABB(centerX, centerY, halfdimX, halfdimY)
 	return NewQuadtree(boundary)
 }
@@ -101,7 +125,8 @@ func (qt *QuadTree) Insert(p *Stop) bool {
 	}
 
 	// If there is space in this quad tree, add the object here.
-	if len(qt.points) < cap(qt.points) {
+	// Nodes too small to be divided (stops sharing the same coordinates) accept any number of points.
+	if qt.northWest == nil && (len(qt.points) < cap(qt.points) || (qt.boundary.halfDimX < minHalfDim && qt.boundary.halfDimY < minHalfDim)) {
 		qt.points = append(qt.points, p)
 		return true
 	}
@@ -125,9 +150,10 @@ func (qt *QuadTree) Insert(p *Stop) bool {
 		return true
 	}
 
-	// Otherwise, the point cannot be inserted for some unknown reason.
-	// (which should never happen)
-	return false
+	// Otherwise the point lies on the edge of the children boundaries and
+	// rounding errors kept them from accepting it, keep it here.
+	qt.points = append(qt.points, p)
+	return true
 }
 
 func (qt *QuadTree) subDivide() {
@@ -156,6 +182,7 @@ func (qt *QuadTree) subDivide() {
 		qt.boundary.halfDimX / 2, qt.boundary.halfDimY / 2}
 	qt.southEast = NewQuadtree(box)
 
+	var kept []*Stop
 	for _, v := range qt.points {
 		if qt.northWest.Insert(v) {
 			continue
@@ -169,18 +196,134 @@ func (qt *QuadTree) subDivide() {
 		if qt.southEast.Insert(v) {
 			continue
 		}
+		kept = append(kept, v) // See Insert
+	}
+	qt.points = kept
+}
+
+// SearchByProximity returns the stops within radius meters of lat, lng
+func (qt *QuadTree) SearchByProximity(lat, lng, radius float64, filters ...StopFilter) (results []*Stop) {
+	for _, stop := range qt.SearchArea(boundingAABB([]Coordinate{{lat, lng}}, radius)) {
+		if geo.Haversine(lat, lng, stop.Lat, stop.Lon) <= radius && acceptsStop(stop, filters) {
+			results = append(results, stop)
+		}
+	}
+	return
+}
+
+// minDistance returns the distance in meters from lat, lng to the closest point of the AABB
+func (aabb *AABB) minDistance(lat, lng float64) float64 {
+	closestLon := math.Max(aabb.centerX-aabb.halfDimX, math.Min(lng, aabb.centerX+aabb.halfDimX))
+	closestLat := math.Max(aabb.centerY-aabb.halfDimY, math.Min(lat, aabb.centerY+aabb.halfDimY))
+	return geo.Haversine(lat, lng, closestLat, closestLon)
+}
+
+// searchItem is either a quadtree node or a stop, queued by distance
+type searchItem struct {
+	node     *QuadTree
+	stop     *Stop
+	distance float64
+}
+
+type searchQueue []*searchItem
+
+func (q searchQueue) Len() int            { return len(q) }
+func (q searchQueue) Less(i, j int) bool  { return q[i].distance < q[j].distance }
+func (q searchQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *searchQueue) Push(x interface{}) { *q = append(*q, x.(*searchItem)) }
+func (q *searchQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// SearchNearest returns the k stops closest to lat, lng, closest first, with their distances.
+// Nodes are visited best-first: a node is only opened when it may contain a closer stop than the
+// ones already found.
+func (qt *QuadTree) SearchNearest(lat, lng float64, k int, filters ...StopFilter) StopDistanceResults {
+	if k <= 0 {
+		return StopDistanceResults{}
+	}
+	results := make(StopDistanceResults, 0, k)
+	queue := &searchQueue{{node: qt, distance: qt.boundary.minDistance(lat, lng)}}
+	for queue.Len() > 0 && len(results) < k {
+		item := heap.Pop(queue).(*searchItem)
+		if item.stop != nil {
+			results = append(results, &StopDistanceResult{Stop: item.stop, Distance: item.distance})
+			continue
+		}
+		for _, stop := range item.node.points {
+			if acceptsStop(stop, filters) {
+				heap.Push(queue, &searchItem{stop: stop, distance: geo.Haversine(lat, lng, stop.Lat, stop.Lon)})
+			}
+		}
+		if item.node.northWest != nil {
+			for _, child := range []*QuadTree{item.node.northWest, item.node.northEast, item.node.southWest, item.node.southEast} {
+				heap.Push(queue, &searchItem{node: child, distance: child.boundary.minDistance(lat, lng)})
+			}
+		}
 	}
-	qt.points = nil
+	return results
 }
 
-func (qt *QuadTree) SearchByProximity(lat, lng, radius float64) (results []*Stop) {
-	earth_radius := 6371000.0 // in meter
-	x1 := lng - (180.0 / math.Pi * (radius / earth_radius / math.Cos(lat*math.Pi/180.0)))
-	x2 := lng + (180.0 / math.Pi * (radius / earth_radius / math.Cos(lat*math.Pi/180.0)))
-	y1 := lat + (radius / earth_radius * 180.0 / math.Pi)
-	y2 := lat - (radius / earth_radius * 180.0 / math.Pi)
-	// FIXME: this is bounding box search, not radial
-	return qt.SearchArea(NewAABB(lng, lat, math.Abs(x1-x2)/2.0, math.Abs(y1-y2)/2.0))
+// SearchPolygon returns the stops inside polygon (a ring, closed or not)
+func (qt *QuadTree) SearchPolygon(polygon []Coordinate, filters ...StopFilter) (results []*Stop) {
+	if len(polygon) < 3 {
+		return
+	}
+	for _, stop := range qt.SearchArea(boundingAABB(polygon, 0)) {
+		if pointInPolygon(stop.Lat, stop.Lon, polygon) && acceptsStop(stop, filters) {
+			results = append(results, stop)
+		}
+	}
+	return
+}
+
+// SearchLineBuffer returns the stops within radius meters of the polyline line
+func (qt *QuadTree) SearchLineBuffer(line []Coordinate, radius float64, filters ...StopFilter) (results []*Stop) {
+	if len(line) == 0 {
+		return
+	}
+	if len(line) == 1 {
+		return qt.SearchByProximity(line[0].Lat, line[0].Lon, radius, filters...)
+	}
+	for _, stop := range qt.SearchArea(boundingAABB(line, radius)) {
+		if !acceptsStop(stop, filters) {
+			continue
+		}
+		for i := 1; i < len(line); i++ {
+			if geo.PointToSegmentDistance(stop.Lat, stop.Lon, line[i-1].Lat, line[i-1].Lon, line[i].Lat, line[i].Lon) <= radius {
+				results = append(results, stop)
+				break
+			}
+		}
+	}
+	return
+}
+
+// boundingAABB returns the box containing coordinates, extended by margin meters
+func boundingAABB(coordinates []Coordinate, margin float64) *AABB {
+	minLat, maxLat := math.Inf(1), math.Inf(-1)
+	minLon, maxLon := math.Inf(1), math.Inf(-1)
+	for _, c := range coordinates {
+		minLat, maxLat = math.Min(minLat, c.Lat), math.Max(maxLat, c.Lat)
+		minLon, maxLon = math.Min(minLon, c.Lon), math.Max(maxLon, c.Lon)
+	}
+	minLat, minLon, maxLat, maxLon = geo.ExpandBBox(minLat, minLon, maxLat, maxLon, margin)
+	return NewAABB((minLon+maxLon)/2, (minLat+maxLat)/2, (maxLon-minLon)/2, (maxLat-minLat)/2)
+}
+
+// pointInPolygon tests lat, lon against polygon with the ray casting (even-odd) rule
+func pointInPolygon(lat, lon float64, polygon []Coordinate) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > lat) != (b.Lat > lat) && lon < (b.Lon-a.Lon)*(lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
 }
 
 func (qt *QuadTree) SearchArea(a *AABB) []*Stop {
@@ -0,0 +1,305 @@
+package gtfs
+
+import (
+	"context"
+	"github.com/nicolaspaton/gogtfs/geo"
+	"math"
+	"sort"
+	"time"
+)
+
+// connection is an elementary hop of a vehicle between two consecutive stops of a trip.
+// Trips with frequencies are expanded, run identifies each vehicle run.
+type connection struct {
+	run       int
+	trip      *Trip
+	from      *StopTime
+	to        *StopTime
+	departure uint // time of day in seconds
+	arrival   uint // in seconds
+}
+
+type connections []*connection
+
+func (c connections) Len() int           { return len(c) }
+func (c connections) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c connections) Less(i, j int) bool { return c[i].departure < c[j].departure }
+
+// connectionsOn returns all the connections of the trips running on date, sorted by departure time.
+func (feed *Feed) connectionsOn(date *time.Time) connections {
+	results := make(connections, 0, feed.StopTimesCount)
+	run := 0
+	for _, trip := range feed.TripsForDay(date) {
+		if len(trip.StopTimes) < 2 {
+			continue
+		}
+		offsets := []int{0}
+		if len(trip.Frequencies) > 0 {
+			offsets = offsets[:0]
+			first := int(trip.StopTimes[0].DepartureTime)
+			for _, freq := range trip.Frequencies {
+				if freq.HeadwaySecs == 0 {
+					continue
+				}
+				for start := freq.StartTime; start < freq.EndTime; start += freq.HeadwaySecs {
+					offsets = append(offsets, int(start)-first)
+				}
+			}
+		}
+		for _, offset := range offsets {
+			for i := 1; i < len(trip.StopTimes); i++ {
+				from, to := trip.StopTimes[i-1], trip.StopTimes[i]
+				if from.Stop == nil || to.Stop == nil {
+					continue
+				}
+				results = append(results, &connection{
+					run:       run,
+					trip:      trip,
+					from:      from,
+					to:        to,
+					departure: uint(int(from.DepartureTime) + offset),
+					arrival:   uint(int(to.ArrivalTime) + offset),
+				})
+			}
+			run += 1
+		}
+	}
+	sort.Stable(results)
+	return results
+}
+
+// connectionsOnTwoDays returns the connections of date and of the following day, sorted by departure
+// time. The times of the following day are counted from the midnight of date (shifted by 24 hours).
+func (feed *Feed) connectionsOnTwoDays(date *time.Time) connections {
+	next := date.AddDate(0, 0, 1)
+	results := feed.connectionsOn(date)
+	runs := 0
+	for _, c := range results {
+		if c.run >= runs {
+			runs = c.run + 1
+		}
+	}
+	for _, c := range feed.connectionsOn(&next) {
+		shifted := *c
+		shifted.run += runs
+		shifted.departure += 24 * 60 * 60
+		shifted.arrival += 24 * 60 * 60
+		results = append(results, &shifted)
+	}
+	sort.Stable(results)
+	return results
+}
+
+// firstAfter returns the index of the first connection departing at or after t
+func (c connections) firstAfter(t uint) int {
+	return sort.Search(len(c), func(i int) bool { return c[i].departure >= t })
+}
+
+type footpath struct {
+	to       *Stop
+	distance float64 // In meters
+	duration uint    // In seconds
+}
+
+// footpathsFrom returns the stops within maxDistance of stop, walking at speed
+func (feed *Feed) footpathsFrom(stop *Stop, maxDistance, speed float64, profile *AccessibilityProfile) []footpath {
+	paths := make([]footpath, 0)
+	for _, other := range feed.StopCollection.StopsByProximity(stop.Lat, stop.Lon, maxDistance) {
+		if other == stop {
+			continue
+		}
+		d := geo.Haversine(stop.Lat, stop.Lon, other.Lat, other.Lon)
+		if d <= maxDistance && profile.AllowsStop(other) && profile.AllowsTransfer(stop, other) {
+			paths = append(paths, footpath{other, d, uint(d / speed)})
+		}
+	}
+	return paths
+}
+
+// Reachability computes the earliest arrival at every stop of the feed from an origin
+// coordinate and a departure time (Connection Scan Algorithm), and derives isochrones from it.
+type Reachability struct {
+	Lat float64
+	Lon float64
+
+	Departure *time.Time
+
+	MaxDuration     uint    // In seconds. Default: 60*60 (1 hour)
+	WalkSpeed       float64 // In meters per second. Default: 1.3
+	MaxWalkDistance float64 // In meters, to access the first stop and between two stops. Default: 500
+
+	Accessibility *AccessibilityProfile // Default: nil (no restriction)
+
+	// Arrivals is filled by Run: earliest arrival at each reached stop, in seconds since midnight
+	Arrivals map[*Stop]uint
+
+	feed          *Feed
+	connections   connections
+	footpaths     map[*Stop][]footpath
+	departureTime uint
+
+	// Inputs the caches were built with, they are rebuilt when these change between runs
+	connectionsDay  string // YYYYMMDD
+	connectionsNext string // YYYYMMDD of the following day when connections include it, see connectionsOnTwoDays
+	footpathsKey    footpathsKey
+}
+
+type footpathsKey struct {
+	maxDistance float64
+	speed       float64
+	profile     *AccessibilityProfile
+}
+
+func NewReachability(f *Feed) (r *Reachability) {
+	r = &Reachability{}
+	r.MaxDuration = 60 * 60
+	r.WalkSpeed = 1.3
+	r.MaxWalkDistance = 500
+	r.feed = f
+	return
+}
+
+// Run computes the arrivals with a one minute time limit. See RunContext.
+func (r *Reachability) Run() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	return r.RunContext(ctx)
+}
+
+func (r *Reachability) RunContext(ctx context.Context) error {
+	if r.Departure == nil {
+		return &ItineraryError{Kind: ItineraryInvalidQuery, Message: "Departure is required"}
+	}
+	if r.WalkSpeed <= 0 {
+		return &ItineraryError{Kind: ItineraryInvalidQuery, Message: "WalkSpeed must be positive"}
+	}
+	r.departureTime = timeOfDayInSeconds(r.Departure)
+	if day := r.Departure.Format("20060102"); r.connections != nil && day == r.connectionsNext {
+		r.departureTime += 24 * 60 * 60 // Counted from the first day, like the connections
+	} else if r.connections == nil || day != r.connectionsDay {
+		r.useConnections(r.feed.connectionsOn(r.Departure), r.Departure, false)
+	}
+	if key := (footpathsKey{r.MaxWalkDistance, r.WalkSpeed, r.Accessibility}); r.footpaths == nil || key != r.footpathsKey {
+		r.footpaths = make(map[*Stop][]footpath)
+		r.footpathsKey = key
+	}
+	limit := r.departureTime + r.MaxDuration
+	r.Arrivals = make(map[*Stop]uint)
+
+	// Walk to the stops around the origin
+	for _, stop := range r.feed.StopCollection.StopsByProximity(r.Lat, r.Lon, r.MaxWalkDistance) {
+		d := geo.Haversine(r.Lat, r.Lon, stop.Lat, stop.Lon)
+		if d > r.MaxWalkDistance || !r.Accessibility.AllowsStop(stop) {
+			continue
+		}
+		if arrival := r.departureTime + uint(d/r.WalkSpeed); arrival <= limit {
+			r.Arrivals[stop] = arrival
+		}
+	}
+
+	boarded := make(map[int]bool)
+	for index := r.connections.firstAfter(r.departureTime); index < len(r.connections); index++ {
+		c := r.connections[index]
+		if c.departure > limit {
+			break
+		}
+		if index%1000 == 0 {
+			select {
+			case <-ctx.Done():
+				return contextError(ctx, "reachability interrupted")
+			default:
+			}
+		}
+
+		if !boarded[c.run] {
+			arrival, reached := r.Arrivals[c.from.Stop]
+			if !reached || arrival > c.departure || c.from.PickupType == PickupUnavailable || !r.Accessibility.AllowsBoarding(c.from) {
+				continue
+			}
+			boarded[c.run] = true
+		}
+
+		if c.arrival > limit || c.to.DropOffType == DropOffUnavailable || !r.Accessibility.AllowsStop(c.to.Stop) {
+			continue
+		}
+		if r.improve(c.to.Stop, c.arrival) {
+			for _, path := range r.footpathsFrom(c.to.Stop) {
+				if c.arrival+path.duration <= limit {
+					r.improve(path.to, c.arrival+path.duration)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Reachability) improve(stop *Stop, arrival uint) bool {
+	if current, reached := r.Arrivals[stop]; reached && current <= arrival {
+		return false
+	}
+	r.Arrivals[stop] = arrival
+	return true
+}
+
+// useConnections sets the connections of the day of date, and of the following day if nextDay (see
+// connectionsOnTwoDays), built by the caller and possibly shared with other Reachability values
+func (r *Reachability) useConnections(conns connections, date *time.Time, nextDay bool) {
+	r.connections = conns
+	r.connectionsDay, r.connectionsNext = date.Format("20060102"), ""
+	if nextDay {
+		r.connectionsNext = date.AddDate(0, 0, 1).Format("20060102")
+	}
+}
+
+// footpathsFrom returns the stops within walking distance of stop, cached for later runs
+func (r *Reachability) footpathsFrom(stop *Stop) []footpath {
+	if paths, ok := r.footpaths[stop]; ok {
+		return paths
+	}
+	paths := r.feed.footpathsFrom(stop, r.MaxWalkDistance, r.WalkSpeed, r.Accessibility)
+	r.footpaths[stop] = paths
+	return paths
+}
+
+// TravelTime returns the duration in seconds from departure to the arrival at stop.
+func (r *Reachability) TravelTime(stop *Stop) (duration uint, reached bool) {
+	arrival, reached := r.Arrivals[stop]
+	if !reached {
+		return 0, false
+	}
+	return arrival - r.departureTime, true
+}
+
+// Isochrone returns the area reachable within cutoff seconds as a GeoJSON MultiPolygon feature:
+// the origin and every reached stop are buffered with a circle covering the walking distance left at
+// their arrival time, up to MaxWalkDistance. The circles are not merged and can overlap.
+// A cutoff greater than MaxDuration is limited by it.
+func (r *Reachability) Isochrone(cutoff uint) *GeoJSONFeature {
+	if cutoff > r.MaxDuration {
+		cutoff = r.MaxDuration
+	}
+	// Walking distance in seconds, limited like the access and egress walks
+	radius := func(seconds uint) float64 {
+		return math.Min(float64(seconds)*r.WalkSpeed, r.MaxWalkDistance)
+	}
+	polygons := make([][][][2]float64, 0, len(r.Arrivals)+1)
+	polygons = append(polygons, circlePolygon(r.Lat, r.Lon, radius(cutoff), 32))
+	for stop, arrival := range r.Arrivals {
+		if arrival >= r.departureTime+cutoff {
+			continue
+		}
+		remaining := r.departureTime + cutoff - arrival
+		polygons = append(polygons, circlePolygon(stop.Lat, stop.Lon, radius(remaining), 32))
+	}
+	return NewGeoJSONFeature(NewGeoJSONMultiPolygon(polygons), map[string]interface{}{"cutoff": cutoff})
+}
+
+// Isochrones returns a FeatureCollection with one isochrone per cutoff (in seconds).
+// Cutoffs greater than MaxDuration are limited by it.
+func (r *Reachability) Isochrones(cutoffs ...uint) *GeoJSONFeatureCollection {
+	collection := NewGeoJSONFeatureCollection()
+	for _, cutoff := range cutoffs {
+		collection.Add(r.Isochrone(cutoff))
+	}
+	return collection
+}
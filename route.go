@@ -83,6 +83,8 @@ type Route struct {
 	// black and white screen.
 	TextColor string
 
+	agencyId string // agency_id as found in routes.txt, Agency is nil when it is unknown
+
 	feed *Feed
 }
 
@@ -94,6 +96,7 @@ func (r *Route) setField(fieldName, val string) {
 		break
 	case "agency_id":
 		r.Agency = r.feed.Agencies[val]
+		r.agencyId = val
 		break
 	case "route_short_name":
 		r.ShortName = val
@@ -1,6 +1,7 @@
 package gtfs
 
 import (
+	"sort"
 	"strconv"
 )
 
@@ -15,6 +16,11 @@ type Shape struct {
 	Color string
 }
 
+// sortPoints orders the points by shape_pt_sequence (shapes.txt rows can come in any order)
+func (s *Shape) sortPoints() {
+	sort.SliceStable(s.Points, func(i, j int) bool { return s.Points[i].PointSequence < s.Points[j].PointSequence })
+}
+
 // shapes.txt
 type ShapePoint struct {
 	// shape_id - Required. The shape_id field contains an ID that uniquely identifies a shape.
@@ -58,6 +64,8 @@ type ShapePoint struct {
 	// 		A_shp,37.65863,-122.30839,11,15.8765
 	DistanceTraveled float64
 
+	hasDistanceTraveled bool // shape_dist_traveled was provided (or computed)
+
 	feed *Feed
 }
 
@@ -80,8 +88,9 @@ func (sp *ShapePoint) setField(fieldName, val string) {
 		sp.PointSequence = v
 		break
 	case "shape_dist_traveled":
-		v, _ := strconv.ParseFloat(val, 64) // Should panic on error !
+		v, err := strconv.ParseFloat(val, 64) // Should panic on error !
 		sp.DistanceTraveled = v
+		sp.hasDistanceTraveled = err == nil
 		break
 	}
 }
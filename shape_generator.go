@@ -0,0 +1,114 @@
+package gtfs
+
+import (
+	"github.com/nicolaspaton/gogtfs/geo"
+	"strconv"
+)
+
+// ShapeGenerator builds a shape for each trip pattern without one: straight lines between the stops,
+// or the shortest path on a road or rail Network when one is given. Trips of a pattern where some trips
+// already have a shape get that shape.
+type ShapeGenerator struct {
+	// Default: nil (straight lines)
+	Network *Network
+
+	MaxSnapDistance float64 // In meters, between a stop and the network. Default: 100
+	MaxDetour       float64 // Ratio of the routed to the straight line length above which a straight line is used instead. Default: 3
+
+	IdPrefix string // Prepended to the pattern id to make the shape_id. Default: "gen:"
+
+	feed *Feed
+}
+
+func NewShapeGenerator(f *Feed) (g *ShapeGenerator) {
+	g = &ShapeGenerator{}
+	g.MaxSnapDistance = 100
+	g.MaxDetour = 3
+	g.IdPrefix = "gen:"
+	g.feed = f
+	return
+}
+
+// networkKinds returns the network ways a route type can use, 0 for straight lines
+func networkKinds(route *Route) int {
+	if route == nil {
+		return 0
+	}
+	switch route.Type {
+	case Bus:
+		return NetworkRoad
+	case Tram:
+		return NetworkRail | NetworkRoad
+	case Subway, Rail, Funicular:
+		return NetworkRail
+	}
+	return 0
+}
+
+// Run generates the missing shapes, adds them to Feed.Shapes, sets the ShapeId of the trips and
+// returns the new shapes.
+func (g *ShapeGenerator) Run() []*Shape {
+	shapes := make([]*Shape, 0)
+	for _, pattern := range g.feed.Patterns() {
+		shapeId := pattern.ShapeId()
+		if shapeId == "" {
+			if len(pattern.Stops) < 2 {
+				continue
+			}
+			shape := g.generate(pattern)
+			g.feed.Shapes[shape.Id] = shape
+			shapes = append(shapes, shape)
+			shapeId = shape.Id
+		}
+		for _, trip := range pattern.Trips {
+			if trip.ShapeId == "" || g.feed.Shapes[trip.ShapeId] == nil {
+				trip.ShapeId = shapeId
+				trip.copyColorToShape()
+			}
+		}
+	}
+	if len(shapes) > 0 {
+		g.feed.invalidateShapeIndex()
+	}
+	return shapes
+}
+
+// generate builds the shape of pattern, with a shape_id that isn't used yet
+func (g *ShapeGenerator) generate(pattern *Pattern) *Shape {
+	id := g.IdPrefix + pattern.Id
+	for n := 1; g.feed.Shapes[id] != nil; n++ {
+		id = g.IdPrefix + pattern.Id + ":" + strconv.Itoa(n)
+	}
+	shape := &Shape{Id: id, Points: make([]*ShapePoint, 0, len(pattern.Stops))}
+	add := func(lat, lon float64) {
+		if last := len(shape.Points) - 1; last >= 0 && shape.Points[last].Lat == lat && shape.Points[last].Lon == lon {
+			return
+		}
+		shape.Points = append(shape.Points, &ShapePoint{Id: id, Lat: lat, Lon: lon, PointSequence: len(shape.Points), feed: g.feed})
+	}
+
+	kinds := networkKinds(pattern.Route)
+	for i, stop := range pattern.Stops {
+		if i > 0 && g.Network != nil && kinds != 0 {
+			for _, node := range g.path(pattern.Stops[i-1], stop, kinds) {
+				add(node.lat, node.lon)
+			}
+		}
+		add(stop.Lat, stop.Lon)
+	}
+	if !anyStopTimeHasShapeDistTraveled(pattern.Trips) {
+		shape.fillDistanceTraveled()
+	}
+	return shape
+}
+
+// path returns the network nodes between two consecutive stops, nil if they can't be routed
+func (g *ShapeGenerator) path(from, to *Stop, kinds int) []*networkNode {
+	start := g.Network.nearest(from.Lat, from.Lon, g.MaxSnapDistance, kinds)
+	end := g.Network.nearest(to.Lat, to.Lon, g.MaxSnapDistance, kinds)
+	if start == nil || end == nil {
+		return nil
+	}
+	straight := geo.Haversine(from.Lat, from.Lon, to.Lat, to.Lon)
+	return g.Network.route(start, end, kinds, straight*g.MaxDetour+2*g.MaxSnapDistance)
+}
@@ -0,0 +1,313 @@
+package gtfs
+
+import (
+	"github.com/nicolaspaton/gogtfs/geo"
+	"math"
+	"sort"
+)
+
+// maxSegmentDepth limits the depth of the shape segments quadtree
+const maxSegmentDepth = 16
+
+// ShapeSegment is the segment between Shape.Points[Index] and Shape.Points[Index+1]
+type ShapeSegment struct {
+	Shape *Shape
+	Index int
+	box   AABB
+}
+
+func newShapeSegment(shape *Shape, index int) *ShapeSegment {
+	a, b := shape.Points[index], shape.Points[index+1]
+	return &ShapeSegment{
+		Shape: shape,
+		Index: index,
+		box:   AABB{(a.Lon + b.Lon) / 2, (a.Lat + b.Lat) / 2, math.Abs(a.Lon-b.Lon) / 2, math.Abs(a.Lat-b.Lat) / 2},
+	}
+}
+
+func (s *ShapeSegment) From() *ShapePoint { return s.Shape.Points[s.Index] }
+func (s *ShapeSegment) To() *ShapePoint   { return s.Shape.Points[s.Index+1] }
+
+// DistanceTo returns the distance in meters from lat, lon to the segment
+func (s *ShapeSegment) DistanceTo(lat, lon float64) float64 {
+	a, b := s.From(), s.To()
+	return geo.PointToSegmentDistance(lat, lon, a.Lat, a.Lon, b.Lat, b.Lon)
+}
+
+// containsAABB returns true when other is entirely inside the AABB
+func (aabb *AABB) containsAABB(other *AABB) bool {
+	return other.centerX-other.halfDimX >= aabb.centerX-aabb.halfDimX &&
+		other.centerX+other.halfDimX <= aabb.centerX+aabb.halfDimX &&
+		other.centerY-other.halfDimY >= aabb.centerY-aabb.halfDimY &&
+		other.centerY+other.halfDimY <= aabb.centerY+aabb.halfDimY
+}
+
+// segmentNode is a node of a quadtree where each segment is stored in the smallest node containing it
+type segmentNode struct {
+	boundary AABB
+	depth    int
+	segments []*ShapeSegment
+	children []*segmentNode // nil or northWest, northEast, southWest, southEast
+}
+
+func (n *segmentNode) insert(segment *ShapeSegment) {
+	if n.depth < maxSegmentDepth {
+		if n.children == nil {
+			hx, hy := n.boundary.halfDimX/2, n.boundary.halfDimY/2
+			cx, cy := n.boundary.centerX, n.boundary.centerY
+			n.children = []*segmentNode{
+				{boundary: AABB{cx - hx, cy + hy, hx, hy}, depth: n.depth + 1},
+				{boundary: AABB{cx + hx, cy + hy, hx, hy}, depth: n.depth + 1},
+				{boundary: AABB{cx - hx, cy - hy, hx, hy}, depth: n.depth + 1},
+				{boundary: AABB{cx + hx, cy - hy, hx, hy}, depth: n.depth + 1},
+			}
+		}
+		for _, child := range n.children {
+			if child.boundary.containsAABB(&segment.box) {
+				child.insert(segment)
+				return
+			}
+		}
+	}
+	n.segments = append(n.segments, segment)
+}
+
+// search calls found with every segment whose box intersects box
+func (n *segmentNode) search(box *AABB, found func(*ShapeSegment)) {
+	if !n.boundary.IntersectsAABB(box) {
+		return
+	}
+	for _, segment := range n.segments {
+		if segment.box.IntersectsAABB(box) {
+			found(segment)
+		}
+	}
+	for _, child := range n.children {
+		child.search(box, found)
+	}
+}
+
+// ShapeIndex is a spatial index over the segments of the feed's shapes, see Feed.ShapeIndex
+type ShapeIndex struct {
+	root   *segmentNode
+	trips  map[*Shape][]*Trip
+	routes map[*Shape][]*Route
+}
+
+// NewShapeIndex indexes the shapes' segments, and the trips (and routes) drawn by each shape
+func NewShapeIndex(shapes map[string]*Shape, trips map[string]*Trip) *ShapeIndex {
+	index := &ShapeIndex{trips: make(map[*Shape][]*Trip), routes: make(map[*Shape][]*Route)}
+
+	minLat, maxLat := math.Inf(1), math.Inf(-1)
+	minLon, maxLon := math.Inf(1), math.Inf(-1)
+	for _, shape := range shapes {
+		for _, point := range shape.Points {
+			minLat, maxLat = math.Min(minLat, point.Lat), math.Max(maxLat, point.Lat)
+			minLon, maxLon = math.Min(minLon, point.Lon), math.Max(maxLon, point.Lon)
+		}
+	}
+	if math.IsInf(minLat, 1) {
+		minLat, maxLat, minLon, maxLon = 0, 0, 0, 0
+	}
+	index.root = &segmentNode{boundary: AABB{(minLon + maxLon) / 2, (minLat + maxLat) / 2, (maxLon-minLon)/2 + minHalfDim, (maxLat-minLat)/2 + minHalfDim}}
+	for _, shape := range shapes {
+		for i := 0; i+1 < len(shape.Points); i++ {
+			index.root.insert(newShapeSegment(shape, i))
+		}
+	}
+
+	for _, trip := range trips {
+		shape := shapes[trip.ShapeId]
+		if shape == nil {
+			continue
+		}
+		index.trips[shape] = append(index.trips[shape], trip)
+		if trip.Route != nil && !containsRoute(index.routes[shape], trip.Route) {
+			index.routes[shape] = append(index.routes[shape], trip.Route)
+		}
+	}
+	// Sorted once, the index is shared by concurrent readers
+	for _, routes := range index.routes {
+		sort.Slice(routes, func(i, j int) bool { return routes[i].Id < routes[j].Id })
+	}
+	return index
+}
+
+func containsRoute(routes []*Route, route *Route) bool {
+	for _, r := range routes {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+type ShapeDistanceResult struct {
+	Shape    *Shape
+	Segment  *ShapeSegment // Closest segment of the shape
+	Distance float64
+}
+
+type ShapeDistanceResults []*ShapeDistanceResult
+
+func (s ShapeDistanceResults) Len() int           { return len(s) }
+func (s ShapeDistanceResults) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s ShapeDistanceResults) Less(i, j int) bool { return s[i].Distance < s[j].Distance }
+
+// ShapesNear returns the shapes passing within radius meters of lat, lon, closest first
+func (index *ShapeIndex) ShapesNear(lat, lon, radius float64) ShapeDistanceResults {
+	closest := make(map[*Shape]*ShapeDistanceResult)
+	index.root.search(boundingAABB([]Coordinate{{lat, lon}}, radius), func(segment *ShapeSegment) {
+		d := segment.DistanceTo(lat, lon)
+		if d > radius {
+			return
+		}
+		if result, ok := closest[segment.Shape]; !ok || d < result.Distance {
+			closest[segment.Shape] = &ShapeDistanceResult{segment.Shape, segment, d}
+		}
+	})
+	results := make(ShapeDistanceResults, 0, len(closest))
+	for _, result := range closest {
+		results = append(results, result)
+	}
+	sort.Sort(results)
+	return results
+}
+
+// ShapesInBox returns the shapes with at least one segment crossing the bounding box
+func (index *ShapeIndex) ShapesInBox(minLat, minLon, maxLat, maxLon float64) []*Shape {
+	box := NewAABB((minLon+maxLon)/2, (minLat+maxLat)/2, (maxLon-minLon)/2, (maxLat-minLat)/2)
+	found := make(map[*Shape]bool)
+	index.root.search(box, func(segment *ShapeSegment) {
+		if !found[segment.Shape] {
+			a, b := segment.From(), segment.To()
+			found[segment.Shape] = segmentIntersectsAABB(a.Lat, a.Lon, b.Lat, b.Lon, box)
+		}
+	})
+	return shapeKeys(found)
+}
+
+// ShapesCrossing returns the shapes with at least one segment crossing the polyline line
+func (index *ShapeIndex) ShapesCrossing(line []Coordinate) []*Shape {
+	found := make(map[*Shape]bool)
+	for i := 1; i < len(line); i++ {
+		a, b := line[i-1], line[i]
+		index.root.search(boundingAABB([]Coordinate{a, b}, 0), func(segment *ShapeSegment) {
+			if !found[segment.Shape] {
+				c, d := segment.From(), segment.To()
+				found[segment.Shape] = segmentsIntersect(a.Lat, a.Lon, b.Lat, b.Lon, c.Lat, c.Lon, d.Lat, d.Lon)
+			}
+		})
+	}
+	return shapeKeys(found)
+}
+
+func shapeKeys(found map[*Shape]bool) []*Shape {
+	shapes := make([]*Shape, 0, len(found))
+	for shape, ok := range found {
+		if ok {
+			shapes = append(shapes, shape)
+		}
+	}
+	return shapes
+}
+
+// TripsOf returns the trips drawn with shape
+func (index *ShapeIndex) TripsOf(shape *Shape) []*Trip {
+	return index.trips[shape]
+}
+
+// RoutesOf returns the routes of the trips drawn with shape, by route id. The slice is shared, it must
+// not be modified.
+func (index *ShapeIndex) RoutesOf(shape *Shape) []*Route {
+	return index.routes[shape]
+}
+
+func (index *ShapeIndex) tripsOf(shapes []*Shape) (trips []*Trip) {
+	for _, shape := range shapes {
+		trips = append(trips, index.trips[shape]...)
+	}
+	return
+}
+
+func (index *ShapeIndex) routesOf(shapes []*Shape) (routes []*Route) {
+	for _, shape := range shapes {
+		for _, route := range index.routes[shape] {
+			if !containsRoute(routes, route) {
+				routes = append(routes, route)
+			}
+		}
+	}
+	return
+}
+
+func (results ShapeDistanceResults) shapes() []*Shape {
+	shapes := make([]*Shape, len(results))
+	for i, result := range results {
+		shapes[i] = result.Shape
+	}
+	return shapes
+}
+
+// RoutesNear returns the routes passing within radius meters of lat, lon, closest first
+func (index *ShapeIndex) RoutesNear(lat, lon, radius float64) []*Route {
+	return index.routesOf(index.ShapesNear(lat, lon, radius).shapes())
+}
+
+// TripsNear returns the trips passing within radius meters of lat, lon
+func (index *ShapeIndex) TripsNear(lat, lon, radius float64) []*Trip {
+	return index.tripsOf(index.ShapesNear(lat, lon, radius).shapes())
+}
+
+func (index *ShapeIndex) RoutesInBox(minLat, minLon, maxLat, maxLon float64) []*Route {
+	return index.routesOf(index.ShapesInBox(minLat, minLon, maxLat, maxLon))
+}
+
+func (index *ShapeIndex) TripsInBox(minLat, minLon, maxLat, maxLon float64) []*Trip {
+	return index.tripsOf(index.ShapesInBox(minLat, minLon, maxLat, maxLon))
+}
+
+func (index *ShapeIndex) RoutesCrossing(line []Coordinate) []*Route {
+	return index.routesOf(index.ShapesCrossing(line))
+}
+
+func (index *ShapeIndex) TripsCrossing(line []Coordinate) []*Trip {
+	return index.tripsOf(index.ShapesCrossing(line))
+}
+
+// segmentsIntersect tests the segments [a, b] and [c, d] in the lat/lon plane
+func segmentsIntersect(aLat, aLon, bLat, bLon, cLat, cLon, dLat, dLon float64) bool {
+	orientation := func(pLat, pLon, qLat, qLon, rLat, rLon float64) float64 {
+		return (qLon-pLon)*(rLat-pLat) - (qLat-pLat)*(rLon-pLon)
+	}
+	onSegment := func(pLat, pLon, qLat, qLon, rLat, rLon float64) bool {
+		return math.Min(pLat, qLat) <= rLat && rLat <= math.Max(pLat, qLat) && math.Min(pLon, qLon) <= rLon && rLon <= math.Max(pLon, qLon)
+	}
+	o1 := orientation(aLat, aLon, bLat, bLon, cLat, cLon)
+	o2 := orientation(aLat, aLon, bLat, bLon, dLat, dLon)
+	o3 := orientation(cLat, cLon, dLat, dLon, aLat, aLon)
+	o4 := orientation(cLat, cLon, dLat, dLon, bLat, bLon)
+	if ((o1 > 0 && o2 < 0) || (o1 < 0 && o2 > 0)) && ((o3 > 0 && o4 < 0) || (o3 < 0 && o4 > 0)) {
+		return true
+	}
+	return (o1 == 0 && onSegment(aLat, aLon, bLat, bLon, cLat, cLon)) ||
+		(o2 == 0 && onSegment(aLat, aLon, bLat, bLon, dLat, dLon)) ||
+		(o3 == 0 && onSegment(cLat, cLon, dLat, dLon, aLat, aLon)) ||
+		(o4 == 0 && onSegment(cLat, cLon, dLat, dLon, bLat, bLon))
+}
+
+// segmentIntersectsAABB tests the segment [a, b] against box
+func segmentIntersectsAABB(aLat, aLon, bLat, bLon float64, box *AABB) bool {
+	minLon, maxLon := box.centerX-box.halfDimX, box.centerX+box.halfDimX
+	minLat, maxLat := box.centerY-box.halfDimY, box.centerY+box.halfDimY
+	inside := func(lat, lon float64) bool {
+		return lat >= minLat && lat <= maxLat && lon >= minLon && lon <= maxLon
+	}
+	if inside(aLat, aLon) || inside(bLat, bLon) {
+		return true
+	}
+	return segmentsIntersect(aLat, aLon, bLat, bLon, minLat, minLon, maxLat, minLon) ||
+		segmentsIntersect(aLat, aLon, bLat, bLon, maxLat, minLon, maxLat, maxLon) ||
+		segmentsIntersect(aLat, aLon, bLat, bLon, maxLat, maxLon, minLat, maxLon) ||
+		segmentsIntersect(aLat, aLon, bLat, bLon, minLat, maxLon, minLat, minLon)
+}
@@ -0,0 +1,311 @@
+package gtfs
+
+import (
+	"container/heap"
+	"github.com/nicolaspaton/gogtfs/geo"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Simplification methods:
+const (
+	DouglasPeucker = iota // 0 - removes points closer than the tolerance to the line joining their neighbours
+	Visvalingam           // 1 - removes points forming a triangle smaller than tolerance² with their neighbours
+)
+
+// plane returns the points of the shape in meters, in a local equirectangular projection
+func (s *Shape) plane() [][2]float64 {
+	xy := make([][2]float64, len(s.Points))
+	if len(s.Points) == 0 {
+		return xy
+	}
+	origin := s.Points[0]
+	for i, point := range s.Points {
+		xy[i][0], xy[i][1] = geo.Equirectangular(origin.Lat, origin.Lon, point.Lat, point.Lon)
+	}
+	return xy
+}
+
+// nearestPointIndex returns the index of the shape point closest to lat, lon
+func (s *Shape) nearestPointIndex(lat, lon float64) int {
+	best, bestDistance := 0, math.Inf(1)
+	for i, point := range s.Points {
+		if d := geo.Haversine(lat, lon, point.Lat, point.Lon); d < bestDistance {
+			best, bestDistance = i, d
+		}
+	}
+	return best
+}
+
+// Simplify returns a copy of the shape with fewer points, using method (DouglasPeucker or Visvalingam)
+// with a tolerance in meters. The first and last points are kept, as well as the point closest to each
+// of stops. The copy shares the kept ShapePoints with the original shape.
+func (s *Shape) Simplify(method int, tolerance float64, stops []*Stop) *Shape {
+	simplified := &Shape{Id: s.Id, Color: s.Color}
+	if len(s.Points) < 3 || tolerance <= 0 {
+		simplified.Points = append(simplified.Points, s.Points...)
+		return simplified
+	}
+
+	kept := make([]bool, len(s.Points))
+	kept[0], kept[len(s.Points)-1] = true, true
+	for _, stop := range stops {
+		kept[s.nearestPointIndex(stop.Lat, stop.Lon)] = true
+	}
+
+	xy := s.plane()
+	switch method {
+	case Visvalingam:
+		visvalingam(xy, kept, tolerance*tolerance)
+	default:
+		// Each section between two forced points is simplified on its own
+		start := 0
+		for i := 1; i < len(kept); i++ {
+			if kept[i] {
+				douglasPeucker(xy, kept, start, i, tolerance)
+				start = i
+			}
+		}
+	}
+
+	simplified.Points = make([]*ShapePoint, 0)
+	for i, point := range s.Points {
+		if kept[i] {
+			simplified.Points = append(simplified.Points, point)
+		}
+	}
+	return simplified
+}
+
+// planeSegmentDistance returns the distance from p to the segment [a, b]
+func planeSegmentDistance(p, a, b [2]float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	t := 0.0
+	if length := dx*dx + dy*dy; length > 0 {
+		t = math.Max(0, math.Min(1, ((p[0]-a[0])*dx+(p[1]-a[1])*dy)/length))
+	}
+	return math.Hypot(p[0]-a[0]-t*dx, p[1]-a[1]-t*dy)
+}
+
+// douglasPeucker marks as kept the points between first and last further than tolerance from the simplified line
+func douglasPeucker(xy [][2]float64, kept []bool, first, last int, tolerance float64) {
+	sections := [][2]int{{first, last}}
+	for len(sections) > 0 {
+		section := sections[len(sections)-1]
+		sections = sections[:len(sections)-1]
+		farthest, farthestDistance := -1, tolerance
+		for i := section[0] + 1; i < section[1]; i++ {
+			if d := planeSegmentDistance(xy[i], xy[section[0]], xy[section[1]]); d > farthestDistance {
+				farthest, farthestDistance = i, d
+			}
+		}
+		if farthest != -1 {
+			kept[farthest] = true
+			sections = append(sections, [2]int{section[0], farthest}, [2]int{farthest, section[1]})
+		}
+	}
+}
+
+type visvalingamItem struct {
+	index int
+	area  float64
+	slot  int // Position in the heap
+}
+
+type visvalingamQueue []*visvalingamItem
+
+func (q visvalingamQueue) Len() int           { return len(q) }
+func (q visvalingamQueue) Less(i, j int) bool { return q[i].area < q[j].area }
+func (q visvalingamQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i]; q[i].slot = i; q[j].slot = j }
+func (q *visvalingamQueue) Push(x interface{}) {
+	item := x.(*visvalingamItem)
+	item.slot = len(*q)
+	*q = append(*q, item)
+}
+func (q *visvalingamQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+func triangleArea(a, b, c [2]float64) float64 {
+	return math.Abs((b[0]-a[0])*(c[1]-a[1])-(c[0]-a[0])*(b[1]-a[1])) / 2
+}
+
+// visvalingam keeps the points which effective area is at least minArea, plus the ones already kept
+func visvalingam(xy [][2]float64, kept []bool, minArea float64) {
+	previous := make([]int, len(xy))
+	next := make([]int, len(xy))
+	items := make([]*visvalingamItem, len(xy))
+	queue := make(visvalingamQueue, 0, len(xy))
+	for i := range xy {
+		previous[i], next[i] = i-1, i+1
+		if !kept[i] {
+			items[i] = &visvalingamItem{index: i, area: triangleArea(xy[i-1], xy[i], xy[i+1])}
+			heap.Push(&queue, items[i])
+		}
+	}
+	update := func(i int) {
+		if items[i] == nil {
+			return
+		}
+		items[i].area = triangleArea(xy[previous[i]], xy[i], xy[next[i]])
+		heap.Fix(&queue, items[i].slot)
+	}
+	for queue.Len() > 0 && queue[0].area < minArea {
+		item := heap.Pop(&queue).(*visvalingamItem)
+		items[item.index] = nil
+		before, after := previous[item.index], next[item.index]
+		next[before], previous[after] = after, before
+		update(before)
+		update(after)
+	}
+	for _, item := range queue {
+		kept[item.index] = true
+	}
+}
+
+// EncodedPolyline returns the points of the shape in the Encoded Polyline Algorithm Format
+// (https://developers.google.com/maps/documentation/utilities/polylinealgorithm), with a precision of 5 decimals.
+func (s *Shape) EncodedPolyline() string {
+	var encoded strings.Builder
+	var lastLat, lastLon int64
+	for _, point := range s.Points {
+		lat := int64(math.Round(point.Lat * 1e5))
+		lon := int64(math.Round(point.Lon * 1e5))
+		encodePolylineValue(&encoded, lat-lastLat)
+		encodePolylineValue(&encoded, lon-lastLon)
+		lastLat, lastLon = lat, lon
+	}
+	return encoded.String()
+}
+
+func encodePolylineValue(encoded *strings.Builder, value int64) {
+	v := value << 1
+	if value < 0 {
+		v = ^v
+	}
+	for v >= 0x20 {
+		encoded.WriteByte(byte((0x20 | (v & 0x1f)) + 63))
+		v >>= 5
+	}
+	encoded.WriteByte(byte(v + 63))
+}
+
+// DecodePolyline returns the coordinates of an encoded polyline (see Shape.EncodedPolyline)
+func DecodePolyline(encoded string) []Coordinate {
+	coordinates := make([]Coordinate, 0)
+	var lat, lon int64
+	index := 0
+	decode := func() (int64, bool) {
+		var result int64
+		shift := uint(0)
+		for index < len(encoded) {
+			b := int64(encoded[index]) - 63
+			index++
+			result |= (b & 0x1f) << shift
+			shift += 5
+			if b < 0x20 {
+				if result&1 != 0 {
+					return ^(result >> 1), true
+				}
+				return result >> 1, true
+			}
+		}
+		return 0, false
+	}
+	for index < len(encoded) {
+		dLat, ok := decode()
+		if !ok {
+			break
+		}
+		dLon, ok := decode()
+		if !ok {
+			break
+		}
+		lat, lon = lat+dLat, lon+dLon
+		coordinates = append(coordinates, Coordinate{float64(lat) / 1e5, float64(lon) / 1e5})
+	}
+	return coordinates
+}
+
+// ShapeStops returns the stops served by the trips of each shape, keyed by shape_id
+func (f *Feed) ShapeStops() map[string][]*Stop {
+	seen := make(map[string]map[*Stop]bool)
+	stops := make(map[string][]*Stop)
+	for _, trip := range f.Trips {
+		if f.Shapes[trip.ShapeId] == nil {
+			continue
+		}
+		if seen[trip.ShapeId] == nil {
+			seen[trip.ShapeId] = make(map[*Stop]bool)
+		}
+		for _, st := range trip.StopTimes {
+			if st != nil && st.Stop != nil && !seen[trip.ShapeId][st.Stop] {
+				seen[trip.ShapeId][st.Stop] = true
+				stops[trip.ShapeId] = append(stops[trip.ShapeId], st.Stop)
+			}
+		}
+	}
+	return stops
+}
+
+// SimplifiedShapes returns a simplified copy of every shape of the feed, keyed by shape_id. See Shape.Simplify.
+func (f *Feed) SimplifiedShapes(method int, tolerance float64) map[string]*Shape {
+	stops := f.ShapeStops()
+	shapes := make(map[string]*Shape, len(f.Shapes))
+	for id, shape := range f.Shapes {
+		shapes[id] = shape.Simplify(method, tolerance, stops[id])
+	}
+	return shapes
+}
+
+// ShapeDuplicates returns the shapes having the same points as another shape, mapped to the
+// shape_id of that other shape (the smallest shape_id of the identical shapes).
+func (f *Feed) ShapeDuplicates() map[string]string {
+	ids := make([]string, 0, len(f.Shapes))
+	for id := range f.Shapes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	duplicates := make(map[string]string)
+	firsts := make(map[string]string)
+	for _, id := range ids {
+		var key strings.Builder
+		for _, point := range f.Shapes[id].Points {
+			key.WriteString(strconv.FormatFloat(point.Lat, 'g', -1, 64))
+			key.WriteByte(',')
+			key.WriteString(strconv.FormatFloat(point.Lon, 'g', -1, 64))
+			key.WriteByte(';')
+		}
+		if first, ok := firsts[key.String()]; ok {
+			duplicates[id] = first
+		} else {
+			firsts[key.String()] = id
+		}
+	}
+	return duplicates
+}
+
+// DeduplicateShapes removes the shapes identical to another one from the feed, pointing their
+// trips to the shape kept instead. It returns the number of shapes removed.
+func (f *Feed) DeduplicateShapes() int {
+	duplicates := f.ShapeDuplicates()
+	if len(duplicates) == 0 {
+		return 0
+	}
+	for _, trip := range f.Trips {
+		if kept, ok := duplicates[trip.ShapeId]; ok {
+			trip.ShapeId = kept
+		}
+	}
+	for id := range duplicates {
+		delete(f.Shapes, id)
+	}
+	f.invalidateShapeIndex()
+	return len(duplicates)
+}
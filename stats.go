@@ -0,0 +1,487 @@
+package gtfs
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nicolaspaton/gogtfs/geo"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Day types of DayTypeStats:
+const (
+	DayTypeWeekday  = iota // 0 - Monday to Friday
+	DayTypeSaturday        // 1 - Saturday
+	DayTypeSunday          // 2 - Sunday
+)
+
+var DayTypeNames = []string{"weekday", "saturday", "sunday"}
+
+func dayTypeOf(date time.Time) int {
+	switch date.Weekday() {
+	case time.Saturday:
+		return DayTypeSaturday
+	case time.Sunday:
+		return DayTypeSunday
+	}
+	return DayTypeWeekday
+}
+
+// TimeBand is a period of the day, in seconds since midnight, End excluded
+type TimeBand struct {
+	Name  string
+	Start uint
+	End   uint
+}
+
+var DefaultTimeBands = []TimeBand{
+	{"early", 0, 6 * 60 * 60},
+	{"am_peak", 6 * 60 * 60, 9 * 60 * 60},
+	{"midday", 9 * 60 * 60, 15 * 60 * 60},
+	{"pm_peak", 15 * 60 * 60, 19 * 60 * 60},
+	{"evening", 19 * 60 * 60, 48 * 60 * 60}, // Including the trips running after midnight
+}
+
+// DayTypeStats is the service of an agency or a route on a day type
+type DayTypeStats struct {
+	DayType string
+
+	Days  int     // Days of the type in the period
+	Trips float64 // Average trip runs per day, frequency based trips counting once per run
+
+	// Figures of the representative day of the type: the one with the most trips in the whole feed
+	Date         time.Time
+	SpanStart    uint // First departure, in seconds since midnight
+	SpanEnd      uint // Last arrival
+	PeakVehicles int  // Most runs at the same time, the trips of a block counting as one vehicle
+
+	// Average time between departures from the first stop, in seconds, by TimeBand name. Bands with
+	// less than two departures are left out. The directions of a route are averaged. Routes only.
+	Headways map[string]float64 `json:",omitempty"`
+}
+
+// ServiceStats is the service provided by an agency or a route over the period of a FeedStats
+type ServiceStats struct {
+	AgencyId string
+	RouteId  string // Empty for agencies
+	Name     string // agency_name, route_short_name or route_long_name
+
+	Stops             int     // Stops served
+	Trips             int     // Trip runs
+	ServiceHours      float64 // From the first departure to the last arrival of each run
+	ServiceKilometers float64 // Along the trips' shapes, or straight between the stops of trips without
+
+	// Indexed by DayType constants
+	DayTypes []*DayTypeStats
+}
+
+// FeedStats is the result of a StatsCalculator
+type FeedStats struct {
+	Start     time.Time
+	End       time.Time
+	TimeBands []TimeBand
+
+	// Entities of the feed
+	AgencyCount    int
+	StopCount      int
+	RouteCount     int
+	TripCount      int
+	StopTimeCount  int
+	ShapeCount     int
+	CalendarCount  int
+	TransferCount  int
+	FrequencyCount int
+
+	Agencies []*ServiceStats // By agency id
+	Routes   []*ServiceStats // By agency id then route id
+}
+
+// StatsCalculator computes per agency and per route service figures over a period, for reporting
+type StatsCalculator struct {
+	Start     time.Time  // Default: first day of the current month
+	End       time.Time  // Included. Default: last day of the current month
+	TimeBands []TimeBand // Default: DefaultTimeBands
+
+	feed *Feed
+}
+
+func NewStatsCalculator(f *Feed) (c *StatsCalculator) {
+	c = &StatsCalculator{}
+	now := time.Now()
+	c.Start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	c.End = c.Start.AddDate(0, 1, -1)
+	c.TimeBands = DefaultTimeBands
+	c.feed = f
+	return
+}
+
+// tripRunStarts returns the departure time from the first stop of each run of a trip
+func tripRunStarts(trip *Trip, stopTimes []*StopTime) []uint {
+	if len(trip.Frequencies) == 0 {
+		return []uint{stopTimes[0].DepartureTime}
+	}
+	starts := make([]uint, 0)
+	for _, freq := range trip.Frequencies {
+		if freq.HeadwaySecs == 0 {
+			continue
+		}
+		for start := freq.StartTime; start < freq.EndTime; start += freq.HeadwaySecs {
+			starts = append(starts, start)
+		}
+	}
+	return starts
+}
+
+// tripLength returns the length of a trip in meters, the one of its shape if it has one
+func (f *Feed) tripLength(trip *Trip, stopTimes []*StopTime) float64 {
+	if shape := f.Shapes[trip.ShapeId]; shape != nil && len(shape.Points) > 1 {
+		return shape.Length()
+	}
+	length := 0.0
+	var previous *Stop
+	for _, st := range stopTimes {
+		if st.Stop == nil {
+			continue
+		}
+		if previous != nil {
+			length += geo.Haversine(previous.Lat, previous.Lon, st.Stop.Lat, st.Stop.Lon)
+		}
+		previous = st.Stop
+	}
+	return length
+}
+
+// statsRun is a vehicle run of a trip on a representative day
+type statsRun struct {
+	trip  *Trip
+	start uint
+	end   uint
+}
+
+// statsGroup accumulates the figures of an agency or a route
+type statsGroup struct {
+	stats    *ServiceStats
+	stops    map[*Stop]bool
+	dayTrips []int
+	runs     [][]statsRun // By day type, on the representative day
+}
+
+func newStatsGroup(agencyId, routeId, name string) *statsGroup {
+	return &statsGroup{
+		stats:    &ServiceStats{AgencyId: agencyId, RouteId: routeId, Name: name, DayTypes: make([]*DayTypeStats, len(DayTypeNames))},
+		stops:    make(map[*Stop]bool),
+		dayTrips: make([]int, len(DayTypeNames)),
+		runs:     make([][]statsRun, len(DayTypeNames)),
+	}
+}
+
+// Run computes the statistics, it fails when End is before Start
+func (c *StatsCalculator) Run() (*FeedStats, error) {
+	start := time.Date(c.Start.Year(), c.Start.Month(), c.Start.Day(), 0, 0, 0, 0, time.UTC)
+	end := time.Date(c.End.Year(), c.End.Month(), c.End.Day(), 0, 0, 0, 0, time.UTC)
+	if end.Before(start) {
+		return nil, errors.New("The end of the period is before its start")
+	}
+	feed := c.feed
+	stats := &FeedStats{
+		Start:          start,
+		End:            end,
+		TimeBands:      c.TimeBands,
+		AgencyCount:    len(feed.Agencies),
+		StopCount:      feed.StopCollection.Length(),
+		RouteCount:     len(feed.Routes),
+		TripCount:      len(feed.Trips),
+		StopTimeCount:  feed.StopTimesCount,
+		ShapeCount:     len(feed.Shapes),
+		CalendarCount:  len(feed.Calendars),
+		TransferCount:  feed.TranfersCount,
+		FrequencyCount: feed.FrequenciesCount,
+		Agencies:       make([]*ServiceStats, 0),
+		Routes:         make([]*ServiceStats, 0),
+	}
+
+	// Days of the period and their type
+	dates := make([]int, 0)
+	days := make([]int, len(DayTypeNames))
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		dates = append(dates, day.Year()*10000+int(day.Month())*100+day.Day())
+		days[dayTypeOf(day)]++
+	}
+	serviceDates := make(map[string]map[int]bool)
+	runsOn := func(trip *Trip) []int {
+		if _, ok := serviceDates[trip.serviceId]; !ok {
+			serviceDates[trip.serviceId] = make(map[int]bool)
+			for _, date := range feed.ServiceDates(trip.serviceId) {
+				serviceDates[trip.serviceId][date] = true
+			}
+		}
+		running := make([]int, 0)
+		for _, date := range dates {
+			if serviceDates[trip.serviceId][date] {
+				running = append(running, date)
+			}
+		}
+		return running
+	}
+
+	agencies := make(map[string]*statsGroup)
+	routes := make(map[*Route]*statsGroup)
+	groupsOf := func(route *Route) []*statsGroup {
+		if routes[route] == nil {
+			agencyId, agencyName := "", ""
+			if route.Agency != nil {
+				agencyId, agencyName = route.Agency.Id, route.Agency.Name
+			}
+			if agencies[agencyId] == nil {
+				agencies[agencyId] = newStatsGroup(agencyId, "", agencyName)
+			}
+			name := route.ShortName
+			if name == "" {
+				name = route.LongName
+			}
+			routes[route] = newStatsGroup(agencyId, route.Id, name)
+		}
+		return []*statsGroup{agencies[routes[route].stats.AgencyId], routes[route]}
+	}
+
+	// Totals over the period, and the trips of each day to find the representative ones
+	dateTrips := make(map[int]int)
+	lengths := make(map[*Trip]float64)
+	for _, id := range sortedTripIds(feed.Trips) {
+		trip := feed.Trips[id]
+		stopTimes := stopTimesOf(trip)
+		if trip.Route == nil || len(stopTimes) == 0 {
+			continue
+		}
+		running := runsOn(trip)
+		if len(running) == 0 {
+			continue
+		}
+		starts := tripRunStarts(trip, stopTimes)
+		duration := float64(stopTimes[len(stopTimes)-1].ArrivalTime) - float64(stopTimes[0].DepartureTime)
+		lengths[trip] = feed.tripLength(trip, stopTimes)
+		for _, group := range groupsOf(trip.Route) {
+			for _, st := range stopTimes {
+				if st.Stop != nil {
+					group.stops[st.Stop] = true
+				}
+			}
+			runs := len(starts) * len(running)
+			group.stats.Trips += runs
+			group.stats.ServiceHours += float64(runs) * duration / (60 * 60)
+			group.stats.ServiceKilometers += float64(runs) * lengths[trip] / 1000
+			for _, date := range running {
+				group.dayTrips[dayTypeOf(intDateToTime(date))] += len(starts)
+			}
+		}
+		for _, date := range running {
+			dateTrips[date] += len(starts)
+		}
+	}
+
+	representative := make([]int, len(DayTypeNames))
+	for _, date := range dates {
+		dayType := dayTypeOf(intDateToTime(date))
+		if dateTrips[date] > dateTrips[representative[dayType]] {
+			representative[dayType] = date
+		}
+	}
+
+	// Runs of the representative days
+	for _, id := range sortedTripIds(feed.Trips) {
+		trip := feed.Trips[id]
+		if _, ok := lengths[trip]; !ok {
+			continue
+		}
+		stopTimes := stopTimesOf(trip)
+		duration := stopTimes[len(stopTimes)-1].ArrivalTime - stopTimes[0].DepartureTime
+		for dayType, date := range representative {
+			if date == 0 || !serviceDates[trip.serviceId][date] {
+				continue
+			}
+			for _, start := range tripRunStarts(trip, stopTimes) {
+				for _, group := range groupsOf(trip.Route) {
+					group.runs[dayType] = append(group.runs[dayType], statsRun{trip, start, start + duration})
+				}
+			}
+		}
+	}
+
+	finish := func(group *statsGroup, headways bool) *ServiceStats {
+		group.stats.Stops = len(group.stops)
+		for dayType, name := range DayTypeNames {
+			dayStats := &DayTypeStats{DayType: name, Days: days[dayType]}
+			if days[dayType] > 0 {
+				dayStats.Trips = float64(group.dayTrips[dayType]) / float64(days[dayType])
+			}
+			if runs := group.runs[dayType]; len(runs) > 0 {
+				dayStats.Date = intDateToTime(representative[dayType])
+				dayStats.SpanStart, dayStats.SpanEnd = runs[0].start, runs[0].end
+				for _, run := range runs {
+					if run.start < dayStats.SpanStart {
+						dayStats.SpanStart = run.start
+					}
+					if run.end > dayStats.SpanEnd {
+						dayStats.SpanEnd = run.end
+					}
+				}
+				dayStats.PeakVehicles = peakVehicles(runs)
+				if headways {
+					dayStats.Headways = c.headways(runs)
+				}
+			}
+			group.stats.DayTypes[dayType] = dayStats
+		}
+		return group.stats
+	}
+	for _, group := range agencies {
+		stats.Agencies = append(stats.Agencies, finish(group, false))
+	}
+	for _, group := range routes {
+		stats.Routes = append(stats.Routes, finish(group, true))
+	}
+	sort.Slice(stats.Agencies, func(i, j int) bool { return stats.Agencies[i].AgencyId < stats.Agencies[j].AgencyId })
+	sort.Slice(stats.Routes, func(i, j int) bool {
+		if stats.Routes[i].AgencyId != stats.Routes[j].AgencyId {
+			return stats.Routes[i].AgencyId < stats.Routes[j].AgencyId
+		}
+		return stats.Routes[i].RouteId < stats.Routes[j].RouteId
+	})
+	return stats, nil
+}
+
+// peakVehicles returns the most runs in service at the same time. The trips of a block use the
+// same vehicle from the first departure to the last arrival of the block.
+func peakVehicles(runs []statsRun) int {
+	type event struct {
+		at    uint
+		delta int
+	}
+	events := make([]event, 0, 2*len(runs))
+	blocks := make(map[string]*statsRun)
+	for _, run := range runs {
+		if run.trip.BlockId != "" && len(run.trip.Frequencies) == 0 {
+			if block := blocks[run.trip.BlockId]; block != nil {
+				if run.start < block.start {
+					block.start = run.start
+				}
+				if run.end > block.end {
+					block.end = run.end
+				}
+			} else {
+				block := run
+				blocks[run.trip.BlockId] = &block
+			}
+			continue
+		}
+		events = append(events, event{run.start, 1}, event{run.end, -1})
+	}
+	for _, block := range blocks {
+		events = append(events, event{block.start, 1}, event{block.end, -1})
+	}
+	// A vehicle arriving can leave again at the same time
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].at != events[j].at {
+			return events[i].at < events[j].at
+		}
+		return events[i].delta < events[j].delta
+	})
+	peak, current := 0, 0
+	for _, e := range events {
+		current += e.delta
+		if current > peak {
+			peak = current
+		}
+	}
+	return peak
+}
+
+// headways returns the average headway of each time band, averaging the directions
+func (c *StatsCalculator) headways(runs []statsRun) map[string]float64 {
+	starts := make(map[byte][]uint)
+	for _, run := range runs {
+		starts[run.trip.Direction] = append(starts[run.trip.Direction], run.start)
+	}
+	headways := make(map[string]float64)
+	for _, band := range c.TimeBands {
+		sum, count := 0.0, 0
+		for _, directionStarts := range starts {
+			inBand := make([]uint, 0)
+			for _, start := range directionStarts {
+				if start >= band.Start && start < band.End {
+					inBand = append(inBand, start)
+				}
+			}
+			if len(inBand) < 2 {
+				continue
+			}
+			sort.Slice(inBand, func(i, j int) bool { return inBand[i] < inBand[j] })
+			sum += float64(inBand[len(inBand)-1]-inBand[0]) / float64(len(inBand)-1)
+			count++
+		}
+		if count > 0 {
+			headways[band.Name] = sum / float64(count)
+		}
+	}
+	return headways
+}
+
+// formatTimeOfDay formats seconds since midnight as a GTFS time, HH:MM:SS
+func formatTimeOfDay(seconds uint) string {
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// WriteJSON writes the statistics as an indented JSON document
+func (s *FeedStats) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(s)
+}
+
+// WriteCSV writes one row per agency then one per route, with the figures of each day type in
+// columns prefixed by its name. Hours and kilometres have two decimals, headways are in seconds
+// and empty when unknown.
+func (s *FeedStats) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	header := []string{"agency_id", "route_id", "name", "stops", "trips", "service_hours", "service_km"}
+	for _, dayType := range DayTypeNames {
+		header = append(header, dayType+"_days", dayType+"_trips", dayType+"_date", dayType+"_span_start", dayType+"_span_end", dayType+"_peak_vehicles")
+		for _, band := range s.TimeBands {
+			header = append(header, dayType+"_headway_"+band.Name)
+		}
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	formatFloat := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	}
+	for _, stats := range append(append([]*ServiceStats(nil), s.Agencies...), s.Routes...) {
+		row := []string{stats.AgencyId, stats.RouteId, stats.Name, strconv.Itoa(stats.Stops), strconv.Itoa(stats.Trips), formatFloat(stats.ServiceHours), formatFloat(stats.ServiceKilometers)}
+		for _, dayStats := range stats.DayTypes {
+			row = append(row, strconv.Itoa(dayStats.Days), formatFloat(dayStats.Trips))
+			if dayStats.Date.IsZero() {
+				row = append(row, "", "", "", "0")
+			} else {
+				row = append(row, dayStats.Date.Format("20060102"), formatTimeOfDay(dayStats.SpanStart), formatTimeOfDay(dayStats.SpanEnd), strconv.Itoa(dayStats.PeakVehicles))
+			}
+			for _, band := range s.TimeBands {
+				if headway, ok := dayStats.Headways[band.Name]; ok {
+					row = append(row, strconv.Itoa(int(headway+0.5)))
+				} else {
+					row = append(row, "")
+				}
+			}
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -1,15 +1,25 @@
 package gtfs
 
 import (
+	"github.com/nicolaspaton/gogtfs/geo"
 	"strconv"
 	"time"
-	"math"
 )
 
 // Stop.LocationType possible values:
 const (
-	LocationTypeStop    = iota // 0 - Stop. A location where passengers board or disembark from a transit vehicle.
-	LocationTypeStation        // 1 - Station. A physical structure or area that contains one or more stop.
+	LocationTypeStop         = iota // 0 - Stop. A location where passengers board or disembark from a transit vehicle.
+	LocationTypeStation             // 1 - Station. A physical structure or area that contains one or more stop.
+	LocationTypeEntrance            // 2 - Station Entrance/Exit. A location where passengers can enter or exit a station from the street.
+	LocationTypeGenericNode         // 3 - Generic Node. A location within a station, used to link pathways together.
+	LocationTypeBoardingArea        // 4 - Boarding Area. A specific location on a platform, where passengers can board and/or alight vehicles.
+)
+
+// Stop.WheelchairBoarding and Trip.WheelchairAccessible possible values:
+const (
+	WheelchairUnknown      = iota // 0 (or empty) - No accessibility information.
+	WheelchairAccessible          // 1 - Some vehicles/stops can accommodate at least one rider in a wheelchair.
+	WheelchairInaccessible        // 2 - No rider in a wheelchair can be accommodated.
 )
 
 // stops.txt
@@ -73,8 +83,20 @@ type Stop struct {
 	// 	 A station.                       	1                            	A blank value. Stations can't contain other stations.
 	ParentStationId string
 
+	// wheelchair_boarding - Optional. The wheelchair_boarding field identifies whether wheelchair boardings are possible from
+	// the specified stop or station. The field can have the following values:
+	// 		0 (or empty) - For a stop without a parent station, there is no accessibility information. For a stop inside a station,
+	// 		               the stop inherits its wheelchair_boarding value from the parent station.
+	// 		1 - Some vehicles at this stop can be boarded by a rider in a wheelchair.
+	// 		2 - Wheelchair boarding is not possible at this stop.
+	// See Wheelchair constants and EffectiveWheelchairBoarding
+	WheelchairBoarding byte
+
 	Transfers map[string]*Transfer
 
+	// Pathways leaving from or arriving at this stop (see pathways.txt)
+	Pathways []*Pathway
+
 	StopTimes []*StopTime
 
 	feed *Feed
@@ -88,6 +110,18 @@ func (s *Stop) ParentStation() *Stop {
 	return s.feed.StopCollection.Stops[s.ParentStationId]
 }
 
+// EffectiveWheelchairBoarding returns the stop's wheelchair_boarding value, inherited from the
+// parent station when the stop itself has no accessibility information.
+func (s *Stop) EffectiveWheelchairBoarding() byte {
+	if s.WheelchairBoarding != WheelchairUnknown || s.ParentStationId == "" {
+		return s.WheelchairBoarding
+	}
+	if parent := s.ParentStation(); parent != nil {
+		return parent.WheelchairBoarding
+	}
+	return WheelchairUnknown
+}
+
 func (s *Stop) NextStopTimes(time *time.Time, count int) (stopTimes []*StopTime) {
 	timeOfDay := timeOfDayInSeconds(time)
 	for _, stoptime := range s.StopTimes {
@@ -98,12 +132,22 @@ func (s *Stop) NextStopTimes(time *time.Time, count int) (stopTimes []*StopTime)
 	return
 }
 
+// Routes returns the routes of the trips calling at the stop
+func (s *Stop) Routes() (routes []*Route) {
+	seen := make(map[*Route]bool)
+	for _, stoptime := range s.StopTimes {
+		if stoptime.Trip == nil || stoptime.Trip.Route == nil || seen[stoptime.Trip.Route] {
+			continue
+		}
+		seen[stoptime.Trip.Route] = true
+		routes = append(routes, stoptime.Trip.Route)
+	}
+	return
+}
+
+// DistanceToCoordinate returns the distance in meters from the stop to lat, lon (see geo.Haversine)
 func (s *Stop) DistanceToCoordinate(lat, lon float64) float64 {
-	earth_radius := 6371000.0
-	to_rad := math.Pi / 180.0
-	return math.Acos(math.Sin(s.Lat * to_rad) * math.Sin(lat * to_rad) +
-                              math.Cos(s.Lat * to_rad) * math.Cos(lat * to_rad) *
-                              math.Cos((lon - s.Lon) * to_rad)) * earth_radius;
+	return geo.Haversine(s.Lat, s.Lon, lat, lon)
 }
 
 func (s *Stop) setField(fieldName, val string) {
@@ -141,10 +185,26 @@ func (s *Stop) setField(fieldName, val string) {
 			s.LocationType = LocationTypeStop
 		} else if v == 1 {
 			s.LocationType = LocationTypeStation
+		} else if v == 2 {
+			s.LocationType = LocationTypeEntrance
+		} else if v == 3 {
+			s.LocationType = LocationTypeGenericNode
+		} else if v == 4 {
+			s.LocationType = LocationTypeBoardingArea
 		}
 		break
 	case "parent_station":
 		s.ParentStationId = val
 		break
+	case "wheelchair_boarding":
+		v, _ := strconv.Atoi(val) // Should panic on error !
+		if v == 1 {
+			s.WheelchairBoarding = WheelchairAccessible
+		} else if v == 2 {
+			s.WheelchairBoarding = WheelchairInaccessible
+		} else {
+			s.WheelchairBoarding = WheelchairUnknown
+		}
+		break
 	}
 }
@@ -0,0 +1,261 @@
+package gtfs
+
+import (
+	"github.com/nicolaspaton/gogtfs/geo"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// platformWords are left out when comparing stop names, "Central Platform 2" and "Central Bay B" being the same place
+var platformWords = map[string]bool{
+	"platform": true, "track": true, "bay": true, "stand": true, "gate": true, "stop": true,
+	"quai": true, "voie": true, "bahnsteig": true, "gleis": true, "anden": true, "via": true,
+}
+
+// StopCluster is a group of stops suggested to become the children of a new station
+type StopCluster struct {
+	// Suggested station
+	Id   string
+	Name string
+	Lat  float64
+	Lon  float64
+
+	// Sorted by id
+	Stops []*Stop
+}
+
+// StopClustering groups stops without parent station that are close to each other and have similar
+// names into candidate stations.
+type StopClustering struct {
+	MaxDistance       float64 // In meters, between any two stops of a cluster. Default: 150
+	MinNameSimilarity float64 // From 0 (any name) to 1 (same name once normalized). Default: 0.7
+
+	IdPrefix string // Prepended to the id of the first stop to make the station id. Default: "station:"
+
+	feed *Feed
+}
+
+func NewStopClustering(f *Feed) (c *StopClustering) {
+	c = &StopClustering{}
+	c.MaxDistance = 150
+	c.MinNameSimilarity = 0.7
+	c.IdPrefix = "station:"
+	c.feed = f
+	return
+}
+
+// normalizeStopName lowercases name and removes punctuation and platforms: platform words, single
+// letters and the numbers following a platform word ("Quai 2"). Other numbers and ordinals are kept.
+func normalizeStopName(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	kept := make([]string, 0, len(words))
+	for i, word := range words {
+		if platformWords[word] || i > 0 && platformWords[words[i-1]] && isNumber(word) {
+			continue
+		}
+		// Single letters are platform names ("Bay B") more often than not
+		if runes := []rune(word); len(runes) == 1 && unicode.IsLetter(runes[0]) {
+			continue
+		}
+		kept = append(kept, word)
+	}
+	return strings.Join(kept, " ")
+}
+
+func isNumber(word string) bool {
+	_, err := strconv.Atoi(word)
+	return err == nil
+}
+
+// stopNameNumbers returns the words of a normalized name containing a digit ("42", "1st")
+func stopNameNumbers(normalized string) string {
+	numbers := make([]string, 0)
+	for _, word := range strings.Fields(normalized) {
+		if strings.IndexFunc(word, unicode.IsDigit) >= 0 {
+			numbers = append(numbers, word)
+		}
+	}
+	return strings.Join(numbers, " ")
+}
+
+// nameSimilarity returns 1 minus the Levenshtein distance of the normalized names divided by the longest
+// length, 0 when their numbers differ ("Main St & 1st" and "Main St & 2nd" are different places)
+func nameSimilarity(a, b string) float64 {
+	na, nb := normalizeStopName(a), normalizeStopName(b)
+	if stopNameNumbers(na) != stopNameNumbers(nb) {
+		return 0
+	}
+	ra, rb := []rune(na), []rune(nb)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	return 1 - float64(previous[len(rb)])/float64(longest)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Suggest returns the clusters of two stops or more, sorted by station id
+func (c *StopClustering) Suggest() []*StopCluster {
+	candidate := func(stop *Stop) bool {
+		return stop.LocationType == LocationTypeStop && stop.ParentStationId == ""
+	}
+
+	// Pairs of close stops with similar names, closest first
+	type pair struct {
+		a, b     *Stop
+		distance float64
+	}
+	pairs := make([]pair, 0)
+	groups := make(map[*Stop][]*Stop) // Members of each cluster, by its first stop
+	cluster := make(map[*Stop]*Stop)
+	for _, stop := range c.feed.Stops {
+		if !candidate(stop) {
+			continue
+		}
+		groups[stop], cluster[stop] = []*Stop{stop}, stop
+		for _, other := range c.feed.StopCollection.StopsByProximity(stop.Lat, stop.Lon, c.MaxDistance, candidate) {
+			if stop.Id < other.Id && nameSimilarity(stop.Name, other.Name) >= c.MinNameSimilarity {
+				pairs = append(pairs, pair{stop, other, geo.Haversine(stop.Lat, stop.Lon, other.Lat, other.Lon)})
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].distance != pairs[j].distance {
+			return pairs[i].distance < pairs[j].distance
+		}
+		if pairs[i].a.Id != pairs[j].a.Id {
+			return pairs[i].a.Id < pairs[j].a.Id
+		}
+		return pairs[i].b.Id < pairs[j].b.Id
+	})
+
+	// Complete linkage: clusters are merged when all their stops are close and have similar names, so
+	// that stops with similar names don't chain along a street
+	joinable := func(a, b []*Stop) bool {
+		for _, x := range a {
+			for _, y := range b {
+				if geo.Haversine(x.Lat, x.Lon, y.Lat, y.Lon) > c.MaxDistance || nameSimilarity(x.Name, y.Name) < c.MinNameSimilarity {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	for _, p := range pairs {
+		a, b := cluster[p.a], cluster[p.b]
+		if a == b || !joinable(groups[a], groups[b]) {
+			continue
+		}
+		for _, stop := range groups[b] {
+			cluster[stop] = a
+		}
+		groups[a] = append(groups[a], groups[b]...)
+		delete(groups, b)
+	}
+
+	clusters := make([]*StopCluster, 0)
+	for _, stops := range groups {
+		if len(stops) < 2 {
+			continue
+		}
+		clusters = append(clusters, c.cluster(stops))
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].Id < clusters[j].Id })
+	return clusters
+}
+
+// cluster builds the station suggested for stops: centroid, common name and an unused id
+func (c *StopClustering) cluster(stops []*Stop) *StopCluster {
+	sort.Slice(stops, func(i, j int) bool { return stops[i].Id < stops[j].Id })
+	cluster := &StopCluster{Stops: stops}
+	for _, stop := range stops {
+		cluster.Lat += stop.Lat / float64(len(stops))
+		cluster.Lon += stop.Lon / float64(len(stops))
+	}
+
+	// The words all the names start with, or the shortest name
+	common := strings.Fields(stops[0].Name)
+	for _, stop := range stops[1:] {
+		words := strings.Fields(stop.Name)
+		n := 0
+		for n < len(common) && n < len(words) && strings.EqualFold(common[n], words[n]) {
+			n++
+		}
+		common = common[:n]
+	}
+	for len(common) > 0 && platformWords[strings.ToLower(common[len(common)-1])] {
+		common = common[:len(common)-1]
+	}
+	cluster.Name = strings.Join(common, " ")
+	if cluster.Name == "" {
+		cluster.Name = stops[0].Name
+		for _, stop := range stops[1:] {
+			if len(stop.Name) < len(cluster.Name) {
+				cluster.Name = stop.Name
+			}
+		}
+	}
+
+	cluster.Id = c.IdPrefix + stops[0].Id
+	for n := 1; c.feed.Stops[cluster.Id] != nil; n++ {
+		cluster.Id = c.IdPrefix + stops[0].Id + ":" + strconv.Itoa(n)
+	}
+	return cluster
+}
+
+// Accept creates the stations of clusters (LocationTypeStation stops) and makes them the parent
+// station of the clusters' stops. Stops that got a parent station since the suggestion are left
+// alone. It returns the created stations.
+func (c *StopClustering) Accept(clusters ...*StopCluster) []*Stop {
+	stations := make([]*Stop, 0, len(clusters))
+	for _, cluster := range clusters {
+		if c.feed.Stops[cluster.Id] != nil {
+			continue
+		}
+		station := NewStop()
+		station.Id = cluster.Id
+		station.Name = cluster.Name
+		station.Lat = cluster.Lat
+		station.Lon = cluster.Lon
+		station.LocationType = LocationTypeStation
+		station.feed = c.feed
+		// SetStop has the stops index rebuilt
+		c.feed.StopCollection.SetStop(station.Id, station)
+		for _, stop := range cluster.Stops {
+			if stop.ParentStationId == "" {
+				stop.ParentStationId = station.Id
+			}
+		}
+		stations = append(stations, station)
+	}
+	return stations
+}
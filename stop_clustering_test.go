@@ -0,0 +1,48 @@
+package gtfs
+
+import (
+	"testing"
+)
+
+// addStopsAlongStreet adds a stop named after each of names to feed, 140 meters apart (just under the
+// default MaxDistance)
+func addStopsAlongStreet(feed *Feed, names []string) {
+	for i, name := range names {
+		stop := NewStop()
+		stop.Id, stop.Name = string(rune('A'+i)), name
+		stop.Lat, stop.Lon = 48.85+float64(i)*140/111195, 2.35
+		stop.feed = feed
+		feed.StopCollection.SetStop(stop.Id, stop)
+	}
+}
+
+// Stops at different intersections of a street aren't the same place
+func TestSuggestKeepsIntersectionsApart(t *testing.T) {
+	feed, _ := NewFeed("")
+	addStopsAlongStreet(feed, []string{"Main St & 1st", "Main St & 2nd", "Main St & 3rd", "Main St & 4th", "Main St & 5th", "Main St & 6th"})
+
+	if clusters := NewStopClustering(feed).Suggest(); len(clusters) != 0 {
+		t.Errorf("expected no clusters, got %d", len(clusters))
+	}
+}
+
+// Stops of the same name along a street are only grouped with their close neighbours
+func TestSuggestDoesNotChainStops(t *testing.T) {
+	feed, _ := NewFeed("")
+	addStopsAlongStreet(feed, []string{"Main St", "Main St", "Main St", "Main St", "Main St", "Main St"})
+
+	clustering := NewStopClustering(feed)
+	clusters := clustering.Suggest()
+	if len(clusters) != 3 {
+		t.Errorf("expected 3 clusters of 2 stops, got %d", len(clusters))
+	}
+	for _, cluster := range clusters {
+		for _, a := range cluster.Stops {
+			for _, b := range cluster.Stops {
+				if d := a.DistanceToCoordinate(b.Lat, b.Lon); d > clustering.MaxDistance {
+					t.Errorf("%s: %s and %s are %.0f meters apart", cluster.Id, a.Id, b.Id, d)
+				}
+			}
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package gtfs
 
 import (
+	"github.com/nicolaspaton/gogtfs/geo"
 	"math"
 	"sort"
+	"sync"
 )
 
 type StopDistanceResult struct {
@@ -20,6 +22,7 @@ func (s StopDistanceResults) Less(i, j int) bool { return s[i].Distance < s[j].D
 type StopCollection struct {
 	Stops  map[string]*Stop
 	qt     *QuadTree
+	qtLock *sync.Mutex // Guards qt, built lazily by concurrent queries, and the bounds. Stops is only written while loading
 	maxLat float64
 	maxLon float64
 	minLat float64
@@ -30,6 +33,7 @@ func NewStopCollection() StopCollection {
 	return StopCollection{
 		Stops:  make(map[string]*Stop),
 		qt:     nil,
+		qtLock: new(sync.Mutex),
 		maxLat: math.Inf(-1),
 		maxLon: math.Inf(-1),
 		minLat: math.Inf(1),
@@ -46,11 +50,34 @@ func (c *StopCollection) Stop(id string) (stop *Stop) {
 }
 
 func (c *StopCollection) SetStop(id string, stop *Stop) {
+	c.qtLock.Lock()
+	defer c.qtLock.Unlock()
 	c.Stops[id] = stop
 	c.maxLat = math.Max(c.maxLat, stop.Lat)
 	c.maxLon = math.Max(c.maxLon, stop.Lon)
 	c.minLat = math.Min(c.minLat, stop.Lat)
 	c.minLon = math.Min(c.minLon, stop.Lon)
+	c.qt = nil // Rebuilt on next query
+}
+
+// Bounds returns the bounding box of the stops, nil if there are none
+func (c *StopCollection) Bounds() *BoundingBox {
+	c.qtLock.Lock()
+	defer c.qtLock.Unlock()
+	if len(c.Stops) == 0 {
+		return nil
+	}
+	return &BoundingBox{MinLat: c.minLat, MinLon: c.minLon, MaxLat: c.maxLat, MaxLon: c.maxLon}
+}
+
+// quadtree returns the spatial index of the stops, building it on first use
+func (c *StopCollection) quadtree() *QuadTree {
+	c.qtLock.Lock()
+	defer c.qtLock.Unlock()
+	if c.qt == nil {
+		c.createQuadtree()
+	}
+	return c.qt
 }
 
 func (c *StopCollection) createQuadtree() {
@@ -69,23 +96,62 @@ func (c *StopCollection) StopsByName(name string) (results []*Stop) {
 	return
 }
 
-func (c *StopCollection) StopsByProximity(lat, lng, radius float64) (results []*Stop) {
-	if c.qt == nil {
-		c.createQuadtree()
-	}
-	return c.qt.SearchByProximity(lat, lng, radius)
+// StopsByProximity returns the stops within radius meters of lat, lng, that pass all filters
+func (c *StopCollection) StopsByProximity(lat, lng, radius float64, filters ...StopFilter) (results []*Stop) {
+	return c.quadtree().SearchByProximity(lat, lng, radius, filters...)
 }
 
-func (c *StopCollection) StopDistancesByProximity(lat, lng, radius float64) (results StopDistanceResults) {
-	stops := c.StopsByProximity(lat, lng, radius)
+func (c *StopCollection) StopDistancesByProximity(lat, lng, radius float64, filters ...StopFilter) (results StopDistanceResults) {
+	stops := c.StopsByProximity(lat, lng, radius, filters...)
 	stopdistances := make(StopDistanceResults, len(stops))
 	for i, stop := range stops {
-		stopdistances[i] = &StopDistanceResult{Stop: stop, Distance: stop.DistanceToCoordinate(lat, lng)}
+		stopdistances[i] = &StopDistanceResult{Stop: stop, Distance: geo.Haversine(lat, lng, stop.Lat, stop.Lon)}
 	}
 	sort.Sort(stopdistances)
 	return stopdistances
 }
 
+// NearestStops returns the k stops closest to lat, lng that pass all filters, closest first
+func (c *StopCollection) NearestStops(lat, lng float64, k int, filters ...StopFilter) StopDistanceResults {
+	return c.quadtree().SearchNearest(lat, lng, k, filters...)
+}
+
+// StopsInPolygon returns the stops inside polygon that pass all filters
+func (c *StopCollection) StopsInPolygon(polygon []Coordinate, filters ...StopFilter) []*Stop {
+	return c.quadtree().SearchPolygon(polygon, filters...)
+}
+
+// StopsAlongLine returns the stops within radius meters of the polyline line that pass all filters
+func (c *StopCollection) StopsAlongLine(line []Coordinate, radius float64, filters ...StopFilter) []*Stop {
+	return c.quadtree().SearchLineBuffer(line, radius, filters...)
+}
+
+// LocationTypeFilter selects the stops with one of the location types (see LocationType constants)
+func LocationTypeFilter(locationTypes ...byte) StopFilter {
+	return func(stop *Stop) bool {
+		for _, locationType := range locationTypes {
+			if stop.LocationType == locationType {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RouteTypeFilter selects the stops served by at least one route of the route types (see Route.Type constants)
+func RouteTypeFilter(routeTypes ...byte) StopFilter {
+	return func(stop *Stop) bool {
+		for _, route := range stop.Routes() {
+			for _, routeType := range routeTypes {
+				if route.Type == routeType {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
 func (c *StopCollection) RandomStop() (stopX *Stop) {
 	stopsCount := 0
 	for _, stopX = range c.Stops {
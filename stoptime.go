@@ -118,6 +118,14 @@ type StopTime struct {
 	// The units used for shape_dist_traveled in the stop_times.txt file must match the units that are used for this field in the shapes.txt file.
 	ShapeDistTraveled float64
 
+	hasShapeDistTraveled bool // shape_dist_traveled was provided (or computed)
+	hasArrivalTime       bool // arrival_time is known, false for interpolated times
+	hasDepartureTime     bool // departure_time is known, false for interpolated times
+
+	// trip_id and stop_id as found in stop_times.txt, Trip and Stop are nil when they are unknown
+	tripId string
+	stopId string
+
 	feed *Feed
 }
 
@@ -126,23 +134,33 @@ func (st *StopTime) setField(fieldName, val string) {
 	switch fieldName {
 	case "trip_id":
 		st.Trip = st.feed.Trips[val]
+		st.tripId = val
 		break
 	case "arrival_time":
+		if val == "" { // Not a time point, see Trip.interpolateStopTimes
+			break
+		}
 		v, err := timeOfDayStringToSeconds(val)
 		if err != nil {
 			panic(err.Error() + val)
 		}
 		st.ArrivalTime = v
+		st.hasArrivalTime = true
 		break
 	case "departure_time":
+		if val == "" {
+			break
+		}
 		v, err := timeOfDayStringToSeconds(val)
 		if err != nil {
 			panic(err)
 		}
 		st.DepartureTime = v
+		st.hasDepartureTime = true
 		break
 	case "stop_id":
 		st.Stop = st.feed.StopCollection.Stops[val]
+		st.stopId = val
 		break
 	case "stop_sequence":
 		v, _ := strconv.Atoi(val)
@@ -176,8 +194,9 @@ func (st *StopTime) setField(fieldName, val string) {
 		}
 		break
 	case "shape_dist_traveled":
-		v, _ := strconv.ParseFloat(val, 64) // Should panic on error !
+		v, err := strconv.ParseFloat(val, 64) // Should panic on error !
 		st.ShapeDistTraveled = v
+		st.hasShapeDistTraveled = err == nil
 		break
 
 		// 
@@ -0,0 +1,355 @@
+package gtfs
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Selection of the entities kept by a FeedSubset, nil selects all of them (see also StopFilter)
+type AgencyFilter func(*Agency) bool
+type RouteFilter func(*Route) bool
+type TripFilter func(*Trip) bool
+
+// AgencyIdFilter selects the agencies with one of the ids
+func AgencyIdFilter(ids ...string) AgencyFilter {
+	return func(agency *Agency) bool {
+		for _, id := range ids {
+			if agency.Id == id {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RouteIdFilter selects the routes with one of the ids
+func RouteIdFilter(ids ...string) RouteFilter {
+	return func(route *Route) bool {
+		for _, id := range ids {
+			if route.Id == id {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RoutesOfTypeFilter selects the routes of one of the route types (see Route.Type constants)
+func RoutesOfTypeFilter(routeTypes ...byte) RouteFilter {
+	return func(route *Route) bool {
+		for _, routeType := range routeTypes {
+			if route.Type == routeType {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// BoundingBoxFilter selects the stops inside a bounding box
+func BoundingBoxFilter(minLat, minLon, maxLat, maxLon float64) StopFilter {
+	return func(stop *Stop) bool {
+		return stop.Lat >= minLat && stop.Lat <= maxLat && stop.Lon >= minLon && stop.Lon <= maxLon
+	}
+}
+
+// FeedSubset cuts a feed down to the trips of the selected agencies and routes running in a date
+// window, and to the stops they serve. Stop times at stops that are not selected are removed, trips
+// left with less than two stop times too. Everything no longer referenced is pruned: agencies
+// without routes, routes without trips, stops (parent stations, and the entrances and nodes of kept
+// stations, are kept), shapes, services, transfers, pathways and fares. Calendars are trimmed to the
+// window.
+type FeedSubset struct {
+	Agencies AgencyFilter
+	Routes   RouteFilter
+	Trips    TripFilter
+	Stops    StopFilter
+
+	// Date window, days included. Zero values for no window.
+	Start time.Time
+	End   time.Time
+
+	feed *Feed
+}
+
+func NewFeedSubset(f *Feed) (s *FeedSubset) {
+	s = &FeedSubset{}
+	s.feed = f
+	return
+}
+
+// window returns the first and last days of the window (YYYYMMDD), 0 and 99999999 without
+func (s *FeedSubset) window() (start, end int, err error) {
+	start, end = 0, 99999999
+	if !s.Start.IsZero() {
+		start = s.Start.Year()*10000 + int(s.Start.Month())*100 + s.Start.Day()
+	}
+	if !s.End.IsZero() {
+		end = s.End.Year()*10000 + int(s.End.Month())*100 + s.End.Day()
+	}
+	if end < start {
+		err = errors.New("The end of the date window is before its start")
+	}
+	return
+}
+
+// Run returns the subset, a new feed
+func (s *FeedSubset) Run() (*Feed, error) {
+	start, end, err := s.window()
+	if err != nil {
+		return nil, err
+	}
+	feed := s.feed
+	subset, _ := NewFeed("")
+	subset.Loaded = true
+
+	s.trimServices(subset, start, end)
+
+	agencies := make(map[*Agency]bool)
+	for _, agency := range feed.Agencies {
+		agencies[agency] = s.Agencies == nil || s.Agencies(agency)
+	}
+	routes := make(map[*Route]*Route)
+	for _, route := range feed.Routes {
+		agency := route.Agency
+		if agency == nil {
+			agency = feed.singleAgency()
+		}
+		if (agency == nil && s.Agencies != nil) || (agency != nil && !agencies[agency]) {
+			continue
+		}
+		if s.Routes == nil || s.Routes(route) {
+			routes[route] = nil
+		}
+	}
+
+	// Trips, with the stops they serve
+	stops := make(map[*Stop]*Stop)
+	services := make(map[string]bool)
+	shapes := make(map[string]bool)
+	for _, id := range sortedTripIds(feed.Trips) {
+		trip := feed.Trips[id]
+		if _, ok := routes[trip.Route]; !ok || len(subset.ServiceDates(trip.serviceId)) == 0 {
+			continue
+		}
+		if s.Trips != nil && !s.Trips(trip) {
+			continue
+		}
+		stopTimes := make([]*StopTime, 0, len(trip.StopTimes))
+		for _, st := range stopTimesOf(trip) {
+			if st.Stop != nil && (s.Stops == nil || s.Stops(st.Stop)) {
+				stopTimes = append(stopTimes, st)
+			}
+		}
+		if len(stopTimes) < 2 {
+			continue
+		}
+
+		if routes[trip.Route] == nil {
+			route := *trip.Route
+			route.feed = subset
+			routes[trip.Route] = &route
+			subset.Routes[route.Id] = &route
+		}
+		copied := *trip
+		copied.Route = routes[trip.Route]
+		copied.feed = subset
+		copied.StopTimes = make([]*StopTime, len(stopTimes))
+		for i, st := range stopTimes {
+			copiedStopTime := *st
+			copiedStopTime.Trip = &copied
+			copiedStopTime.Stop = s.copyStop(subset, st.Stop, stops)
+			copiedStopTime.feed = subset
+			copied.StopTimes[i] = &copiedStopTime
+			copiedStopTime.Stop.StopTimes = append(copiedStopTime.Stop.StopTimes, &copiedStopTime)
+		}
+		copied.Frequencies = make([]Frequency, len(trip.Frequencies))
+		for i, freq := range trip.Frequencies {
+			freq.Trip = &copied
+			freq.feed = subset
+			copied.Frequencies[i] = freq
+		}
+		copied.calculateDayTimeRange() // The first or last stops may have been dropped
+		subset.StopTimesCount += len(copied.StopTimes)
+		subset.FrequenciesCount += len(copied.Frequencies)
+		subset.Trips[copied.Id] = &copied
+		services[trip.serviceId] = true
+		if trip.ShapeId != "" {
+			shapes[trip.ShapeId] = true
+		}
+	}
+
+	// Parent stations, then the entrances, nodes and boarding areas of kept stations and platforms
+	for changed := true; changed; {
+		changed = false
+		for _, stop := range feed.sortedStops() {
+			if stops[stop] != nil {
+				if parent := feed.StopCollection.Stop(stop.ParentStationId); parent != nil && stops[parent] == nil {
+					s.copyStop(subset, parent, stops)
+					changed = true
+				}
+			} else if stop.LocationType != LocationTypeStop && (s.Stops == nil || s.Stops(stop)) {
+				if parent := feed.StopCollection.Stop(stop.ParentStationId); parent != nil && stops[parent] != nil {
+					s.copyStop(subset, stop, stops)
+					changed = true
+				}
+			}
+		}
+	}
+	for _, stop := range feed.sortedStops() {
+		if stops[stop] != nil {
+			subset.StopCollection.SetStop(stop.Id, stops[stop])
+		}
+	}
+	s.copyStopLinks(subset, stops)
+
+	copiedAgencies := make(map[*Agency]*Agency)
+	for _, route := range subset.Routes {
+		agency := route.Agency
+		if agency == nil {
+			agency = feed.singleAgency()
+		}
+		if agency != nil && copiedAgencies[agency] == nil {
+			copied := *agency
+			copied.feed = subset
+			copiedAgencies[agency] = &copied
+			subset.Agencies[copied.Id] = &copied
+		}
+		if route.Agency != nil {
+			route.Agency = copiedAgencies[route.Agency]
+		}
+	}
+	for _, id := range subset.sortedServiceIds() {
+		if !services[id] {
+			delete(subset.Calendars, id)
+			delete(subset.CalendarDates, id)
+		}
+	}
+	for id := range shapes {
+		shape := feed.Shapes[id]
+		if shape == nil {
+			continue
+		}
+		copied := &Shape{Id: id, Color: shape.Color, Points: make([]*ShapePoint, len(shape.Points))}
+		for i, point := range shape.Points {
+			copiedPoint := *point
+			copiedPoint.feed = subset
+			copied.Points[i] = &copiedPoint
+		}
+		subset.Shapes[id] = copied
+	}
+	s.copyFares(subset)
+	return subset, nil
+}
+
+// trimServices copies the calendars and calendar dates of the window to the subset
+func (s *FeedSubset) trimServices(subset *Feed, start, end int) {
+	for _, id := range s.feed.sortedServiceIds() {
+		if calendar := s.feed.Calendars[id]; calendar != nil {
+			copied := *calendar
+			if copied.StartDate < start {
+				copied.StartDate = start
+			}
+			if copied.EndDate > end {
+				copied.EndDate = end
+			}
+			copied.feed = subset
+			if copied.StartDate <= copied.EndDate {
+				subset.Calendars[id] = &copied
+			}
+		}
+		for _, cd := range s.feed.CalendarDates[id] {
+			if cd.Date >= start && cd.Date <= end {
+				copied := *cd
+				copied.feed = subset
+				subset.CalendarDates[id] = append(subset.CalendarDates[id], &copied)
+			}
+		}
+	}
+}
+
+// copyStop returns the copy of stop in the subset, without its stop times, transfers and pathways
+func (s *FeedSubset) copyStop(subset *Feed, stop *Stop, stops map[*Stop]*Stop) *Stop {
+	if stops[stop] == nil {
+		copied := *stop
+		copied.Transfers = make(map[string]*Transfer)
+		copied.Pathways = nil
+		copied.StopTimes = nil
+		copied.feed = subset
+		stops[stop] = &copied
+	}
+	return stops[stop]
+}
+
+// copyStopLinks copies the transfers and pathways between kept stops
+func (s *FeedSubset) copyStopLinks(subset *Feed, stops map[*Stop]*Stop) {
+	pathways := make(map[*Pathway]bool)
+	for _, stop := range s.feed.sortedStops() {
+		from := stops[stop]
+		if from == nil {
+			continue
+		}
+		for toId, transfer := range stop.Transfers {
+			if subset.StopCollection.Stop(toId) != nil {
+				copied := *transfer
+				copied.feed = subset
+				from.Transfers[toId] = &copied
+				subset.TranfersCount++
+			}
+		}
+		for _, pathway := range stop.Pathways {
+			if pathways[pathway] {
+				continue
+			}
+			pathways[pathway] = true
+			fromStop, toStop := subset.StopCollection.Stop(pathway.FromStopId), subset.StopCollection.Stop(pathway.ToStopId)
+			if fromStop == nil || toStop == nil {
+				continue
+			}
+			copied := *pathway
+			copied.feed = subset
+			fromStop.Pathways = append(fromStop.Pathways, &copied)
+			if toStop != fromStop {
+				toStop.Pathways = append(toStop.Pathways, &copied)
+			}
+		}
+	}
+}
+
+// copyFares keeps the fare rules whose route and zones are still in the subset, with their fare
+// attributes, and the fare attributes without rules
+func (s *FeedSubset) copyFares(subset *Feed) {
+	zones := make(map[string]bool)
+	for _, stop := range subset.StopCollection.Stops {
+		zones[stop.ZoneId] = true
+	}
+	zoneKept := func(id string) bool { return id == "" || zones[id] }
+	fareIds := make(map[string]bool)
+	withRules := make(map[string]bool)
+	for _, rule := range s.feed.FareRules {
+		withRules[rule.Id] = true
+		if rule.RouteId != "" && subset.Routes[rule.RouteId] == nil {
+			continue
+		}
+		if !zoneKept(rule.OriginId) || !zoneKept(rule.DestinationId) || !zoneKept(rule.ContainsId) {
+			continue
+		}
+		copied := *rule
+		copied.feed = subset
+		subset.FareRules = append(subset.FareRules, &copied)
+		fareIds[rule.Id] = true
+	}
+	ids := make([]string, 0, len(s.feed.FareAttributes))
+	for id := range s.feed.FareAttributes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if fareIds[id] || !withRules[id] {
+			copied := *s.feed.FareAttributes[id]
+			copied.feed = subset
+			subset.FareAttributes[id] = &copied
+		}
+	}
+}
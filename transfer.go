@@ -66,11 +66,11 @@ func (t *Transfer) setField(fieldName, val string) {
 	case "to_stop_id":
 		t.ToStopId = val
 		break
-	case "route_long_name":
+	case "min_transfer_time":
 		v, _ := strconv.Atoi(val) // Should panic on error !
 		t.MinTransferTime = v
 		break
-	case "route_type":
+	case "transfer_type":
 		v, _ := strconv.Atoi(val) // Should panic on error !
 		if v == 0 {
 			t.TransferType = TransferRecommended
@@ -0,0 +1,227 @@
+package gtfs
+
+import (
+	"context"
+	"encoding/csv"
+	"github.com/nicolaspaton/gogtfs/geo"
+	"io"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Unreachable is the TravelTimeMatrix value for destinations that can't be reached within MaxDuration
+const Unreachable = -1
+
+type MatrixPoint struct {
+	Id  string
+	Lat float64
+	Lon float64
+}
+
+// TravelTimeMatrix computes the travel times between every origin and every destination for
+// departures sampled every Step seconds across a departure window, reporting the minimum and
+// the median travel time of each pair. Origins are processed in parallel.
+type TravelTimeMatrix struct {
+	Origins      []*MatrixPoint
+	Destinations []*MatrixPoint
+
+	Departure *time.Time // Start of the departure window
+	Window    uint       // In seconds. Default: 60*60 (1 hour)
+	Step      uint       // In seconds. Default: 60 (1 min)
+
+	MaxDuration     uint    // In seconds. Default: 60*60*2 (2 hours)
+	WalkSpeed       float64 // In meters per second. Default: 1.3
+	MaxWalkDistance float64 // In meters, for access, egress and transfers. Default: 500
+
+	Accessibility *AccessibilityProfile // Default: nil (no restriction)
+
+	Workers int // Default: runtime.NumCPU()
+
+	// Filled by Run, indexed [origin][destination], in seconds (or Unreachable)
+	Min    [][]int
+	Median [][]int
+
+	feed *Feed
+}
+
+func NewTravelTimeMatrix(f *Feed) (m *TravelTimeMatrix) {
+	m = &TravelTimeMatrix{}
+	m.Window = 60 * 60
+	m.Step = 60
+	m.MaxDuration = 60 * 60 * 2
+	m.WalkSpeed = 1.3
+	m.MaxWalkDistance = 500
+	m.Workers = runtime.NumCPU()
+	m.feed = f
+	return
+}
+
+// Run computes the matrix without time limit. See RunContext.
+func (m *TravelTimeMatrix) Run() error {
+	return m.RunContext(context.Background())
+}
+
+func (m *TravelTimeMatrix) RunContext(ctx context.Context) error {
+	if m.Departure == nil {
+		return &ItineraryError{Kind: ItineraryInvalidQuery, Message: "Departure is required"}
+	}
+	if m.Step == 0 {
+		return &ItineraryError{Kind: ItineraryInvalidQuery, Message: "Step must be positive"}
+	}
+	if m.WalkSpeed <= 0 {
+		return &ItineraryError{Kind: ItineraryInvalidQuery, Message: "WalkSpeed must be positive"}
+	}
+
+	// Shared by all the workers, read only. A window crossing midnight needs the following day too.
+	end := m.Departure.Add(time.Duration(m.Window) * time.Second)
+	twoDays := end.Format("20060102") != m.Departure.Format("20060102")
+	var conns connections
+	if twoDays {
+		conns = m.feed.connectionsOnTwoDays(m.Departure)
+	} else {
+		conns = m.feed.connectionsOn(m.Departure)
+	}
+	egress := make([][]footpath, len(m.Destinations))
+	for i, destination := range m.Destinations {
+		egress[i] = make([]footpath, 0)
+		for _, stop := range m.feed.StopCollection.StopsByProximity(destination.Lat, destination.Lon, m.MaxWalkDistance) {
+			d := geo.Haversine(destination.Lat, destination.Lon, stop.Lat, stop.Lon)
+			if d <= m.MaxWalkDistance && m.Accessibility.AllowsStop(stop) {
+				egress[i] = append(egress[i], footpath{stop, d, uint(d / m.WalkSpeed)})
+			}
+		}
+	}
+
+	m.Min = make([][]int, len(m.Origins))
+	m.Median = make([][]int, len(m.Origins))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := m.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	origins := make(chan int)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := NewReachability(m.feed)
+			r.MaxDuration = m.MaxDuration
+			r.WalkSpeed = m.WalkSpeed
+			r.MaxWalkDistance = m.MaxWalkDistance
+			r.Accessibility = m.Accessibility
+			r.useConnections(conns, m.Departure, twoDays)
+			for index := range origins {
+				if err := m.computeOrigin(ctx, r, index, egress); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+feeding:
+	for index := range m.Origins {
+		select {
+		case origins <- index:
+		case <-ctx.Done():
+			break feeding
+		}
+	}
+	close(origins)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+	if ctx.Err() != nil {
+		return contextError(ctx, "travel time matrix interrupted")
+	}
+	return nil
+}
+
+// computeOrigin fills the Min and Median rows of one origin, reusing r between departures
+func (m *TravelTimeMatrix) computeOrigin(ctx context.Context, r *Reachability, index int, egress [][]footpath) error {
+	origin := m.Origins[index]
+	samples := make([][]int, len(m.Destinations))
+	for departure := uint(0); departure <= m.Window; departure += m.Step {
+		t := m.Departure.Add(time.Duration(departure) * time.Second)
+		r.Lat, r.Lon, r.Departure = origin.Lat, origin.Lon, &t
+		if err := r.RunContext(ctx); err != nil {
+			return err
+		}
+		for d, destination := range m.Destinations {
+			best := Unreachable
+			if walk := geo.Haversine(origin.Lat, origin.Lon, destination.Lat, destination.Lon); walk <= m.MaxWalkDistance {
+				best = int(walk / m.WalkSpeed)
+			}
+			for _, path := range egress[d] {
+				if duration, reached := r.TravelTime(path.to); reached && duration+path.duration <= m.MaxDuration {
+					if best == Unreachable || int(duration+path.duration) < best {
+						best = int(duration + path.duration)
+					}
+				}
+			}
+			samples[d] = append(samples[d], best)
+		}
+	}
+
+	m.Min[index] = make([]int, len(m.Destinations))
+	m.Median[index] = make([]int, len(m.Destinations))
+	for d, values := range samples {
+		// Unreachable samples count as infinitely long trips
+		sort.Slice(values, func(i, j int) bool {
+			if values[i] == Unreachable || values[j] == Unreachable {
+				return values[j] == Unreachable && values[i] != Unreachable
+			}
+			return values[i] < values[j]
+		})
+		m.Min[index][d] = values[0]
+		// Mean of the two middle values for an even number of samples, unreachable if one of them is
+		middle := len(values) / 2
+		switch {
+		case len(values)%2 == 1 || values[middle] == Unreachable:
+			m.Median[index][d] = values[middle]
+		default:
+			m.Median[index][d] = int(median(values[middle-1 : middle+1]))
+		}
+	}
+	return nil
+}
+
+// WriteCSV writes one row per origin/destination pair: origin_id,destination_id,min,median.
+// Durations are in seconds and left empty for unreachable pairs.
+func (m *TravelTimeMatrix) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"origin_id", "destination_id", "min", "median"}); err != nil {
+		return err
+	}
+	format := func(v int) string {
+		if v == Unreachable {
+			return ""
+		}
+		return strconv.Itoa(v)
+	}
+	for o, origin := range m.Origins {
+		if m.Min == nil || m.Min[o] == nil {
+			continue
+		}
+		for d, destination := range m.Destinations {
+			if err := writer.Write([]string{origin.Id, destination.Id, format(m.Min[o][d]), format(m.Median[o][d])}); err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -2,6 +2,7 @@ package gtfs
 
 import (
 	"fmt"
+	"github.com/nicolaspaton/gogtfs/geo"
 	"strconv"
 	"time"
 	// "log"
@@ -67,6 +68,14 @@ type Trip struct {
 	// from the shapes.txt file. The shapes.txt file allows you to define how a line should be drawn on the map to represent a trip.
 	ShapeId string
 
+	// wheelchair_accessible - Optional. The wheelchair_accessible field indicates whether the vehicle used on this trip
+	// can accommodate riders in wheelchairs. Valid values for this field are:
+	// 		0 (or empty) - There is no accessibility information for the trip.
+	// 		1 - The vehicle being used on this particular trip can accommodate at least one rider in a wheelchair.
+	// 		2 - No riders in wheelchairs can be accommodated on this trip.
+	// See Wheelchair constants
+	WheelchairAccessible byte
+
 	//
 	DayRange
 
@@ -74,6 +83,8 @@ type Trip struct {
 
 	Frequencies []Frequency
 
+	routeId string // route_id as found in trips.txt, Route is nil when it is unknown
+
 	feed *Feed
 }
 
@@ -162,7 +173,7 @@ func (t *Trip) AddStopTime(newStopTime *StopTime) {
 			t.StopTimes = append(t.StopTimes, newStopTime)
 		} else {
 			// Otherwise rebuild new array, inserting the new stop time at right time
-			newStopTimes := make([]*StopTime, stopTimesLength+1)
+			newStopTimes := make([]*StopTime, 0, stopTimesLength+1)
 			hasAppendedNewStopTime := false
 			for _, existingStopTime := range t.StopTimes {
 				if existingStopTime != nil {
@@ -173,6 +184,9 @@ func (t *Trip) AddStopTime(newStopTime *StopTime) {
 					newStopTimes = append(newStopTimes, existingStopTime)
 				}
 			}
+			if !hasAppendedNewStopTime { // Same stop_sequence as the last one
+				newStopTimes = append(newStopTimes, newStopTime)
+			}
 			t.StopTimes = newStopTimes
 		}
 	}
@@ -214,6 +228,50 @@ func (t *Trip) calculateDayTimeRange() {
 
 }
 
+// interpolateStopTimes completes the stop times without arrival or departure time (stops that aren't
+// time points): a missing time is copied from the other one, stop times without any are interpolated
+// between the surrounding time points, in proportion to the distance between stops.
+func (t *Trip) interpolateStopTimes() {
+	previous := -1 // Index of the last time point
+	for i, st := range t.StopTimes {
+		if st == nil {
+			continue
+		}
+		if st.hasArrivalTime && !st.hasDepartureTime {
+			st.DepartureTime, st.hasDepartureTime = st.ArrivalTime, true
+		} else if st.hasDepartureTime && !st.hasArrivalTime {
+			st.ArrivalTime, st.hasArrivalTime = st.DepartureTime, true
+		}
+		if !st.hasArrivalTime {
+			continue
+		}
+		// Times going backwards are left alone, the validator reports them
+		if previous >= 0 && i-previous > 1 && st.ArrivalTime >= t.StopTimes[previous].DepartureTime {
+			// Cumulated distances from the previous time point
+			distances := make([]float64, i-previous+1)
+			for j := previous + 1; j <= i; j++ {
+				distances[j-previous] = distances[j-previous-1]
+				a, b := t.StopTimes[j-1], t.StopTimes[j]
+				if a != nil && b != nil && a.Stop != nil && b.Stop != nil {
+					distances[j-previous] += geo.Haversine(a.Stop.Lat, a.Stop.Lon, b.Stop.Lat, b.Stop.Lon)
+				}
+			}
+			from, to := float64(t.StopTimes[previous].DepartureTime), float64(st.ArrivalTime)
+			for j := previous + 1; j < i; j++ {
+				ratio := float64(j-previous) / float64(i-previous)
+				if total := distances[len(distances)-1]; total > 0 {
+					ratio = distances[j-previous] / total
+				}
+				if untimed := t.StopTimes[j]; untimed != nil {
+					untimed.ArrivalTime = uint(from + (to-from)*ratio)
+					untimed.DepartureTime = untimed.ArrivalTime
+				}
+			}
+		}
+		previous = i
+	}
+}
+
 func (t *Trip) HasShape() bool {
 	return t.ShapeId != "" && t.feed.Shapes[t.ShapeId] != nil
 }
@@ -252,6 +310,7 @@ func (t *Trip) setField(fieldName, val string) {
 		break
 	case "route_id":
 		t.Route = t.feed.Routes[val]
+		t.routeId = val
 		break
 	case "service_id":
 		t.serviceId = val
@@ -276,6 +335,16 @@ func (t *Trip) setField(fieldName, val string) {
 	case "shape_id":
 		t.ShapeId = val
 		break
+	case "wheelchair_accessible":
+		v, _ := strconv.Atoi(val) // Should panic on error !
+		if v == 1 {
+			t.WheelchairAccessible = WheelchairAccessible
+		} else if v == 2 {
+			t.WheelchairAccessible = WheelchairInaccessible
+		} else {
+			t.WheelchairAccessible = WheelchairUnknown
+		}
+		break
 	}
 }
 
@@ -0,0 +1,242 @@
+package gtfs
+
+import (
+	"sort"
+)
+
+// TripDuplicate is a trip with the same route, service, stops and times as another one, the times
+// possibly shifted by a few seconds
+type TripDuplicate struct {
+	Trip     *Trip
+	Original *Trip // The trip kept when removing duplicates, departing first
+	Shift    int   // In seconds, first departure of Trip minus the one of Original
+	Exact    bool  // All the times and frequencies are the same, and so are the stop_times.txt rows
+}
+
+// BlockOverlap is a pair of trips of the same block running at the same time on a day both run
+type BlockOverlap struct {
+	BlockId string
+	First   *Trip // Departs first
+	Second  *Trip
+	Overlap uint // In seconds
+	Date    int  // First day both trips run, YYYYMMDD
+}
+
+// FrequencyOverlap is a pair of frequencies.txt periods of a trip overlapping in time
+type FrequencyOverlap struct {
+	Trip   *Trip
+	First  Frequency // Starts first
+	Second Frequency
+}
+
+// TripOverlapAnalyzer finds trips that are the same service listed twice (typically under different
+// ids in merged exports), trips of a block running at the same time and overlapping frequencies.
+type TripOverlapAnalyzer struct {
+	MaxShift uint // In seconds, trips whose times all differ by at most MaxShift are duplicates. Default: 60
+
+	feed *Feed
+}
+
+func NewTripOverlapAnalyzer(f *Feed) (a *TripOverlapAnalyzer) {
+	a = &TripOverlapAnalyzer{}
+	a.MaxShift = 60
+	a.feed = f
+	return
+}
+
+// stopTimesOf returns the stop times of trip, leaving nil entries out
+func stopTimesOf(trip *Trip) []*StopTime {
+	stopTimes := make([]*StopTime, 0, len(trip.StopTimes))
+	for _, st := range trip.StopTimes {
+		if st != nil {
+			stopTimes = append(stopTimes, st)
+		}
+	}
+	return stopTimes
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// compareTrips returns whether the times of b are all within maxShift of the ones of a (trips having
+// the same stops), and if they are all the same
+func compareTrips(a, b []*StopTime, aTrip, bTrip *Trip, maxShift int) (duplicate, exact bool) {
+	if len(a) != len(b) || len(aTrip.Frequencies) != len(bTrip.Frequencies) {
+		return false, false
+	}
+	exact = true
+	for i := range aTrip.Frequencies {
+		fa, fb := aTrip.Frequencies[i], bTrip.Frequencies[i]
+		if fa.HeadwaySecs != fb.HeadwaySecs || absInt(int(fa.StartTime)-int(fb.StartTime)) > maxShift || absInt(int(fa.EndTime)-int(fb.EndTime)) > maxShift {
+			return false, false
+		}
+		exact = exact && fa.StartTime == fb.StartTime && fa.EndTime == fb.EndTime
+	}
+	for i := range a {
+		arrival := absInt(int(b[i].ArrivalTime) - int(a[i].ArrivalTime))
+		departure := absInt(int(b[i].DepartureTime) - int(a[i].DepartureTime))
+		if arrival > maxShift || departure > maxShift {
+			return false, false
+		}
+		exact = exact && arrival == 0 && departure == 0
+	}
+	return true, exact
+}
+
+// Duplicates returns the trips duplicating another one, by trip id
+func (a *TripOverlapAnalyzer) Duplicates() []*TripDuplicate {
+	// Same service and pattern (route, direction and stops)
+	groups := make(map[string][]*Trip)
+	stopTimes := make(map[*Trip][]*StopTime)
+	for _, trip := range a.feed.Trips {
+		if served := servedStopTimes(trip); len(served) > 0 {
+			key := trip.serviceId + "\x00" + patternKey(trip)
+			groups[key] = append(groups[key], trip)
+			stopTimes[trip] = served
+		}
+	}
+
+	duplicates := make([]*TripDuplicate, 0)
+	for _, trips := range groups {
+		if len(trips) < 2 {
+			continue
+		}
+		departure := func(trip *Trip) int {
+			return int(stopTimes[trip][0].DepartureTime)
+		}
+		sort.Slice(trips, func(i, j int) bool {
+			if departure(trips[i]) != departure(trips[j]) {
+				return departure(trips[i]) < departure(trips[j])
+			}
+			return trips[i].Id < trips[j].Id
+		})
+
+		duplicated := make(map[*Trip]bool)
+		for i, trip := range trips {
+			for j := i - 1; j >= 0 && departure(trip)-departure(trips[j]) <= int(a.MaxShift); j-- {
+				original := trips[j]
+				if duplicated[original] {
+					continue
+				}
+				if duplicate, exact := compareTrips(stopTimes[original], stopTimes[trip], original, trip, int(a.MaxShift)); duplicate {
+					// Rows at unknown stops aren't compared, the trips differ if they don't have the same number
+					exact = exact && len(stopTimesOf(original)) == len(stopTimesOf(trip))
+					duplicated[trip] = true
+					duplicates = append(duplicates, &TripDuplicate{trip, original, departure(trip) - departure(original), exact})
+					break
+				}
+			}
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i].Trip.Id < duplicates[j].Trip.Id })
+	return duplicates
+}
+
+// RemoveExactDuplicates removes the exact duplicates from the feed, keeping their original, and
+// returns them
+func (a *TripOverlapAnalyzer) RemoveExactDuplicates() []*Trip {
+	removed := make([]*Trip, 0)
+	for _, duplicate := range a.Duplicates() {
+		if duplicate.Exact {
+			a.feed.removeTrip(duplicate.Trip)
+			removed = append(removed, duplicate.Trip)
+		}
+	}
+	return removed
+}
+
+// BlockOverlaps returns the trips of a block running at the same time on a day both run, by block
+// id and departure. Frequency based trips are left out.
+func (a *TripOverlapAnalyzer) BlockOverlaps() []*BlockOverlap {
+	blocks := make(map[string][]*Trip)
+	for _, trip := range a.feed.Trips {
+		if trip.BlockId != "" && len(trip.Frequencies) == 0 && len(stopTimesOf(trip)) > 0 {
+			blocks[trip.BlockId] = append(blocks[trip.BlockId], trip)
+		}
+	}
+
+	serviceDates := make(map[string][]int)
+	dates := func(trip *Trip) []int {
+		if _, ok := serviceDates[trip.serviceId]; !ok {
+			serviceDates[trip.serviceId] = a.feed.ServiceDates(trip.serviceId)
+		}
+		return serviceDates[trip.serviceId]
+	}
+
+	// First departure and last arrival of each trip
+	starts, ends := make(map[*Trip]uint), make(map[*Trip]uint)
+	for _, trips := range blocks {
+		for _, trip := range trips {
+			stopTimes := stopTimesOf(trip)
+			starts[trip], ends[trip] = stopTimes[0].DepartureTime, stopTimes[len(stopTimes)-1].ArrivalTime
+		}
+	}
+	start := func(trip *Trip) uint { return starts[trip] }
+	end := func(trip *Trip) uint { return ends[trip] }
+
+	overlaps := make([]*BlockOverlap, 0)
+	for blockId, trips := range blocks {
+		sort.Slice(trips, func(i, j int) bool {
+			if start(trips[i]) != start(trips[j]) {
+				return start(trips[i]) < start(trips[j])
+			}
+			return trips[i].Id < trips[j].Id
+		})
+		for i, first := range trips {
+			for _, second := range trips[i+1:] {
+				if start(second) >= end(first) {
+					continue
+				}
+				date := firstCommonDate(dates(first), dates(second))
+				if date == 0 {
+					continue
+				}
+				overlap := end(first) - start(second)
+				if end(second) < end(first) {
+					overlap = end(second) - start(second)
+				}
+				overlaps = append(overlaps, &BlockOverlap{blockId, first, second, overlap, date})
+			}
+		}
+	}
+	sort.SliceStable(overlaps, func(i, j int) bool { return overlaps[i].BlockId < overlaps[j].BlockId })
+	return overlaps
+}
+
+// firstCommonDate returns the first date of two sorted lists of dates, 0 if there is none
+func firstCommonDate(a, b []int) int {
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			return a[i]
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return 0
+}
+
+// FrequencyOverlaps returns the overlapping frequencies.txt periods, by trip id. A period may start
+// when another one ends.
+func (a *TripOverlapAnalyzer) FrequencyOverlaps() []*FrequencyOverlap {
+	overlaps := make([]*FrequencyOverlap, 0)
+	for _, trip := range a.feed.Trips {
+		frequencies := append([]Frequency(nil), trip.Frequencies...)
+		sort.Slice(frequencies, func(i, j int) bool { return frequencies[i].StartTime < frequencies[j].StartTime })
+		for i, first := range frequencies {
+			for _, second := range frequencies[i+1:] {
+				if second.StartTime < first.EndTime {
+					overlaps = append(overlaps, &FrequencyOverlap{trip, first, second})
+				}
+			}
+		}
+	}
+	sort.SliceStable(overlaps, func(i, j int) bool { return overlaps[i].Trip.Id < overlaps[j].Trip.Id })
+	return overlaps
+}
@@ -0,0 +1,50 @@
+package gtfs
+
+import (
+	"testing"
+)
+
+// A stop_times.txt row with an unknown stop_id is still attached to its trip (its Stop is nil)
+func TestDuplicatesWithDanglingStopId(t *testing.T) {
+	feed, _ := NewFeed("")
+	route := &Route{Id: "R", feed: feed}
+	feed.Routes[route.Id] = route
+	a, b := NewStop(), NewStop()
+	a.Id, a.Lat, a.Lon = "A", 48.85, 2.35
+	b.Id, b.Lat, b.Lon = "B", 48.86, 2.36
+	feed.StopCollection.SetStop(a.Id, a)
+	feed.StopCollection.SetStop(b.Id, b)
+
+	// stopTime appends to trip a stop time at stop, minutes after 8:00
+	stopTime := func(trip *Trip, stop *Stop, minutes uint) {
+		time := 8*3600 + minutes*60
+		trip.StopTimes = append(trip.StopTimes, &StopTime{Trip: trip, Stop: stop, StopSequence: uint(len(trip.StopTimes) + 1), ArrivalTime: time, DepartureTime: time, feed: feed})
+	}
+	// The original, first by id, is the longer one
+	original := &Trip{Id: "T1", Route: route, serviceId: "S", feed: feed}
+	stopTime(original, a, 0)
+	stopTime(original, nil, 5)
+	stopTime(original, b, 10)
+	duplicate := &Trip{Id: "T2", Route: route, serviceId: "S", feed: feed}
+	stopTime(duplicate, a, 0)
+	stopTime(duplicate, b, 10)
+	feed.Trips[original.Id], feed.Trips[duplicate.Id] = original, duplicate
+
+	duplicates := NewTripOverlapAnalyzer(feed).Duplicates()
+	if len(duplicates) != 1 {
+		t.Fatalf("expected 1 duplicate, got %d", len(duplicates))
+	}
+	// T1 has an extra row, removing T2 as an exact duplicate would lose it
+	if duplicates[0].Trip.Id != "T2" || duplicates[0].Original.Id != "T1" || duplicates[0].Exact {
+		t.Errorf("expected T2 non exact duplicate of T1, got %s of %s (exact %v)", duplicates[0].Trip.Id, duplicates[0].Original.Id, duplicates[0].Exact)
+	}
+}
+
+// Trips whose stop times differ in number are not compared stop by stop
+func TestCompareTripsOfDifferentLengths(t *testing.T) {
+	a := []*StopTime{{ArrivalTime: 0}, {ArrivalTime: 60}, {ArrivalTime: 120}}
+	b := a[:2]
+	if duplicate, _ := compareTrips(a, b, &Trip{}, &Trip{}, 60); duplicate {
+		t.Error("trips with 3 and 2 stop times are not duplicates")
+	}
+}
@@ -0,0 +1,1121 @@
+package gtfs
+
+import (
+	"github.com/nicolaspaton/gogtfs/geo"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of values of the schema
+const (
+	fieldText = iota
+	fieldId
+	fieldInteger
+	fieldFloat
+	fieldDate     // YYYYMMDD
+	fieldTime     // H:MM:SS or HH:MM:SS, possibly beyond 24:00:00
+	fieldColor    // Six hexadecimal digits
+	fieldUrl      // http or https
+	fieldTimezone // tz database name
+)
+
+type gtfsField struct {
+	name     string
+	kind     int
+	required bool
+	valid    func(float64) bool // Accepted numbers, nil for any
+}
+
+// gtfsFile is the description of a file of the specification used by the validator
+type gtfsFile struct {
+	name     string
+	required bool
+	keys     []string // Columns identifying a record
+	fields   []gtfsField
+}
+
+func between(min, max float64) func(float64) bool {
+	return func(v float64) bool { return v >= min && v <= max }
+}
+
+func nonNegative(v float64) bool {
+	return v >= 0
+}
+
+func positive(v float64) bool {
+	return v > 0
+}
+
+// validRouteType accepts the basic route types and the extended ones
+// (https://developers.google.com/transit/gtfs/reference/extended-route-types)
+func validRouteType(v float64) bool {
+	return (v >= Tram && v <= Funicular) || v == 11 || v == 12 || (v >= 100 && v <= 1702)
+}
+
+// basicRouteType returns the basic route type closest to an extended one, -1 if there is none
+func basicRouteType(routeType int) int {
+	switch {
+	case routeType >= Tram && routeType <= Funicular:
+		return routeType
+	case routeType == 11: // Trolleybus
+		return Bus
+	case routeType == 12: // Monorail
+		return Rail
+	case routeType >= 100 && routeType < 200: // Railway
+		return Rail
+	case routeType >= 200 && routeType < 300: // Coach
+		return Bus
+	case routeType >= 400 && routeType < 500: // Urban railway
+		return Subway
+	case routeType >= 700 && routeType < 900: // Bus, trolleybus
+		return Bus
+	case routeType >= 900 && routeType < 1000:
+		return Tram
+	case routeType >= 1000 && routeType < 1300: // Water transport, ferry
+		return Ferry
+	case routeType >= 1300 && routeType < 1400: // Aerial lift
+		return Gondola
+	case routeType >= 1400 && routeType < 1500:
+		return Funicular
+	}
+	return -1
+}
+
+// DefaultMaxSpeeds are the speeds above which travel between stops is implausible, in km/h by route type
+var DefaultMaxSpeeds = map[int]float64{
+	Tram:      100,
+	Subway:    150,
+	Rail:      500,
+	Bus:       150,
+	Ferry:     80,
+	CableCar:  30,
+	Gondola:   50,
+	Funicular: 50,
+}
+
+var gtfsSchema = []*gtfsFile{
+	{"agency.txt", true, []string{"agency_id"}, []gtfsField{
+		{"agency_id", fieldId, false, nil},
+		{"agency_name", fieldText, true, nil},
+		{"agency_url", fieldUrl, true, nil},
+		{"agency_timezone", fieldTimezone, true, nil},
+		{"agency_lang", fieldText, false, nil},
+		{"agency_phone", fieldText, false, nil},
+		{"agency_fare_url", fieldUrl, false, nil},
+		{"agency_email", fieldText, false, nil},
+	}},
+	{"stops.txt", true, []string{"stop_id"}, []gtfsField{
+		{"stop_id", fieldId, true, nil},
+		{"stop_code", fieldText, false, nil},
+		{"stop_name", fieldText, false, nil},
+		{"stop_desc", fieldText, false, nil},
+		{"stop_lat", fieldFloat, false, between(-90, 90)},
+		{"stop_lon", fieldFloat, false, between(-180, 180)},
+		{"zone_id", fieldId, false, nil},
+		{"stop_url", fieldUrl, false, nil},
+		{"location_type", fieldInteger, false, between(LocationTypeStop, LocationTypeBoardingArea)},
+		{"parent_station", fieldId, false, nil},
+		{"stop_timezone", fieldTimezone, false, nil},
+		{"wheelchair_boarding", fieldInteger, false, between(WheelchairUnknown, WheelchairInaccessible)},
+		{"level_id", fieldId, false, nil},
+		{"platform_code", fieldText, false, nil},
+	}},
+	{"routes.txt", true, []string{"route_id"}, []gtfsField{
+		{"route_id", fieldId, true, nil},
+		{"agency_id", fieldId, false, nil},
+		{"route_short_name", fieldText, false, nil},
+		{"route_long_name", fieldText, false, nil},
+		{"route_desc", fieldText, false, nil},
+		{"route_type", fieldInteger, true, validRouteType},
+		{"route_url", fieldUrl, false, nil},
+		{"route_color", fieldColor, false, nil},
+		{"route_text_color", fieldColor, false, nil},
+		{"route_sort_order", fieldInteger, false, nonNegative},
+	}},
+	{"trips.txt", true, []string{"trip_id"}, []gtfsField{
+		{"route_id", fieldId, true, nil},
+		{"service_id", fieldId, true, nil},
+		{"trip_id", fieldId, true, nil},
+		{"trip_headsign", fieldText, false, nil},
+		{"trip_short_name", fieldText, false, nil},
+		{"direction_id", fieldInteger, false, between(DirectionOut, DirectionIn)},
+		{"block_id", fieldId, false, nil},
+		{"shape_id", fieldId, false, nil},
+		{"wheelchair_accessible", fieldInteger, false, between(WheelchairUnknown, WheelchairInaccessible)},
+		{"bikes_allowed", fieldInteger, false, between(0, 2)},
+	}},
+	{"stop_times.txt", true, []string{"trip_id", "stop_sequence"}, []gtfsField{
+		{"trip_id", fieldId, true, nil},
+		{"arrival_time", fieldTime, false, nil},
+		{"departure_time", fieldTime, false, nil},
+		{"stop_id", fieldId, true, nil},
+		{"stop_sequence", fieldInteger, true, nonNegative},
+		{"stop_headsign", fieldText, false, nil},
+		{"pickup_type", fieldInteger, false, between(PickupRegular, PickupTheDriver)},
+		{"drop_off_type", fieldInteger, false, between(DropOffRegular, DropOffTheDriver)},
+		{"shape_dist_traveled", fieldFloat, false, nonNegative},
+		{"timepoint", fieldInteger, false, between(0, 1)},
+	}},
+	{"calendar.txt", false, []string{"service_id"}, []gtfsField{
+		{"service_id", fieldId, true, nil},
+		{"monday", fieldInteger, true, between(0, 1)},
+		{"tuesday", fieldInteger, true, between(0, 1)},
+		{"wednesday", fieldInteger, true, between(0, 1)},
+		{"thursday", fieldInteger, true, between(0, 1)},
+		{"friday", fieldInteger, true, between(0, 1)},
+		{"saturday", fieldInteger, true, between(0, 1)},
+		{"sunday", fieldInteger, true, between(0, 1)},
+		{"start_date", fieldDate, true, nil},
+		{"end_date", fieldDate, true, nil},
+	}},
+	{"calendar_dates.txt", false, []string{"service_id", "date"}, []gtfsField{
+		{"service_id", fieldId, true, nil},
+		{"date", fieldDate, true, nil},
+		{"exception_type", fieldInteger, true, between(CalendarExceptionAddedService, CalendarExceptionRemovedService)},
+	}},
+	{"fare_attributes.txt", false, []string{"fare_id"}, []gtfsField{
+		{"fare_id", fieldId, true, nil},
+		{"price", fieldFloat, true, nonNegative},
+		{"currency_type", fieldText, true, nil},
+		{"payment_method", fieldInteger, true, between(PayementOnBoard, PayementBeforeBoarding)},
+		{"transfers", fieldInteger, false, between(TransfersNone, TransfersTwice)}, // Empty means unlimited
+		{"agency_id", fieldId, false, nil},
+		{"transfer_duration", fieldInteger, false, nonNegative},
+	}},
+	{"fare_rules.txt", false, []string{"fare_id", "route_id", "origin_id", "destination_id", "contains_id"}, []gtfsField{
+		{"fare_id", fieldId, true, nil},
+		{"route_id", fieldId, false, nil},
+		{"origin_id", fieldId, false, nil},
+		{"destination_id", fieldId, false, nil},
+		{"contains_id", fieldId, false, nil},
+	}},
+	{"shapes.txt", false, []string{"shape_id", "shape_pt_sequence"}, []gtfsField{
+		{"shape_id", fieldId, true, nil},
+		{"shape_pt_lat", fieldFloat, true, between(-90, 90)},
+		{"shape_pt_lon", fieldFloat, true, between(-180, 180)},
+		{"shape_pt_sequence", fieldInteger, true, nonNegative},
+		{"shape_dist_traveled", fieldFloat, false, nonNegative},
+	}},
+	{"frequencies.txt", false, []string{"trip_id", "start_time"}, []gtfsField{
+		{"trip_id", fieldId, true, nil},
+		{"start_time", fieldTime, true, nil},
+		{"end_time", fieldTime, true, nil},
+		{"headway_secs", fieldInteger, true, positive},
+		{"exact_times", fieldInteger, false, between(0, 1)},
+	}},
+	{"transfers.txt", false, []string{"from_stop_id", "to_stop_id"}, []gtfsField{
+		{"from_stop_id", fieldId, true, nil},
+		{"to_stop_id", fieldId, true, nil},
+		{"transfer_type", fieldInteger, false, between(TransferRecommended, TransferImpossible)}, // Empty means 0
+		{"min_transfer_time", fieldInteger, false, nonNegative},
+	}},
+	{"pathways.txt", false, []string{"pathway_id"}, []gtfsField{
+		{"pathway_id", fieldId, true, nil},
+		{"from_stop_id", fieldId, true, nil},
+		{"to_stop_id", fieldId, true, nil},
+		{"pathway_mode", fieldInteger, true, between(PathwayWalkway, PathwayExitGate)},
+		{"is_bidirectional", fieldInteger, true, between(0, 1)},
+		{"length", fieldFloat, false, nonNegative},
+		{"traversal_time", fieldInteger, false, positive},
+		{"stair_count", fieldInteger, false, nil},
+		{"max_slope", fieldFloat, false, nil},
+		{"min_width", fieldFloat, false, positive},
+		{"signposted_as", fieldText, false, nil},
+		{"reversed_signposted_as", fieldText, false, nil},
+	}},
+}
+
+func gtfsSchemaFile(name string) *gtfsFile {
+	for _, file := range gtfsSchema {
+		if file.name == name {
+			return file
+		}
+	}
+	return nil
+}
+
+// gtfsReference is a column whose values must exist in one of the target columns ("file#column")
+type gtfsReference struct {
+	file    string
+	field   string
+	targets []string
+}
+
+var gtfsReferences = []gtfsReference{
+	{"routes.txt", "agency_id", []string{"agency.txt#agency_id"}},
+	{"trips.txt", "route_id", []string{"routes.txt#route_id"}},
+	{"trips.txt", "service_id", []string{"calendar.txt#service_id", "calendar_dates.txt#service_id"}},
+	{"trips.txt", "shape_id", []string{"shapes.txt#shape_id"}},
+	{"stop_times.txt", "trip_id", []string{"trips.txt#trip_id"}},
+	{"stop_times.txt", "stop_id", []string{"stops.txt#stop_id"}},
+	{"stops.txt", "parent_station", []string{"stops.txt#stop_id"}},
+	{"frequencies.txt", "trip_id", []string{"trips.txt#trip_id"}},
+	{"transfers.txt", "from_stop_id", []string{"stops.txt#stop_id"}},
+	{"transfers.txt", "to_stop_id", []string{"stops.txt#stop_id"}},
+	{"pathways.txt", "from_stop_id", []string{"stops.txt#stop_id"}},
+	{"pathways.txt", "to_stop_id", []string{"stops.txt#stop_id"}},
+	{"fare_attributes.txt", "agency_id", []string{"agency.txt#agency_id"}},
+	{"fare_rules.txt", "fare_id", []string{"fare_attributes.txt#fare_id"}},
+	{"fare_rules.txt", "route_id", []string{"routes.txt#route_id"}},
+	{"fare_rules.txt", "origin_id", []string{"stops.txt#zone_id"}},
+	{"fare_rules.txt", "destination_id", []string{"stops.txt#zone_id"}},
+	{"fare_rules.txt", "contains_id", []string{"stops.txt#zone_id"}},
+}
+
+// ValidationRules is the catalogue of the validator's rules, in the order they run. Codes are the
+// ones of the canonical GTFS validator where it has an equivalent rule.
+var ValidationRules = []*ValidationRule{
+	{"missing_required_file", SeverityError, "A required file is missing.", checkRequiredFiles},
+	{"missing_calendar_and_calendar_date_files", SeverityError, "Both calendar.txt and calendar_dates.txt are missing, trips have no service dates.", checkCalendarFiles},
+	{"empty_file", SeverityError, "A file has no records.", checkEmptyFiles},
+	{"unknown_file", SeverityInfo, "A file is not part of the specification and is ignored.", checkUnknownFiles},
+	{"csv_parsing_failed", SeverityError, "A line could not be parsed and is ignored.", checkParsing},
+	{"missing_required_column", SeverityError, "A required column is missing.", checkRequiredColumns},
+	{"unknown_column", SeverityInfo, "A column is not part of the specification and is ignored.", checkUnknownColumns},
+	{"missing_required_field", SeverityError, "A required value is empty.", checkRequiredFields},
+	{"leading_or_trailing_whitespaces", SeverityWarning, "A value has leading or trailing spaces.", checkWhitespaces},
+	{"invalid_integer", SeverityError, "A value is not an integer.", formatCheck(fieldInteger, "Not an integer")},
+	{"invalid_float", SeverityError, "A value is not a number.", formatCheck(fieldFloat, "Not a number")},
+	{"invalid_date", SeverityError, "A date is not in the YYYYMMDD format.", formatCheck(fieldDate, "Not a YYYYMMDD date")},
+	{"invalid_time", SeverityError, "A time is not in the HH:MM:SS format.", formatCheck(fieldTime, "Not a HH:MM:SS time")},
+	{"invalid_color", SeverityError, "A color is not six hexadecimal digits.", formatCheck(fieldColor, "Not a RRGGBB color")},
+	{"invalid_url", SeverityError, "A URL is not a complete http or https URL.", formatCheck(fieldUrl, "Not an http or https URL")},
+	{"invalid_timezone", SeverityError, "A timezone is not a tz database name.", formatCheck(fieldTimezone, "Not a tz database timezone")},
+	{"number_out_of_range", SeverityError, "A number is outside of the values the specification allows.", checkRanges},
+	{"duplicate_key", SeverityError, "Two records have the same id.", checkDuplicateKeys},
+	{"foreign_key_violation", SeverityError, "A value references an entity that doesn't exist.", checkForeignKeys},
+	{"start_and_end_range_out_of_order", SeverityError, "A period ends before it starts.", checkRangesOrder},
+	{"route_both_short_and_long_name_missing", SeverityError, "A route has neither a short name nor a long name.", checkRouteNames},
+	{"inconsistent_agency_timezone", SeverityError, "Agencies have different timezones.", checkAgencyTimezones},
+	{"station_with_parent_station", SeverityError, "A station has a parent station.", checkStationParents},
+	{"location_without_parent_station", SeverityError, "An entrance, generic node or boarding area has no parent station.", checkLocationParents},
+	{"wrong_parent_location_type", SeverityError, "The parent station of a location has the wrong location type.", checkParentTypes},
+	{"point_near_origin", SeverityError, "A point is close to (0, 0), its coordinates are probably missing.", checkPointsNearOrigin},
+	{"point_near_pole", SeverityWarning, "A point is close to a pole, latitude and longitude are probably swapped.", checkPointsNearPole},
+	{"route_short_name_too_long", SeverityWarning, "A route short name is longer than 12 characters.", checkRouteShortNames},
+	{"unusable_trip", SeverityWarning, "A trip has less than two stop times.", checkUnusableTrips},
+	{"unused_shape", SeverityWarning, "A shape is not used by any trip.", checkUnusedShapes},
+	{"stop_too_far_from_shape", SeverityWarning, "A stop is further than Validator.MaxShapeDistance from the shape of its trip.", checkStopsFarFromShapes},
+	{"missing_trip_edge", SeverityError, "The first or last stop time of a trip has no arrival or departure time.", checkTripEdges},
+	{"stop_time_with_departure_before_arrival_time", SeverityError, "A stop time departs before it arrives.", checkDwellTimes},
+	{"stop_time_with_arrival_before_previous_departure_time", SeverityError, "Times decrease along a trip.", checkDecreasingTimes},
+	{"consecutive_duplicate_stops", SeverityWarning, "A trip stops twice in a row at the same stop.", checkConsecutiveStops},
+	{"fast_travel_between_stops", SeverityWarning, "The speed between two time points exceeds Validator.MaxSpeeds for the route type.", checkTravelSpeeds},
+	{"zero_duration_long_hop", SeverityWarning, "Two time points further than Validator.MaxZeroDurationHop are scheduled at the same time.", checkZeroDurationHops},
+	{"service_never_active", SeverityWarning, "A service has no active date.", checkServicesNeverActive},
+	{"expired_calendar", SeverityWarning, "A service has no active date from today on.", checkExpiredServices},
+}
+
+func checkRequiredFiles(v *validation) {
+	for _, file := range gtfsSchema {
+		if file.required && v.tables[file.name] == nil {
+			v.notice(file.name, nil, "", "", "", "The file is required")
+		}
+	}
+}
+
+func checkCalendarFiles(v *validation) {
+	if v.tables["calendar.txt"] == nil && v.tables["calendar_dates.txt"] == nil {
+		v.notice("calendar.txt", nil, "", "", "", "calendar.txt or calendar_dates.txt is required")
+	}
+}
+
+func checkEmptyFiles(v *validation) {
+	for _, file := range gtfsSchema {
+		if table := v.tables[file.name]; table != nil && len(table.rows) == 0 {
+			v.notice(file.name, nil, "", "", "", "The file has no records")
+		}
+	}
+}
+
+func checkUnknownFiles(v *validation) {
+	sort.Strings(v.files)
+	for _, file := range v.files {
+		if gtfsSchemaFile(file) == nil {
+			v.notice(file, nil, "", "", "", "Not a GTFS file")
+		}
+	}
+}
+
+func checkParsing(v *validation) {
+	for _, perr := range v.broken {
+		v.notice(perr.FileName, &gtfsRow{line: perr.LineNumber}, "", "", "", perr.Message)
+	}
+}
+
+func checkRequiredColumns(v *validation) {
+	for _, file := range gtfsSchema {
+		table := v.tables[file.name]
+		if table == nil || table.header == nil {
+			continue
+		}
+		for _, field := range file.fields {
+			if field.required && !table.has(field.name) {
+				v.notice(file.name, nil, "", field.name, "", "The column is required")
+			}
+		}
+	}
+}
+
+func checkUnknownColumns(v *validation) {
+	for _, file := range gtfsSchema {
+		table := v.tables[file.name]
+		if table == nil {
+			continue
+		}
+		for _, column := range table.header {
+			known := false
+			for _, field := range file.fields {
+				known = known || field.name == column
+			}
+			if !known {
+				v.notice(file.name, nil, "", column, "", "Unknown column")
+			}
+		}
+	}
+}
+
+func checkRequiredFields(v *validation) {
+	missing := func(table *gtfsTable, row *gtfsRow, field, reason string) {
+		if table.get(row, field) == "" {
+			v.notice(table.file, row, v.entityId(table.file, row), field, "", reason)
+		}
+	}
+	for _, file := range gtfsSchema {
+		table := v.tables[file.name]
+		if table == nil {
+			continue
+		}
+		for _, field := range file.fields {
+			if !field.required || !table.has(field.name) {
+				continue
+			}
+			for _, row := range table.rows {
+				missing(table, row, field.name, "The value is required")
+			}
+		}
+	}
+
+	// Conditionally required
+	if stops := v.tables["stops.txt"]; stops != nil {
+		for _, row := range stops.rows {
+			switch stops.get(row, "location_type") {
+			case "", "0", "1", "2":
+				missing(stops, row, "stop_name", "The value is required for stops, stations and entrances")
+				missing(stops, row, "stop_lat", "The value is required for stops, stations and entrances")
+				missing(stops, row, "stop_lon", "The value is required for stops, stations and entrances")
+			}
+		}
+	}
+	if agencies := v.tables["agency.txt"]; agencies != nil && len(agencies.rows) > 1 {
+		for _, file := range []string{"agency.txt", "routes.txt", "fare_attributes.txt"} {
+			if table := v.tables[file]; table != nil {
+				for _, row := range table.rows {
+					missing(table, row, "agency_id", "The value is required when the feed has several agencies")
+				}
+			}
+		}
+	}
+}
+
+func checkWhitespaces(v *validation) {
+	for _, file := range gtfsSchema {
+		table := v.tables[file.name]
+		if table == nil {
+			continue
+		}
+		for _, row := range table.rows {
+			for i, value := range row.values {
+				if i < len(table.header) && strings.TrimSpace(value) != value {
+					v.notice(file.name, row, v.entityId(file.name, row), table.header[i], value, "Leading or trailing spaces")
+				}
+			}
+		}
+	}
+}
+
+// parseTimeOfDay reads a GTFS time (H:MM:SS or HH:MM:SS) in seconds since midnight
+func parseTimeOfDay(value string) (uint, bool) {
+	components := strings.Split(value, ":")
+	if len(components) != 3 || len(components[0]) == 0 || len(components[0]) > 3 || len(components[1]) != 2 || len(components[2]) != 2 {
+		return 0, false
+	}
+	hours, err := strconv.ParseUint(components[0], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	minutes, err := strconv.ParseUint(components[1], 10, 32)
+	if err != nil || minutes > 59 {
+		return 0, false
+	}
+	seconds, err := strconv.ParseUint(components[2], 10, 32)
+	if err != nil || seconds > 59 {
+		return 0, false
+	}
+	return uint(hours*60*60 + minutes*60 + seconds), true
+}
+
+// parseDate reads a GTFS date (YYYYMMDD)
+func parseDate(value string) (time.Time, bool) {
+	if len(value) != 8 {
+		return time.Time{}, false
+	}
+	date, err := time.Parse("20060102", value)
+	return date, err == nil
+}
+
+func validFormat(kind int, value string) bool {
+	switch kind {
+	case fieldInteger:
+		_, err := strconv.Atoi(value)
+		return err == nil
+	case fieldFloat:
+		_, err := strconv.ParseFloat(value, 64)
+		return err == nil
+	case fieldDate:
+		_, ok := parseDate(value)
+		return ok
+	case fieldTime:
+		_, ok := parseTimeOfDay(value)
+		return ok
+	case fieldColor:
+		_, err := strconv.ParseUint(value, 16, 32)
+		return len(value) == 6 && err == nil
+	case fieldUrl:
+		u, err := url.Parse(value)
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+	case fieldTimezone:
+		_, err := time.LoadLocation(value)
+		return err == nil && value != "Local"
+	}
+	return true
+}
+
+// formatCheck returns the check of the values of kind
+func formatCheck(kind int, message string) func(v *validation) {
+	return func(v *validation) {
+		for _, file := range gtfsSchema {
+			table := v.tables[file.name]
+			if table == nil {
+				continue
+			}
+			for _, field := range file.fields {
+				if field.kind != kind || !table.has(field.name) {
+					continue
+				}
+				for _, row := range table.rows {
+					if value := strings.TrimSpace(table.get(row, field.name)); value != "" && !validFormat(kind, value) {
+						v.notice(file.name, row, v.entityId(file.name, row), field.name, value, message)
+					}
+				}
+			}
+		}
+	}
+}
+
+func checkRanges(v *validation) {
+	for _, file := range gtfsSchema {
+		table := v.tables[file.name]
+		if table == nil {
+			continue
+		}
+		for _, field := range file.fields {
+			if field.valid == nil || !table.has(field.name) {
+				continue
+			}
+			for _, row := range table.rows {
+				value := strings.TrimSpace(table.get(row, field.name))
+				number, err := strconv.ParseFloat(value, 64)
+				if value == "" || err != nil || !validFormat(field.kind, value) {
+					continue
+				}
+				if !field.valid(number) {
+					v.notice(file.name, row, v.entityId(file.name, row), field.name, value, "Out of range")
+				}
+			}
+		}
+	}
+}
+
+func checkDuplicateKeys(v *validation) {
+	for _, file := range gtfsSchema {
+		table := v.tables[file.name]
+		if table == nil {
+			continue
+		}
+		seen := make(map[string]*gtfsRow)
+		for _, row := range table.rows {
+			key := v.entityId(file.name, row)
+			if table.get(row, file.keys[0]) == "" && len(table.rows) > 1 {
+				// Reported as missing, unless it is the only agency
+				if file.name != "agency.txt" {
+					continue
+				}
+			}
+			if first := seen[key]; first != nil {
+				v.notice(file.name, row, key, strings.Join(file.keys, ","), key, "Same key as line "+strconv.Itoa(first.line))
+				continue
+			}
+			seen[key] = row
+		}
+	}
+}
+
+func checkForeignKeys(v *validation) {
+	for _, reference := range gtfsReferences {
+		table := v.tables[reference.file]
+		if !table.has(reference.field) {
+			continue
+		}
+		for _, row := range table.rows {
+			value := table.get(row, reference.field)
+			if value == "" {
+				continue
+			}
+			found := false
+			for _, target := range reference.targets {
+				parts := strings.SplitN(target, "#", 2)
+				found = found || v.index(parts[0], parts[1])[value] != nil
+			}
+			if !found {
+				v.notice(reference.file, row, v.entityId(reference.file, row), reference.field, value,
+					"Not found in "+strings.Replace(strings.Join(reference.targets, " or "), "#", " ", -1))
+			}
+		}
+	}
+}
+
+func checkRangesOrder(v *validation) {
+	if calendars := v.tables["calendar.txt"]; calendars != nil {
+		for _, row := range calendars.rows {
+			start, startOk := parseDate(calendars.get(row, "start_date"))
+			end, endOk := parseDate(calendars.get(row, "end_date"))
+			if startOk && endOk && end.Before(start) {
+				v.notice(calendars.file, row, v.entityId(calendars.file, row), "end_date", calendars.get(row, "end_date"),
+					"Before start_date "+calendars.get(row, "start_date"))
+			}
+		}
+	}
+	if frequencies := v.tables["frequencies.txt"]; frequencies != nil {
+		for _, row := range frequencies.rows {
+			start, startOk := parseTimeOfDay(frequencies.get(row, "start_time"))
+			end, endOk := parseTimeOfDay(frequencies.get(row, "end_time"))
+			if startOk && endOk && end <= start {
+				v.notice(frequencies.file, row, v.entityId(frequencies.file, row), "end_time", frequencies.get(row, "end_time"),
+					"Not after start_time "+frequencies.get(row, "start_time"))
+			}
+		}
+	}
+}
+
+func checkRouteNames(v *validation) {
+	routes := v.tables["routes.txt"]
+	if routes == nil {
+		return
+	}
+	for _, row := range routes.rows {
+		if routes.get(row, "route_short_name") == "" && routes.get(row, "route_long_name") == "" {
+			v.notice(routes.file, row, v.entityId(routes.file, row), "route_short_name", "", "route_short_name or route_long_name is required")
+		}
+	}
+}
+
+func checkAgencyTimezones(v *validation) {
+	agencies := v.tables["agency.txt"]
+	if agencies == nil || len(agencies.rows) == 0 {
+		return
+	}
+	expected := agencies.get(agencies.rows[0], "agency_timezone")
+	for _, row := range agencies.rows[1:] {
+		if timezone := agencies.get(row, "agency_timezone"); timezone != expected {
+			v.notice(agencies.file, row, v.entityId(agencies.file, row), "agency_timezone", timezone, "The first agency's timezone is "+expected)
+		}
+	}
+}
+
+// locationType returns the location type of a stops.txt row, empty being a stop
+func locationType(stops *gtfsTable, row *gtfsRow) int {
+	locationType, _ := strconv.Atoi(stops.get(row, "location_type"))
+	return locationType
+}
+
+func checkStationParents(v *validation) {
+	stops := v.tables["stops.txt"]
+	if stops == nil {
+		return
+	}
+	for _, row := range stops.rows {
+		if locationType(stops, row) == LocationTypeStation && stops.get(row, "parent_station") != "" {
+			v.notice(stops.file, row, v.entityId(stops.file, row), "parent_station", stops.get(row, "parent_station"), "Stations can't have a parent station")
+		}
+	}
+}
+
+func checkLocationParents(v *validation) {
+	stops := v.tables["stops.txt"]
+	if stops == nil {
+		return
+	}
+	for _, row := range stops.rows {
+		if t := locationType(stops, row); t >= LocationTypeEntrance && t <= LocationTypeBoardingArea && stops.get(row, "parent_station") == "" {
+			v.notice(stops.file, row, v.entityId(stops.file, row), "parent_station", "", "Required for location type "+stops.get(row, "location_type"))
+		}
+	}
+}
+
+func checkParentTypes(v *validation) {
+	stops := v.tables["stops.txt"]
+	if stops == nil {
+		return
+	}
+	index := v.index("stops.txt", "stop_id")
+	for _, row := range stops.rows {
+		parent := index[stops.get(row, "parent_station")]
+		if parent == nil {
+			continue
+		}
+		child, expected := locationType(stops, row), LocationTypeStation
+		if child == LocationTypeStation {
+			continue
+		}
+		if child == LocationTypeBoardingArea {
+			expected = LocationTypeStop
+		}
+		if actual := locationType(stops, parent); actual != expected {
+			v.notice(stops.file, row, v.entityId(stops.file, row), "parent_station", stops.get(row, "parent_station"),
+				"The parent has location type "+strconv.Itoa(actual)+", "+strconv.Itoa(expected)+" expected")
+		}
+	}
+}
+
+// eachPoint calls handler with the valid coordinates of stops and shape points
+func (v *validation) eachPoint(handler func(table *gtfsTable, row *gtfsRow, lat, lon float64)) {
+	for _, columns := range [][3]string{{"stops.txt", "stop_lat", "stop_lon"}, {"shapes.txt", "shape_pt_lat", "shape_pt_lon"}} {
+		table := v.tables[columns[0]]
+		if table == nil {
+			continue
+		}
+		for _, row := range table.rows {
+			lat, err := strconv.ParseFloat(table.get(row, columns[1]), 64)
+			if err != nil {
+				continue
+			}
+			lon, err := strconv.ParseFloat(table.get(row, columns[2]), 64)
+			if err != nil {
+				continue
+			}
+			handler(table, row, lat, lon)
+		}
+	}
+}
+
+func checkPointsNearOrigin(v *validation) {
+	v.eachPoint(func(table *gtfsTable, row *gtfsRow, lat, lon float64) {
+		if math.Abs(lat) <= 1 && math.Abs(lon) <= 1 {
+			v.notice(table.file, row, v.entityId(table.file, row), "", strconv.FormatFloat(lat, 'f', -1, 64)+","+strconv.FormatFloat(lon, 'f', -1, 64), "Less than a degree from (0, 0)")
+		}
+	})
+}
+
+func checkPointsNearPole(v *validation) {
+	v.eachPoint(func(table *gtfsTable, row *gtfsRow, lat, lon float64) {
+		if math.Abs(lat) >= 89 && math.Abs(lat) <= 90 {
+			v.notice(table.file, row, v.entityId(table.file, row), "", strconv.FormatFloat(lat, 'f', -1, 64)+","+strconv.FormatFloat(lon, 'f', -1, 64), "Less than a degree from a pole")
+		}
+	})
+}
+
+func checkRouteShortNames(v *validation) {
+	routes := v.tables["routes.txt"]
+	if routes == nil {
+		return
+	}
+	for _, row := range routes.rows {
+		if name := routes.get(row, "route_short_name"); len([]rune(name)) > 12 {
+			v.notice(routes.file, row, v.entityId(routes.file, row), "route_short_name", name, "Longer than 12 characters")
+		}
+	}
+}
+
+func checkUnusableTrips(v *validation) {
+	trips, stopTimes := v.tables["trips.txt"], v.tables["stop_times.txt"]
+	if trips == nil {
+		return
+	}
+	counts := make(map[string]int)
+	if stopTimes != nil {
+		for _, row := range stopTimes.rows {
+			counts[stopTimes.get(row, "trip_id")]++
+		}
+	}
+	for _, row := range trips.rows {
+		id := trips.get(row, "trip_id")
+		if id != "" && counts[id] < 2 {
+			v.notice(trips.file, row, id, "trip_id", id, strconv.Itoa(counts[id])+" stop times")
+		}
+	}
+}
+
+func checkUnusedShapes(v *validation) {
+	shapes := v.tables["shapes.txt"]
+	if shapes == nil {
+		return
+	}
+	used := v.index("trips.txt", "shape_id")
+	first := v.index("shapes.txt", "shape_id")
+	ids := make([]string, 0, len(first))
+	for id := range first {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if used[id] == nil {
+			v.notice(shapes.file, first[id], id, "shape_id", id, "No trip uses the shape")
+		}
+	}
+}
+
+func checkStopsFarFromShapes(v *validation) {
+	shapes, stopTimes := v.tables["shapes.txt"], v.tables["stop_times.txt"]
+	stops, trips := v.tables["stops.txt"], v.tables["trips.txt"]
+	if shapes == nil || stopTimes == nil || stops == nil || trips == nil {
+		return
+	}
+
+	// Shape points by shape, in sequence order
+	type point struct {
+		sequence int
+		lat, lon float64
+	}
+	points := make(map[string][]point)
+	for _, row := range shapes.rows {
+		sequence, err := strconv.Atoi(shapes.get(row, "shape_pt_sequence"))
+		lat, latErr := strconv.ParseFloat(shapes.get(row, "shape_pt_lat"), 64)
+		lon, lonErr := strconv.ParseFloat(shapes.get(row, "shape_pt_lon"), 64)
+		if err == nil && latErr == nil && lonErr == nil {
+			id := shapes.get(row, "shape_id")
+			points[id] = append(points[id], point{sequence, lat, lon})
+		}
+	}
+	for _, shape := range points {
+		sort.SliceStable(shape, func(i, j int) bool { return shape[i].sequence < shape[j].sequence })
+	}
+
+	tripsIndex, stopsIndex := v.index("trips.txt", "trip_id"), v.index("stops.txt", "stop_id")
+	checked := make(map[[2]string]bool)
+	for _, row := range stopTimes.rows {
+		trip, stop := tripsIndex[stopTimes.get(row, "trip_id")], stopsIndex[stopTimes.get(row, "stop_id")]
+		if trip == nil || stop == nil {
+			continue
+		}
+		shapeId, stopId := trips.get(trip, "shape_id"), stops.get(stop, "stop_id")
+		shape := points[shapeId]
+		if len(shape) == 0 || checked[[2]string{shapeId, stopId}] {
+			continue
+		}
+		checked[[2]string{shapeId, stopId}] = true
+		lat, latErr := strconv.ParseFloat(stops.get(stop, "stop_lat"), 64)
+		lon, lonErr := strconv.ParseFloat(stops.get(stop, "stop_lon"), 64)
+		if latErr != nil || lonErr != nil {
+			continue
+		}
+		distance := geo.Haversine(lat, lon, shape[0].lat, shape[0].lon)
+		for i := 1; i < len(shape); i++ {
+			distance = math.Min(distance, geo.PointToSegmentDistance(lat, lon, shape[i-1].lat, shape[i-1].lon, shape[i].lat, shape[i].lon))
+		}
+		if distance > v.MaxShapeDistance {
+			v.notice(stopTimes.file, row, v.entityId(stopTimes.file, row), "stop_id", stopId,
+				strconv.Itoa(int(distance))+" m from shape "+shapeId)
+		}
+	}
+}
+
+// serviceDates is the active dates of a service, and where it is defined
+type serviceDates struct {
+	file  string
+	row   *gtfsRow
+	dates map[string]bool // YYYYMMDD
+}
+
+// maxServiceDays bounds the calendar periods expanded to dates
+const maxServiceDays = 366 * 10
+
+// services returns the active dates of each service of calendar.txt and calendar_dates.txt. The
+// rows are loaded in a scratch feed and expanded by Feed.ServiceDates, like the loader would.
+func (v *validation) services() map[string]*serviceDates {
+	feed, _ := NewFeed("")
+	services := make(map[string]*serviceDates)
+	if calendars := v.tables["calendar.txt"]; calendars != nil {
+		for _, row := range calendars.rows {
+			id := calendars.get(row, "service_id")
+			if id == "" || services[id] != nil {
+				continue
+			}
+			services[id] = &serviceDates{calendars.file, row, nil}
+			start, startOk := parseDate(calendars.get(row, "start_date"))
+			end, endOk := parseDate(calendars.get(row, "end_date"))
+			if !startOk || !endOk {
+				continue
+			}
+			calendar := &Calendar{feed: feed}
+			for _, column := range calendars.header {
+				calendar.setField(column, calendars.get(row, column))
+			}
+			if last := start.AddDate(0, 0, maxServiceDays-1); end.After(last) {
+				calendar.EndDate, _ = strconv.Atoi(last.Format("20060102"))
+			}
+			feed.Calendars[id] = calendar
+		}
+	}
+	if dates := v.tables["calendar_dates.txt"]; dates != nil {
+		for _, row := range dates.rows {
+			id, date := dates.get(row, "service_id"), dates.get(row, "date")
+			if id == "" {
+				continue
+			}
+			if services[id] == nil {
+				services[id] = &serviceDates{dates.file, row, nil}
+			}
+			if exceptionType := dates.get(row, "exception_type"); exceptionType != "1" && exceptionType != "2" {
+				continue
+			}
+			if _, ok := parseDate(date); !ok {
+				continue
+			}
+			calendarDate := &CalendarDate{feed: feed}
+			for _, column := range dates.header {
+				calendarDate.setField(column, dates.get(row, column))
+			}
+			feed.CalendarDates[id] = append(feed.CalendarDates[id], calendarDate)
+		}
+	}
+	for id, service := range services {
+		service.dates = make(map[string]bool)
+		for _, day := range feed.ServiceDates(id) {
+			service.dates[strconv.Itoa(day)] = true
+		}
+	}
+	return services
+}
+
+func sortedServiceIds(services map[string]*serviceDates) []string {
+	ids := make([]string, 0, len(services))
+	for id := range services {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func checkServicesNeverActive(v *validation) {
+	services := v.services()
+	for _, id := range sortedServiceIds(services) {
+		if service := services[id]; len(service.dates) == 0 {
+			v.notice(service.file, service.row, id, "service_id", id, "The service has no active date")
+		}
+	}
+}
+
+func checkExpiredServices(v *validation) {
+	today := v.Today.Format("20060102")
+	services := v.services()
+	for _, id := range sortedServiceIds(services) {
+		service := services[id]
+		last := ""
+		for date := range service.dates {
+			if date > last {
+				last = date
+			}
+		}
+		if last != "" && last < today {
+			v.notice(service.file, service.row, id, "service_id", id, "Last active date is "+last)
+		}
+	}
+}
+
+// tripStopTimes returns the stop_times.txt rows of each trip, in stop_sequence order
+func (v *validation) tripStopTimes() map[string][]*gtfsRow {
+	if v.trips != nil {
+		return v.trips
+	}
+	v.trips = make(map[string][]*gtfsRow)
+	stopTimes := v.tables["stop_times.txt"]
+	if stopTimes == nil {
+		return v.trips
+	}
+	for _, row := range stopTimes.rows {
+		if id := stopTimes.get(row, "trip_id"); id != "" {
+			v.trips[id] = append(v.trips[id], row)
+		}
+	}
+	for _, rows := range v.trips {
+		sort.SliceStable(rows, func(i, j int) bool {
+			a, _ := strconv.Atoi(stopTimes.get(rows[i], "stop_sequence"))
+			b, _ := strconv.Atoi(stopTimes.get(rows[j], "stop_sequence"))
+			return a < b
+		})
+	}
+	return v.trips
+}
+
+// eachTrip calls handler with the stop times of each trip, by trip id
+func (v *validation) eachTrip(handler func(stopTimes *gtfsTable, tripId string, rows []*gtfsRow)) {
+	trips := v.tripStopTimes()
+	ids := make([]string, 0, len(trips))
+	for id := range trips {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		handler(v.tables["stop_times.txt"], id, trips[id])
+	}
+}
+
+// stopTimeTimes returns the arrival and departure times of a row, each replacing the other when
+// missing. ok is false when both are missing or invalid.
+func stopTimeTimes(stopTimes *gtfsTable, row *gtfsRow) (arrival, departure uint, ok bool) {
+	arrival, arrivalOk := parseTimeOfDay(stopTimes.get(row, "arrival_time"))
+	departure, departureOk := parseTimeOfDay(stopTimes.get(row, "departure_time"))
+	if !arrivalOk {
+		arrival = departure
+	}
+	if !departureOk {
+		departure = arrival
+	}
+	return arrival, departure, arrivalOk || departureOk
+}
+
+func checkTripEdges(v *validation) {
+	v.eachTrip(func(stopTimes *gtfsTable, tripId string, rows []*gtfsRow) {
+		edges := []*gtfsRow{rows[0]}
+		if len(rows) > 1 {
+			edges = append(edges, rows[len(rows)-1])
+		}
+		for _, row := range edges {
+			for _, field := range []string{"arrival_time", "departure_time"} {
+				if stopTimes.get(row, field) == "" {
+					v.notice(stopTimes.file, row, v.entityId(stopTimes.file, row), field, "", "Required for the first and last stops of a trip")
+				}
+			}
+		}
+	})
+}
+
+func checkDwellTimes(v *validation) {
+	v.eachTrip(func(stopTimes *gtfsTable, tripId string, rows []*gtfsRow) {
+		for _, row := range rows {
+			arrival, arrivalOk := parseTimeOfDay(stopTimes.get(row, "arrival_time"))
+			departure, departureOk := parseTimeOfDay(stopTimes.get(row, "departure_time"))
+			if arrivalOk && departureOk && departure < arrival {
+				v.notice(stopTimes.file, row, v.entityId(stopTimes.file, row), "departure_time", stopTimes.get(row, "departure_time"),
+					"Before arrival_time "+stopTimes.get(row, "arrival_time"))
+			}
+		}
+	})
+}
+
+func checkDecreasingTimes(v *validation) {
+	v.eachTrip(func(stopTimes *gtfsTable, tripId string, rows []*gtfsRow) {
+		var previous *gtfsRow
+		var previousDeparture uint
+		for _, row := range rows {
+			arrival, departure, ok := stopTimeTimes(stopTimes, row)
+			if !ok {
+				continue
+			}
+			if previous != nil && arrival < previousDeparture {
+				v.notice(stopTimes.file, row, v.entityId(stopTimes.file, row), "arrival_time", stopTimes.get(row, "arrival_time"),
+					"Before the departure of stop_sequence "+stopTimes.get(previous, "stop_sequence")+" (line "+strconv.Itoa(previous.line)+")")
+			}
+			previous, previousDeparture = row, departure
+		}
+	})
+}
+
+func checkConsecutiveStops(v *validation) {
+	v.eachTrip(func(stopTimes *gtfsTable, tripId string, rows []*gtfsRow) {
+		for i := 1; i < len(rows); i++ {
+			if stop := stopTimes.get(rows[i], "stop_id"); stop != "" && stop == stopTimes.get(rows[i-1], "stop_id") {
+				v.notice(stopTimes.file, rows[i], v.entityId(stopTimes.file, rows[i]), "stop_id", stop,
+					"Same stop as stop_sequence "+stopTimes.get(rows[i-1], "stop_sequence"))
+			}
+		}
+	})
+}
+
+// eachTimedHop calls handler for the consecutive time points of each trip whose stops all have
+// coordinates, with the distance traveled through the stops between them and the route type of the trip
+func (v *validation) eachTimedHop(handler func(stopTimes *gtfsTable, from, to *gtfsRow, duration int, distance float64, routeType int)) {
+	trips, routes, stops := v.tables["trips.txt"], v.tables["routes.txt"], v.tables["stops.txt"]
+	tripsIndex, routesIndex, stopsIndex := v.index("trips.txt", "trip_id"), v.index("routes.txt", "route_id"), v.index("stops.txt", "stop_id")
+	coordinates := func(stopTimes *gtfsTable, row *gtfsRow) (lat, lon float64, ok bool) {
+		stop := stopsIndex[stopTimes.get(row, "stop_id")]
+		if stop == nil {
+			return 0, 0, false
+		}
+		lat, latErr := strconv.ParseFloat(stops.get(stop, "stop_lat"), 64)
+		lon, lonErr := strconv.ParseFloat(stops.get(stop, "stop_lon"), 64)
+		return lat, lon, latErr == nil && lonErr == nil
+	}
+	v.eachTrip(func(stopTimes *gtfsTable, tripId string, rows []*gtfsRow) {
+		routeType := -1
+		if trip := tripsIndex[tripId]; trip != nil {
+			if route := routesIndex[trips.get(trip, "route_id")]; route != nil {
+				if t, err := strconv.Atoi(routes.get(route, "route_type")); err == nil {
+					routeType = basicRouteType(t)
+				}
+			}
+		}
+
+		var from *gtfsRow
+		var departure uint
+		var distance float64
+		located := true
+		lat, lon, _ := coordinates(stopTimes, rows[0])
+		for i, row := range rows {
+			nextLat, nextLon, ok := coordinates(stopTimes, row)
+			if !ok {
+				located = false
+			} else if i > 0 {
+				distance += geo.Haversine(lat, lon, nextLat, nextLon)
+			}
+			lat, lon = nextLat, nextLon
+
+			arrival, nextDeparture, timed := stopTimeTimes(stopTimes, row)
+			if !timed {
+				continue
+			}
+			if from != nil && located {
+				handler(stopTimes, from, row, int(arrival)-int(departure), distance, routeType)
+			}
+			from, departure, distance, located = row, nextDeparture, 0, ok
+		}
+	})
+}
+
+func checkTravelSpeeds(v *validation) {
+	v.eachTimedHop(func(stopTimes *gtfsTable, from, to *gtfsRow, duration int, distance float64, routeType int) {
+		maxSpeed, ok := v.MaxSpeeds[routeType]
+		if !ok || duration <= 0 {
+			return
+		}
+		if speed := distance / float64(duration) * 3.6; speed > maxSpeed {
+			v.notice(stopTimes.file, to, v.entityId(stopTimes.file, to), "arrival_time", stopTimes.get(to, "arrival_time"),
+				strconv.Itoa(int(speed))+" km/h from stop_sequence "+stopTimes.get(from, "stop_sequence")+
+					" ("+strconv.Itoa(int(distance))+" m in "+strconv.Itoa(duration)+" s)")
+		}
+	})
+}
+
+func checkZeroDurationHops(v *validation) {
+	v.eachTimedHop(func(stopTimes *gtfsTable, from, to *gtfsRow, duration int, distance float64, routeType int) {
+		if duration == 0 && distance > v.MaxZeroDurationHop {
+			v.notice(stopTimes.file, to, v.entityId(stopTimes.file, to), "arrival_time", stopTimes.get(to, "arrival_time"),
+				strconv.Itoa(int(distance))+" m from stop_sequence "+stopTimes.get(from, "stop_sequence")+" in no time")
+		}
+	})
+}
@@ -0,0 +1,394 @@
+package gtfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Severity of a validation notice
+type Severity int
+
+const (
+	SeverityInfo    Severity = iota // 0 - Information, nothing to fix
+	SeverityWarning                 // 1 - Likely a data quality issue, the feed remains usable
+	SeverityError                   // 2 - The feed doesn't follow the specification, consumers may reject it
+)
+
+var severityNames = []string{"INFO", "WARNING", "ERROR"}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return "UNKNOWN"
+	}
+	return severityNames[s]
+}
+
+func (s Severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// Notice is a finding of the validator, the field names of its JSON encoding are the ones of the
+// canonical GTFS validator (https://github.com/MobilityData/gtfs-validator)
+type Notice struct {
+	Code     string   `json:"-"`
+	Severity Severity `json:"-"`
+
+	File     string `json:"filename,omitempty"`
+	Line     int    `json:"csvRowNumber,omitempty"` // The header being line 1, 0 for the whole file or feed
+	EntityId string `json:"entityId,omitempty"`
+	Field    string `json:"fieldName,omitempty"`
+	Value    string `json:"fieldValue,omitempty"`
+	Message  string `json:"message"`
+}
+
+// ValidationRule is a check of the validator, see ValidationRules for the catalogue
+type ValidationRule struct {
+	Code        string
+	Severity    Severity
+	Description string
+
+	check func(v *validation)
+}
+
+// Validator checks a feed against the rules of the GTFS specification. It reads the files of the
+// feed itself, the feed doesn't need to be loaded (and may not load at all). Feeds without files
+// (NewFeed(""), like the FeedMerger and FeedSubset results) are checked as Feed.Write would write
+// them, the notices' lines are the ones of those files.
+type Validator struct {
+	// Default: ValidationRules
+	Rules []*ValidationRule
+
+	Today              time.Time // Reference date of the calendar rules. Default: time.Now()
+	MaxShapeDistance   float64   // In meters, between a stop and the shape of its trips. Default: 100
+	MaxZeroDurationHop float64   // In meters, between two stops scheduled at the same time. Default: 1000
+
+	// In km/h, by basic route type (extended types count as the closest basic one). Default: DefaultMaxSpeeds
+	MaxSpeeds map[int]float64
+
+	feed *Feed
+}
+
+func NewValidator(f *Feed) (v *Validator) {
+	v = &Validator{}
+	v.Rules = ValidationRules
+	v.Today = time.Now()
+	v.MaxShapeDistance = 100
+	v.MaxZeroDurationHop = 1000
+	v.MaxSpeeds = DefaultMaxSpeeds
+	v.feed = f
+	return
+}
+
+// gtfsTable is a file of the feed as read by the validator, values are kept as strings
+type gtfsTable struct {
+	file    string
+	header  []string
+	columns map[string]int
+	rows    []*gtfsRow
+}
+
+type gtfsRow struct {
+	line   int
+	values []string
+}
+
+// get returns the value of column in row, "" if the column or the table is missing
+func (t *gtfsTable) get(row *gtfsRow, column string) string {
+	if t == nil {
+		return ""
+	}
+	if i, ok := t.columns[column]; ok && i < len(row.values) {
+		return row.values[i]
+	}
+	return ""
+}
+
+func (t *gtfsTable) has(column string) bool {
+	if t == nil {
+		return false
+	}
+	_, ok := t.columns[column]
+	return ok
+}
+
+// validation is a run of the validator
+type validation struct {
+	*Validator
+
+	files   []string // All the files of the feed, GTFS or not
+	tables  map[string]*gtfsTable
+	broken  []*ParseError // Lines the parser couldn't read
+	indexes map[string]map[string]*gtfsRow
+	trips   map[string][]*gtfsRow // stop_times.txt rows by trip, see tripStopTimes
+
+	rule    *ValidationRule
+	notices []*Notice
+}
+
+// notice reports a finding of the current rule, row may be nil for file or feed wide findings
+func (v *validation) notice(file string, row *gtfsRow, entityId, field, value, message string) {
+	n := &Notice{Code: v.rule.Code, Severity: v.rule.Severity, File: file, EntityId: entityId, Field: field, Value: value, Message: message}
+	if row != nil {
+		n.Line = row.line
+	}
+	v.notices = append(v.notices, n)
+}
+
+// index returns the first row of file for each value of column
+func (v *validation) index(file, column string) map[string]*gtfsRow {
+	key := file + "#" + column
+	if index, ok := v.indexes[key]; ok {
+		return index
+	}
+	index := make(map[string]*gtfsRow)
+	if table := v.tables[file]; table.has(column) {
+		for _, row := range table.rows {
+			if value := table.get(row, column); value != "" && index[value] == nil {
+				index[value] = row
+			}
+		}
+	}
+	v.indexes[key] = index
+	return index
+}
+
+// entityId returns the key of row, as defined by the schema, to identify it in notices
+func (v *validation) entityId(file string, row *gtfsRow) string {
+	schema := gtfsSchemaFile(file)
+	table := v.tables[file]
+	if schema == nil || table == nil {
+		return ""
+	}
+	values := make([]string, len(schema.keys))
+	for i, key := range schema.keys {
+		values[i] = table.get(row, key)
+	}
+	return strings.Join(values, ",")
+}
+
+func (v *validation) read() error {
+	v.tables = make(map[string]*gtfsTable)
+	v.indexes = make(map[string]map[string]*gtfsRow)
+	return v.readFiles(func(fileName string, reader io.Reader) error {
+		v.files = append(v.files, fileName)
+		if gtfsSchemaFile(fileName) == nil {
+			return nil
+		}
+		table := &gtfsTable{file: fileName, columns: make(map[string]int)}
+		parser := Parser(fileName)
+		err := parser.parseLines(reader, func(k, values []string, lineNumber int) {
+			if table.header == nil {
+				table.header = make([]string, len(k))
+				for i, column := range k {
+					column = strings.TrimSpace(strings.TrimPrefix(column, "\ufeff"))
+					table.header[i] = column
+					if _, ok := table.columns[column]; !ok {
+						table.columns[column] = i
+					}
+				}
+			}
+			table.rows = append(table.rows, &gtfsRow{lineNumber, values})
+		}, func(perr *ParseError) {
+			v.broken = append(v.broken, perr)
+		})
+		if err != nil {
+			// Empty file (no header)
+			if perr, ok := err.(*ParseError); ok && perr.LineNumber == 1 && perr.Message == io.EOF.Error() {
+				v.tables[fileName] = table
+				return nil
+			}
+			return err
+		}
+		v.tables[fileName] = table
+		return nil
+	})
+}
+
+// readFiles calls handler with each file of the feed, or of its loaded model for in-memory feeds
+func (v *validation) readFiles(handler func(fileName string, reader io.Reader) error) error {
+	if v.feed.path != "" {
+		return v.feed.readFiles(handler)
+	}
+	names := make([]string, 0)
+	files := make(map[string]*bytes.Buffer)
+	err := v.feed.writeFiles(func(fileName string) (io.WriteCloser, error) {
+		names = append(names, fileName)
+		files[fileName] = new(bytes.Buffer)
+		return nopWriteCloser{files[fileName]}, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := handler(name, files[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run checks the feed and returns the findings. It only fails if the files can't be read.
+func (v *Validator) Run() (*ValidationReport, error) {
+	run := &validation{Validator: v}
+	if err := run.read(); err != nil {
+		return nil, err
+	}
+	for _, rule := range v.Rules {
+		run.rule = rule
+		rule.check(run)
+	}
+	sort.SliceStable(run.notices, func(i, j int) bool {
+		a, b := run.notices[i], run.notices[j]
+		if a.Severity != b.Severity {
+			return a.Severity > b.Severity
+		}
+		if a.Code != b.Code {
+			return a.Code < b.Code
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+	return &ValidationReport{Feed: v.feed.path, ValidatedAt: time.Now(), Notices: run.notices, rules: v.Rules}, nil
+}
+
+// ValidationReport holds the notices of a validator run
+type ValidationReport struct {
+	Feed        string
+	ValidatedAt time.Time
+	Notices     []*Notice // Errors first, then by code, file and line
+
+	rules []*ValidationRule
+}
+
+// Count returns the number of notices of severity
+func (r *ValidationReport) Count(severity Severity) (count int) {
+	for _, notice := range r.Notices {
+		if notice.Severity == severity {
+			count++
+		}
+	}
+	return
+}
+
+// Valid is true when the report has no errors
+func (r *ValidationReport) Valid() bool {
+	return r.Count(SeverityError) == 0
+}
+
+// NoticeGroup is the notices of a code, as listed in the reports
+type NoticeGroup struct {
+	Code          string    `json:"code"`
+	Severity      Severity  `json:"severity"`
+	Description   string    `json:"-"`
+	TotalNotices  int       `json:"totalNotices"`
+	SampleNotices []*Notice `json:"sampleNotices"`
+}
+
+// Groups returns the notices by code, keeping the first maxSamples notices of each code (all if 0)
+func (r *ValidationReport) Groups(maxSamples int) []*NoticeGroup {
+	descriptions := make(map[string]string)
+	for _, rule := range r.rules {
+		descriptions[rule.Code] = rule.Description
+	}
+	groups := make([]*NoticeGroup, 0)
+	byCode := make(map[string]*NoticeGroup)
+	for _, notice := range r.Notices {
+		group := byCode[notice.Code]
+		if group == nil {
+			group = &NoticeGroup{Code: notice.Code, Severity: notice.Severity, Description: descriptions[notice.Code], SampleNotices: make([]*Notice, 0)}
+			byCode[notice.Code] = group
+			groups = append(groups, group)
+		}
+		group.TotalNotices++
+		if maxSamples == 0 || len(group.SampleNotices) < maxSamples {
+			group.SampleNotices = append(group.SampleNotices, notice)
+		}
+	}
+	return groups
+}
+
+type validationSummary struct {
+	Feed        string         `json:"feed"`
+	ValidatedAt time.Time      `json:"validatedAt"`
+	Counts      map[string]int `json:"counts"`
+}
+
+func (r *ValidationReport) summary() *validationSummary {
+	return &validationSummary{
+		Feed:        r.Feed,
+		ValidatedAt: r.ValidatedAt,
+		Counts: map[string]int{
+			"errors":   r.Count(SeverityError),
+			"warnings": r.Count(SeverityWarning),
+			"infos":    r.Count(SeverityInfo),
+		},
+	}
+}
+
+// WriteJSON writes the report in the layout of the canonical GTFS validator's report.json, with at
+// most maxSamples notices per code (all if 0)
+func (r *ValidationReport) WriteJSON(w io.Writer, maxSamples int) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		Summary *validationSummary `json:"summary"`
+		Notices []*NoticeGroup     `json:"notices"`
+	}{r.summary(), r.Groups(maxSamples)})
+}
+
+var validationReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>GTFS validation report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; font-size: 0.9em; }
+th { background: #f4f4f4; }
+.ERROR { color: #b00020; font-weight: bold; }
+.WARNING { color: #c77700; font-weight: bold; }
+.INFO { color: #1565c0; }
+</style>
+</head>
+<body>
+<h1>GTFS validation report</h1>
+<p>Feed: {{.Summary.Feed}}<br>Validated at: {{.Summary.ValidatedAt.Format "2006-01-02 15:04:05 MST"}}</p>
+<p><span class="ERROR">{{index .Summary.Counts "errors"}} errors</span>,
+<span class="WARNING">{{index .Summary.Counts "warnings"}} warnings</span>,
+<span class="INFO">{{index .Summary.Counts "infos"}} infos</span></p>
+{{if .Groups}}
+<table>
+<tr><th>Code</th><th>Severity</th><th>Description</th><th>Total</th></tr>
+{{range .Groups}}<tr><td><a href="#{{.Code}}">{{.Code}}</a></td><td class="{{.Severity}}">{{.Severity}}</td><td>{{.Description}}</td><td>{{.TotalNotices}}</td></tr>
+{{end}}</table>
+{{range .Groups}}
+<h2 id="{{.Code}}">{{.Code}} <span class="{{.Severity}}">{{.Severity}}</span></h2>
+<p>{{.Description}}</p>
+<table>
+<tr><th>File</th><th>Line</th><th>Entity</th><th>Field</th><th>Value</th><th>Message</th></tr>
+{{range .SampleNotices}}<tr><td>{{.File}}</td><td>{{if .Line}}{{.Line}}{{end}}</td><td>{{.EntityId}}</td><td>{{.Field}}</td><td>{{.Value}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>
+{{if lt (len .SampleNotices) .TotalNotices}}<p>Only the first {{len .SampleNotices}} of {{.TotalNotices}} notices are shown.</p>{{end}}
+{{end}}
+{{else}}
+<p>No issues found.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// WriteHTML writes the report as a web page, with at most maxSamples notices per code (all if 0)
+func (r *ValidationReport) WriteHTML(w io.Writer, maxSamples int) error {
+	return validationReportTemplate.Execute(w, struct {
+		Summary *validationSummary
+		Groups  []*NoticeGroup
+	}{r.summary(), r.Groups(maxSamples)})
+}
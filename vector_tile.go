@@ -0,0 +1,367 @@
+package gtfs
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Mapbox Vector Tile (https://github.com/mapbox/vector-tile-spec, version 2) geometry types and commands
+const (
+	mvtPoint      = 1
+	mvtLineString = 2
+
+	mvtMoveTo = 1
+	mvtLineTo = 2
+)
+
+// pbf is a minimal protocol buffers writer, enough for vector tiles
+type pbf []byte
+
+func (b *pbf) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+func (b *pbf) key(field, wireType int) {
+	b.varint(uint64(field<<3 | wireType))
+}
+
+func (b *pbf) uint(field int, v uint64) {
+	b.key(field, 0)
+	b.varint(v)
+}
+
+func (b *pbf) bytes(field int, v []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *pbf) packed(field int, values []uint32) {
+	var packed pbf
+	for _, v := range values {
+		packed.varint(uint64(v))
+	}
+	b.bytes(field, packed)
+}
+
+func zigzag(v int32) uint32 {
+	return uint32((v << 1) ^ (v >> 31))
+}
+
+// mvtValue is a feature property value: a string or an unsigned integer
+type mvtValue struct {
+	s      string
+	u      uint64
+	number bool
+}
+
+type mvtLayer struct {
+	name     string
+	extent   uint32
+	keys     []string
+	keyIndex map[string]uint32
+	values   []mvtValue
+	valIndex map[mvtValue]uint32
+	features pbf
+}
+
+func newMvtLayer(name string, extent uint32) *mvtLayer {
+	return &mvtLayer{name: name, extent: extent, keyIndex: make(map[string]uint32), valIndex: make(map[mvtValue]uint32)}
+}
+
+// tags encodes the properties of a feature, given as alternating keys and values (string or int)
+func (l *mvtLayer) tags(properties ...interface{}) []uint32 {
+	tags := make([]uint32, 0, len(properties))
+	for i := 0; i+1 < len(properties); i += 2 {
+		key := properties[i].(string)
+		var value mvtValue
+		switch v := properties[i+1].(type) {
+		case string:
+			if v == "" {
+				continue
+			}
+			value = mvtValue{s: v}
+		case int:
+			value = mvtValue{u: uint64(v), number: true}
+		case byte:
+			value = mvtValue{u: uint64(v), number: true}
+		default:
+			continue
+		}
+		k, ok := l.keyIndex[key]
+		if !ok {
+			k = uint32(len(l.keys))
+			l.keys = append(l.keys, key)
+			l.keyIndex[key] = k
+		}
+		index, ok := l.valIndex[value]
+		if !ok {
+			index = uint32(len(l.values))
+			l.values = append(l.values, value)
+			l.valIndex[value] = index
+		}
+		tags = append(tags, k, index)
+	}
+	return tags
+}
+
+func (l *mvtLayer) addFeature(geometryType uint64, geometry []uint32, tags []uint32) {
+	if len(geometry) == 0 {
+		return
+	}
+	var feature pbf
+	feature.packed(2, tags)
+	feature.uint(3, geometryType)
+	feature.packed(4, geometry)
+	l.features.bytes(2, feature)
+}
+
+func (l *mvtLayer) encode() []byte {
+	var layer pbf
+	layer.uint(15, 2)
+	layer.bytes(1, []byte(l.name))
+	layer = append(layer, l.features...)
+	for _, key := range l.keys {
+		layer.bytes(3, []byte(key))
+	}
+	for _, value := range l.values {
+		var v pbf
+		if value.number {
+			v.uint(5, value.u)
+		} else {
+			v.bytes(1, []byte(value.s))
+		}
+		layer.bytes(4, v)
+	}
+	layer.uint(5, uint64(l.extent))
+	return layer
+}
+
+// tileProjection converts coordinates to the integer grid of a tile (Web Mercator)
+type tileProjection struct {
+	z, x, y int
+	extent  float64
+}
+
+func (p tileProjection) project(lat, lon float64) (int32, int32) {
+	n := math.Exp2(float64(p.z))
+	latRad := lat * math.Pi / 180.0
+	px := ((lon+180)/360*n - float64(p.x)) * p.extent
+	py := ((1-math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi)/2*n - float64(p.y)) * p.extent
+	return int32(math.Round(px)), int32(math.Round(py))
+}
+
+// bounds returns the area covered by the tile, enlarged by buffer tile units
+func (p tileProjection) bounds(buffer float64) *BoundingBox {
+	n := math.Exp2(float64(p.z))
+	margin := buffer / p.extent
+	lon := func(x float64) float64 { return x/n*360 - 180 }
+	lat := func(y float64) float64 { return math.Atan(math.Sinh(math.Pi*(1-2*y/n))) * 180 / math.Pi }
+	return &BoundingBox{
+		MinLat: lat(float64(p.y) + 1 + margin),
+		MinLon: lon(float64(p.x) - margin),
+		MaxLat: lat(float64(p.y) - margin),
+		MaxLon: lon(float64(p.x) + 1 + margin),
+	}
+}
+
+// pointGeometry encodes a point
+func (p tileProjection) pointGeometry(lat, lon float64) []uint32 {
+	x, y := p.project(lat, lon)
+	return []uint32{mvtMoveTo | 1<<3, zigzag(x), zigzag(y)}
+}
+
+// lineGeometry encodes the parts of a shape crossing box as line strings
+func (p tileProjection) lineGeometry(points []*ShapePoint, box *BoundingBox) []uint32 {
+	aabb := box.aabb()
+	geometry := make([]uint32, 0)
+	var cursorX, cursorY int32
+	part := make([][2]int32, 0)
+	flush := func() {
+		// Drop the repeated positions, only visible at higher zooms
+		deduplicated := part[:0]
+		for _, position := range part {
+			if len(deduplicated) == 0 || deduplicated[len(deduplicated)-1] != position {
+				deduplicated = append(deduplicated, position)
+			}
+		}
+		if len(deduplicated) >= 2 {
+			geometry = append(geometry, mvtMoveTo|1<<3, zigzag(deduplicated[0][0]-cursorX), zigzag(deduplicated[0][1]-cursorY))
+			geometry = append(geometry, uint32(mvtLineTo|(len(deduplicated)-1)<<3))
+			for i := 1; i < len(deduplicated); i++ {
+				geometry = append(geometry, zigzag(deduplicated[i][0]-deduplicated[i-1][0]), zigzag(deduplicated[i][1]-deduplicated[i-1][1]))
+			}
+			last := deduplicated[len(deduplicated)-1]
+			cursorX, cursorY = last[0], last[1]
+		}
+		part = part[:0]
+	}
+	for i := 1; i < len(points); i++ {
+		a, b := points[i-1], points[i]
+		if !segmentIntersectsAABB(a.Lat, a.Lon, b.Lat, b.Lon, aabb) {
+			flush()
+			continue
+		}
+		if len(part) == 0 {
+			x, y := p.project(a.Lat, a.Lon)
+			part = append(part, [2]int32{x, y})
+		}
+		x, y := p.project(b.Lat, b.Lon)
+		part = append(part, [2]int32{x, y})
+	}
+	flush()
+	return geometry
+}
+
+// VectorTiles renders the feed as Mapbox Vector Tiles with three layers: "stops", "shapes" and
+// "routes" (one line per route and shape). Shapes are simplified according to the zoom level and
+// the tiles are kept in memory, until the feed is reloaded or its shapes change (see Feed.ShapeIndex).
+type VectorTiles struct {
+	Extent         uint32 // Tile resolution. Default: 4096
+	Buffer         uint32 // In tile units, around the tile. Default: 64
+	MinStopsZoom   int    // Stops are left out of lower zoom levels. Default: 13
+	MaxCachedTiles int    // Default: 4096
+
+	feed       *Feed
+	lock       sync.Mutex  // Guards the caches below
+	index      *ShapeIndex // Feed shape index the caches were built with
+	tiles      map[[3]int][]byte
+	tilesOrder [][3]int
+	simplified map[int]map[*Shape]*Shape // By zoom level
+	shapeStops map[string][]*Stop
+}
+
+func NewVectorTiles(f *Feed) (v *VectorTiles) {
+	v = &VectorTiles{}
+	v.Extent = 4096
+	v.Buffer = 64
+	v.MinStopsZoom = 13
+	v.MaxCachedTiles = 4096
+	v.feed = f
+	v.tiles = make(map[[3]int][]byte)
+	v.simplified = make(map[int]map[*Shape]*Shape)
+	return
+}
+
+// Tile returns the encoded tile z/x/y
+func (v *VectorTiles) Tile(z, x, y int) ([]byte, error) {
+	if z < 0 || z > 24 || x < 0 || y < 0 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		return nil, errors.New("Invalid tile coordinates")
+	}
+	key := [3]int{z, x, y}
+	index := v.feed.ShapeIndex()
+	v.lock.Lock()
+	if index != v.index {
+		v.reset(index)
+	}
+	tile, ok := v.tiles[key]
+	v.lock.Unlock()
+	if ok {
+		return tile, nil
+	}
+
+	tile = v.render(index, z, x, y)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if _, ok := v.tiles[key]; !ok && index == v.index {
+		v.tiles[key] = tile
+		v.tilesOrder = append(v.tilesOrder, key)
+		for len(v.tilesOrder) > v.MaxCachedTiles {
+			delete(v.tiles, v.tilesOrder[0])
+			v.tilesOrder = v.tilesOrder[1:]
+		}
+	}
+	return tile, nil
+}
+
+// reset drops the caches built with a previous shape index, v.lock must be held
+func (v *VectorTiles) reset(index *ShapeIndex) {
+	v.index = index
+	v.tiles = make(map[[3]int][]byte)
+	v.tilesOrder = nil
+	v.simplified = make(map[int]map[*Shape]*Shape)
+	v.shapeStops = nil
+}
+
+// simplifiedShape returns shape simplified to about a pixel of a 256 pixels tile at zoom z. The
+// simplification is done without holding the lock, concurrent tiles are rendered in parallel.
+func (v *VectorTiles) simplifiedShape(index *ShapeIndex, shape *Shape, z int) *Shape {
+	v.lock.Lock()
+	simplified, shapeStops := v.simplified[z][shape], v.shapeStops
+	v.lock.Unlock()
+	if simplified != nil {
+		return simplified
+	}
+	if shapeStops == nil {
+		shapeStops = v.feed.ShapeStops()
+	}
+	tolerance := 0.0
+	if len(shape.Points) > 0 {
+		// Meters per pixel at the latitude of the shape
+		tolerance = 156543.03 * math.Cos(shape.Points[0].Lat*math.Pi/180) / math.Exp2(float64(z))
+	}
+	simplified = shape.Simplify(DouglasPeucker, tolerance, shapeStops[shape.Id])
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if index != v.index { // Reloaded meanwhile
+		return simplified
+	}
+	v.shapeStops = shapeStops
+	if v.simplified[z] == nil {
+		v.simplified[z] = make(map[*Shape]*Shape)
+	}
+	if existing := v.simplified[z][shape]; existing != nil {
+		return existing
+	}
+	v.simplified[z][shape] = simplified
+	return simplified
+}
+
+func (v *VectorTiles) render(index *ShapeIndex, z, x, y int) []byte {
+	projection := tileProjection{z, x, y, float64(v.Extent)}
+	box := projection.bounds(float64(v.Buffer))
+
+	var tile pbf
+
+	if z >= v.MinStopsZoom {
+		stops := newMvtLayer("stops", v.Extent)
+		found := v.feed.StopCollection.quadtree().SearchArea(box.aabb())
+		sort.Slice(found, func(i, j int) bool { return found[i].Id < found[j].Id })
+		for _, stop := range found {
+			stops.addFeature(mvtPoint, projection.pointGeometry(stop.Lat, stop.Lon),
+				stops.tags("stop_id", stop.Id, "stop_name", stop.Name, "location_type", stop.LocationType))
+		}
+		tile.bytes(3, stops.encode())
+	}
+
+	shapes := index.ShapesInBox(box.MinLat, box.MinLon, box.MaxLat, box.MaxLon)
+	sort.Slice(shapes, func(i, j int) bool { return shapes[i].Id < shapes[j].Id })
+	shapesLayer := newMvtLayer("shapes", v.Extent)
+	routesLayer := newMvtLayer("routes", v.Extent)
+	for _, shape := range shapes {
+		geometry := projection.lineGeometry(v.simplifiedShape(index, shape, z).Points, box)
+		if len(geometry) == 0 {
+			continue
+		}
+		shapesLayer.addFeature(mvtLineString, geometry, shapesLayer.tags("shape_id", shape.Id, "color", shape.Color))
+		for _, route := range index.RoutesOf(shape) {
+			routesLayer.addFeature(mvtLineString, geometry, routesLayer.tags(
+				"route_id", route.Id,
+				"route_short_name", route.ShortName,
+				"route_type", route.Type,
+				"route_color", route.Color,
+				"shape_id", shape.Id))
+		}
+	}
+	tile.bytes(3, shapesLayer.encode())
+	tile.bytes(3, routesLayer.encode())
+	return tile
+}
@@ -0,0 +1,276 @@
+package gtfs
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Write writes the feed as GTFS .txt files in the path folder (created if needed), or in a zip file
+// if path ends with .zip. Entities are written by id, optional files only when they have rows.
+// Records referencing missing entities (see IntegrityRepair) are not written.
+func (f *Feed) Write(path string) error {
+	if filepath.Ext(path) == ".zip" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		archive := zip.NewWriter(file)
+		err = f.writeFiles(func(fileName string) (io.WriteCloser, error) {
+			w, err := archive.Create(fileName)
+			return nopWriteCloser{w}, err
+		})
+		if err != nil {
+			return err
+		}
+		return archive.Close()
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	return f.writeFiles(func(fileName string) (io.WriteCloser, error) {
+		return os.Create(filepath.Join(path, fileName))
+	})
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// gtfsFileWriter writes the rows of a file
+type gtfsFileWriter struct {
+	name     string
+	required bool
+	header   []string
+	rows     func(write func(row ...string)) // Calls write for each row
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func formatByte(v byte) string {
+	return strconv.Itoa(int(v))
+}
+
+// formatOptional formats v, empty for 0 which stands for an empty field once loaded
+func formatOptional(v float64) string {
+	if v == 0 {
+		return ""
+	}
+	return formatFloat(v)
+}
+
+func (f *Feed) writeFiles(create func(fileName string) (io.WriteCloser, error)) error {
+	for _, file := range f.fileWriters() {
+		rows := make([][]string, 0)
+		file.rows(func(row ...string) {
+			rows = append(rows, row)
+		})
+		if len(rows) == 0 && !file.required {
+			continue
+		}
+		w, err := create(file.name)
+		if err != nil {
+			return err
+		}
+		writer := csv.NewWriter(w)
+		writer.Write(file.header)
+		writer.WriteAll(rows)
+		if err = writer.Error(); err != nil {
+			w.Close()
+			return err
+		}
+		if err = w.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Feed) sortedStops() []*Stop {
+	stops := make([]*Stop, 0, f.StopCollection.Length())
+	for _, stop := range f.StopCollection.Stops {
+		stops = append(stops, stop)
+	}
+	sort.Slice(stops, func(i, j int) bool { return stops[i].Id < stops[j].Id })
+	return stops
+}
+
+func (f *Feed) sortedServiceIds() []string {
+	ids := make([]string, 0, len(f.Calendars))
+	for id := range f.Calendars {
+		ids = append(ids, id)
+	}
+	for id := range f.CalendarDates {
+		if f.Calendars[id] == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// stopTimeFields returns the arrival and departure times to write, empty for stops without time
+// (whose times were interpolated on load)
+func stopTimeFields(st *StopTime) (arrival, departure string) {
+	if !st.hasArrivalTime && !st.hasDepartureTime {
+		return "", ""
+	}
+	return formatTimeOfDay(st.ArrivalTime), formatTimeOfDay(st.DepartureTime)
+}
+
+// fileWriters returns the writers of every GTFS file, in AllFiles order
+func (f *Feed) fileWriters() []*gtfsFileWriter {
+	return []*gtfsFileWriter{
+		{"agency.txt", true, []string{"agency_id", "agency_name", "agency_url", "agency_timezone", "agency_lang", "agency_phone"}, func(write func(...string)) {
+			ids := make([]string, 0, len(f.Agencies))
+			for id := range f.Agencies {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			for _, id := range ids {
+				a := f.Agencies[id]
+				write(a.Id, a.Name, a.Url, a.Timezone, a.Lang, a.Phone)
+			}
+		}},
+		{"stops.txt", true, []string{"stop_id", "stop_code", "stop_name", "stop_desc", "stop_lat", "stop_lon", "zone_id", "stop_url", "location_type", "parent_station", "wheelchair_boarding"}, func(write func(...string)) {
+			for _, s := range f.sortedStops() {
+				write(s.Id, s.Code, s.Name, s.Desc, formatFloat(s.Lat), formatFloat(s.Lon), s.ZoneId, s.Url, formatByte(s.LocationType), s.ParentStationId, formatByte(s.WheelchairBoarding))
+			}
+		}},
+		{"routes.txt", true, []string{"route_id", "agency_id", "route_short_name", "route_long_name", "route_desc", "route_type", "route_url", "route_color", "route_text_color"}, func(write func(...string)) {
+			for _, id := range sortedRouteIds(f.Routes) {
+				r := f.Routes[id]
+				agencyId := r.agencyId
+				if r.Agency != nil {
+					agencyId = r.Agency.Id
+				}
+				write(r.Id, agencyId, r.ShortName, r.LongName, r.Desc, formatByte(r.Type), r.Url, r.Color, r.TextColor)
+			}
+		}},
+		{"trips.txt", true, []string{"route_id", "service_id", "trip_id", "trip_headsign", "trip_short_name", "direction_id", "block_id", "shape_id", "wheelchair_accessible"}, func(write func(...string)) {
+			for _, id := range sortedTripIds(f.Trips) {
+				t := f.Trips[id]
+				routeId := t.routeId
+				if t.Route != nil {
+					routeId = t.Route.Id
+				}
+				write(routeId, t.serviceId, t.Id, t.Headsign, t.ShortName, formatByte(t.Direction), t.BlockId, t.ShapeId, formatByte(t.WheelchairAccessible))
+			}
+		}},
+		{"stop_times.txt", true, []string{"trip_id", "arrival_time", "departure_time", "stop_id", "stop_sequence", "stop_headsign", "pickup_type", "drop_off_type", "shape_dist_traveled"}, func(write func(...string)) {
+			for _, id := range sortedTripIds(f.Trips) {
+				for _, st := range stopTimesOf(f.Trips[id]) {
+					if st.Stop == nil {
+						continue
+					}
+					arrival, departure := stopTimeFields(st)
+					distance := ""
+					if st.hasShapeDistTraveled {
+						distance = formatFloat(st.ShapeDistTraveled)
+					}
+					write(id, arrival, departure, st.Stop.Id, strconv.Itoa(int(st.StopSequence)), st.Headsign, formatByte(st.PickupType), formatByte(st.DropOffType), distance)
+				}
+			}
+		}},
+		{"calendar.txt", false, []string{"service_id", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday", "start_date", "end_date"}, func(write func(...string)) {
+			for _, id := range f.sortedServiceIds() {
+				if c := f.Calendars[id]; c != nil {
+					write(id, boolDigit(c.Monday), boolDigit(c.Tuesday), boolDigit(c.Wednesday), boolDigit(c.Thursday), boolDigit(c.Friday), boolDigit(c.Saturday), boolDigit(c.Sunday), strconv.Itoa(c.StartDate), strconv.Itoa(c.EndDate))
+				}
+			}
+		}},
+		{"calendar_dates.txt", false, []string{"service_id", "date", "exception_type"}, func(write func(...string)) {
+			for _, id := range f.sortedServiceIds() {
+				for _, cd := range f.CalendarDates[id] {
+					exceptionType := strconv.Itoa(CalendarExceptionRemovedService)
+					if cd.ExceptionType == CalendarExceptionAddedService {
+						exceptionType = strconv.Itoa(CalendarExceptionAddedService)
+					}
+					write(id, strconv.Itoa(cd.Date), exceptionType)
+				}
+			}
+		}},
+		{"fare_attributes.txt", false, []string{"fare_id", "price", "currency_type", "payment_method", "transfers", "transfer_duration"}, func(write func(...string)) {
+			ids := make([]string, 0, len(f.FareAttributes))
+			for id := range f.FareAttributes {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			for _, id := range ids {
+				fa := f.FareAttributes[id]
+				transfers := ""
+				if fa.Transfers != TransfersUnlimited {
+					transfers = formatByte(fa.Transfers)
+				}
+				write(fa.Id, formatFloat(fa.Price), fa.CurrencyType, formatByte(fa.PaymentMethod), transfers, formatOptional(float64(fa.TransferDuration)))
+			}
+		}},
+		{"fare_rules.txt", false, []string{"fare_id", "route_id", "origin_id", "destination_id", "contains_id"}, func(write func(...string)) {
+			for _, fr := range f.FareRules {
+				write(fr.Id, fr.RouteId, fr.OriginId, fr.DestinationId, fr.ContainsId)
+			}
+		}},
+		{"shapes.txt", false, []string{"shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence", "shape_dist_traveled"}, func(write func(...string)) {
+			ids := make([]string, 0, len(f.Shapes))
+			for id := range f.Shapes {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			for _, id := range ids {
+				for _, p := range f.Shapes[id].Points {
+					distance := ""
+					if p.hasDistanceTraveled {
+						distance = formatFloat(p.DistanceTraveled)
+					}
+					write(id, formatFloat(p.Lat), formatFloat(p.Lon), strconv.Itoa(p.PointSequence), distance)
+				}
+			}
+		}},
+		{"frequencies.txt", false, []string{"trip_id", "start_time", "end_time", "headway_secs"}, func(write func(...string)) {
+			for _, id := range sortedTripIds(f.Trips) {
+				for _, freq := range f.Trips[id].Frequencies {
+					write(id, formatTimeOfDay(freq.StartTime), formatTimeOfDay(freq.EndTime), strconv.Itoa(int(freq.HeadwaySecs)))
+				}
+			}
+		}},
+		{"transfers.txt", false, []string{"from_stop_id", "to_stop_id", "transfer_type", "min_transfer_time"}, func(write func(...string)) {
+			for _, stop := range f.sortedStops() {
+				toIds := make([]string, 0, len(stop.Transfers))
+				for toId := range stop.Transfers {
+					toIds = append(toIds, toId)
+				}
+				sort.Strings(toIds)
+				for _, toId := range toIds {
+					t := stop.Transfers[toId]
+					minTime := ""
+					if t.TransferType == TransferRequiresMinTransferTime || t.MinTransferTime != 0 {
+						minTime = strconv.Itoa(t.MinTransferTime)
+					}
+					write(stop.Id, toId, formatByte(t.TransferType), minTime)
+				}
+			}
+		}},
+		{"pathways.txt", false, []string{"pathway_id", "from_stop_id", "to_stop_id", "pathway_mode", "is_bidirectional", "length", "traversal_time", "stair_count"}, func(write func(...string)) {
+			written := make(map[*Pathway]bool)
+			for _, stop := range f.sortedStops() {
+				for _, p := range stop.Pathways {
+					if written[p] {
+						continue
+					}
+					written[p] = true
+					write(p.Id, p.FromStopId, p.ToStopId, formatByte(p.PathwayMode), boolDigit(p.IsBidirectional), formatOptional(p.Length), formatOptional(float64(p.TraversalTime)), formatOptional(float64(p.StairCount)))
+				}
+			}
+		}},
+	}
+}